@@ -34,12 +34,16 @@ type OtcService struct {
 	db     *mongo.Database
 }
 
-func getConfig() (mongoConf *mongo.Config, svcConf service.Config, err error) {
+func getConfig() (mongoConf *mongo.Config, svcConf service.Config, otcConf rpc.Config, err error) {
 	v, err := config.LoadConfig("service.otc")
 	err = v.ReadInConfig()
 	if err != nil {
 		return
 	}
+	otcConf, err = rpc.GetConfig(v)
+	if err != nil {
+		return
+	}
 
 	mongoConf, err = mongo.GetConfig(v)
 	if err != nil {
@@ -69,6 +73,7 @@ func (s *OtcService) Run(ctx context.Context) {
 	}
 	gs := grpc.NewServer()
 	pb.RegisterOtcTradingServer(gs, s.rpc)
+	rpc.RegisterOtcTradingExtensionServer(gs, s.rpc)
 	grpc_health_v1.RegisterHealthServer(gs, s.health)
 	s.health.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
 	// Register reflection service on gRPC server.
@@ -95,7 +100,7 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	mgoConf, svcCfg, err := getConfig()
+	mgoConf, svcCfg, otcCfg, err := getConfig()
 	db := mongo.Connect(ctx, *mgoConf)
 	defer db.Close(ctx)
 	log.Infof("service config: %v", svcCfg)
@@ -105,6 +110,7 @@ func main() {
 		log.Fatal("failed to create api ")
 	}
 	otcServer := rpc.NewOtcTradingServer(api, db)
+	otcServer.SetConfig(otcCfg)
 	otc := &OtcService{
 		rpc:    otcServer,
 		db:     db,
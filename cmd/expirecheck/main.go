@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"gitlab.com/sdce/exlib/service"
+	"gitlab.com/sdce/service/otc/pkg/api"
 	"gitlab.com/sdce/service/otc/pkg/expireworker"
 	"gitlab.com/sdce/service/otc/pkg/otcapi"
 
@@ -17,7 +18,7 @@ const (
 	serviceName = "service.otc"
 )
 
-func getConfigs() (mongoConf *mongo.Config, svcConf service.Config, err error) {
+func getConfigs() (mongoConf *mongo.Config, svcConf service.Config, workerConf expireworker.Config, err error) {
 	v, err := config.LoadConfig(serviceName)
 	if err != nil {
 		log.Errorf("Failed to load configs: %v", err)
@@ -32,6 +33,7 @@ func getConfigs() (mongoConf *mongo.Config, svcConf service.Config, err error) {
 	if err != nil {
 		return
 	}
+	workerConf, err = expireworker.GetConfig(v)
 	return
 }
 
@@ -41,7 +43,7 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel() // Just in case
 
-	mongoConf, svcConf, err := getConfigs()
+	mongoConf, svcConf, workerConf, err := getConfigs()
 	if err != nil {
 		log.Fatalln("Cannot read config: ", err)
 	}
@@ -56,7 +58,12 @@ func main() {
 		log.Fatal("failed to create otc api ")
 	}
 
-	expireWorker := expireworker.NewExpireCheckService(otcapi, db)
+	apis, err := api.New(&svcConf)
+	if err != nil {
+		log.Fatal("failed to create member api ")
+	}
+
+	expireWorker := expireworker.NewExpireCheckService(otcapi, apis, db, workerConf)
 
 	wg := sync.WaitGroup{}
 
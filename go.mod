@@ -6,7 +6,7 @@ require (
 	github.com/magiconair/properties v1.8.1 // indirect
 	github.com/robfig/cron v1.2.0
 	github.com/sirupsen/logrus v1.4.2
-	github.com/spf13/viper v1.4.0 // indirect
+	github.com/spf13/viper v1.4.0
 	github.com/tidwall/pretty v1.0.0 // indirect
 	gitlab.com/sdce/exlib v0.0.0-20190808050506-08e34ed1b2d3
 	gitlab.com/sdce/protogo v0.0.0-20200110032919-43f6f0e7c365
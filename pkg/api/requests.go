@@ -91,9 +91,8 @@ func (s *Server) newLockBalanceRequest(ctx context.Context, lr *LockBalance) (re
 
 	amount := new(big.Int).Sub(lr.ToAmount, lr.FromAmount)
 
-	// cannot change as more balance has been locked
+	// cannot change as more balance has been locked, decreases are released instead
 	if amount.Sign() <= 0 {
-		// TODO should not throw error when updating to less amount
 		return nil, grpc.Errorf(codes.PermissionDenied, "balance has been locked!")
 	}
 
@@ -2,55 +2,168 @@ package expireworker
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"math/big"
+	"time"
 
 	"github.com/robfig/cron"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"gitlab.com/sdce/exlib/exutil"
 	"gitlab.com/sdce/exlib/mongo"
 	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/api"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
 	"gitlab.com/sdce/service/otc/pkg/otcapi"
 	"gitlab.com/sdce/service/otc/pkg/repository"
 )
 
+const (
+	defaultReleaseWarning   = time.Hour
+	defaultRebateSettlement = "@hourly"
+	// rebateSettlementBatch is how many rebates are paid out per run at most
+	rebateSettlementBatch = 500
+)
+
+// errNoReferrerAccount is returned for rebates of referrers without an account for the coin
+var errNoReferrerAccount = errors.New("referrer has no account for the coin")
+
 type ExpireCheckService interface {
 }
 
+// Config holds the settings of the expire worker in the "otc" section of the service config
+type Config struct {
+	// ReleaseWarning is how long before its release deadline the seller of a paid order is warned
+	ReleaseWarning time.Duration
+	// RebateSettlement is the cron spec of paying out accrued rebates to referrers
+	RebateSettlement string
+	// FeeAccountOwner is the member owning the platform accounts fees are collected in, which
+	// rebates are paid from. Rebates are not paid out without it.
+	FeeAccountOwner *pb.UUID
+}
+
+// GetConfig reads the expire worker settings, using defaults for the ones not set
+func GetConfig(v *viper.Viper) (Config, error) {
+	v.SetDefault("otc.releaseWarning", defaultReleaseWarning)
+	v.SetDefault("otc.rebateSettlement", defaultRebateSettlement)
+	conf := Config{
+		ReleaseWarning:   v.GetDuration("otc.releaseWarning"),
+		RebateSettlement: v.GetString("otc.rebateSettlement"),
+	}
+	if s := v.GetString("otc.feeAccountOwner"); s != "" {
+		owner, err := exutil.AtoUUID(s)
+		if err != nil {
+			return conf, fmt.Errorf("invalid fee account owner %q: %v", s, err)
+		}
+		conf.FeeAccountOwner = owner
+	}
+	return conf, nil
+}
+
+// Notifier tells the parties of an order about it
+type Notifier interface {
+	// ReleaseDeadlineWarning tells the seller of a paid order to release coin before the order is appealed
+	ReleaseDeadlineWarning(ctx context.Context, order *pb.OtcOrder) error
+}
+
+// logNotifier only logs notifications. Telling the seller is deferred until this service can
+// reach a messaging service, which is then wired in with SetNotifier.
+type logNotifier struct{}
+
+func (logNotifier) ReleaseDeadlineWarning(ctx context.Context, order *pb.OtcOrder) error {
+	log.Warnf("Order %s is paid and will be appealed unless coin is released soon", exutil.UUIDtoA(order.Id))
+	return nil
+}
+
 type expireCheckManager struct {
 	trades         repository.OtcTradeRepository
+	quotes         repository.QuoteRepository
 	currencyOrders repository.CurrencyOrderRepository
+	rebates        repository.RebateLedgerRepository
 	otcApis        otcapi.OTCApi
+	apis           api.Api
+	notifier       Notifier
+	conf           Config
 }
 
-func NewExpireCheckService(otcApi otcapi.OTCApi, db *mongo.Database) *expireCheckManager {
+func NewExpireCheckService(otcApi otcapi.OTCApi, apis api.Api, db *mongo.Database, conf Config) *expireCheckManager {
 	return &expireCheckManager{
 		trades:         repository.NewOtcTradeRepository(db),
+		quotes:         repository.NewQuoteRepo(db),
 		currencyOrders: repository.NewCurrencyOrderRepo(db),
+		rebates:        repository.NewRebateLedgerRepo(db),
 		otcApis:        otcApi,
+		apis:           apis,
+		notifier:       logNotifier{},
+		conf:           conf,
 	}
 }
 
+// SetNotifier replaces the notifier, which only logs by default
+func (ecm *expireCheckManager) SetNotifier(n Notifier) {
+	ecm.notifier = n
+}
+
 func (ecm *expireCheckManager) Run(ctx context.Context) error {
 	c := cron.New()
 	c.AddFunc("@every 1m", func() {
-		//for currency order
 		log.Info("This is from the expiration check cron job every minute.")
-		err := ecm.currencyOrders.UpdateExpiredCurrencyOrders(ctx)
-		if err != nil {
-			log.Errorf("Fail to update expired currency orders: %v", err)
-		}
-		//for otc order
-		err = ecm.updateExpiredOtcOrder(ctx)
+		ecm.CheckExpiry(ctx)
+	})
+	if ecm.conf.FeeAccountOwner == nil {
+		log.Warn("No fee account owner is configured, rebates are not paid out")
+	} else {
+		err := c.AddFunc(ecm.conf.RebateSettlement, func() {
+			err := ecm.SettleRebates(ctx)
+			if err != nil {
+				log.Errorf("Fail to settle rebates: %v", err)
+			}
+		})
 		if err != nil {
-			log.Errorf("Fail to expire otc order! : %v", err)
+			return fmt.Errorf("invalid rebate settlement schedule %q: %v", ecm.conf.RebateSettlement, err)
 		}
-	})
+	}
 	c.Start()
 	<-ctx.Done()
 	c.Stop()
 	return fmt.Errorf("Cron job of expiration check stopped unexpectedly.")
 }
 
+// CheckExpiry runs the checks made every minute once
+func (ecm *expireCheckManager) CheckExpiry(ctx context.Context) {
+	//for currency order
+	err := ecm.currencyOrders.UpdateExpiredCurrencyOrders(ctx)
+	if err != nil {
+		log.Errorf("Fail to update expired currency orders: %v", err)
+	}
+	//for otc order
+	err = ecm.updateExpiredOtcOrder(ctx)
+	if err != nil {
+		log.Errorf("Fail to expire otc order! : %v", err)
+	}
+	//for paid otc order the seller does not release
+	err = ecm.warnUnreleasedOtcOrder(ctx)
+	if err != nil {
+		log.Errorf("Fail to warn unreleased otc order: %v", err)
+	}
+	err = ecm.appealOverdueOtcOrder(ctx)
+	if err != nil {
+		log.Errorf("Fail to appeal overdue otc order: %v", err)
+	}
+	//for quotes with trading hours
+	err = ecm.scheduleQuotes(ctx)
+	if err != nil {
+		log.Errorf("Fail to schedule quotes: %v", err)
+	}
+	//for quotes past their listing expiry
+	err = ecm.closeExpiredQuotes(ctx)
+	if err != nil {
+		log.Errorf("Fail to close expired quotes: %v", err)
+	}
+}
+
 func (ecm *expireCheckManager) updateExpiredOtcOrder(ctx context.Context) (err error) {
 	expiredOrders, err := ecm.trades.SearchExpiredOtcOrders(ctx)
 	if err != nil {
@@ -61,6 +174,7 @@ func (ecm *expireCheckManager) updateExpiredOtcOrder(ctx context.Context) (err e
 	if len(expiredOrders) == 0 {
 		return nil
 	}
+	ctx = otcapi.WithActor(ctx, nil, orderstate.RoleSystem)
 	for _, order := range expiredOrders {
 		req := &pb.UpdateOtcOrderStatusRequest{
 			OrderId: order.GetId(),
@@ -75,3 +189,218 @@ func (ecm *expireCheckManager) updateExpiredOtcOrder(ctx context.Context) (err e
 	}
 	return
 }
+
+// warnUnreleasedOtcOrder warns the sellers of paid orders due within the release warning.
+// An order which fails is warned again next run.
+func (ecm *expireCheckManager) warnUnreleasedOtcOrder(ctx context.Context) (err error) {
+	orders, err := ecm.trades.SearchUnwarnedPaidOrders(ctx, time.Now().Add(ecm.conf.ReleaseWarning).UnixNano())
+	if err != nil {
+		log.Errorf("Search unreleased otc order err: %v", err)
+		return
+	}
+	failed := 0
+	for _, order := range orders {
+		err := ecm.notifier.ReleaseDeadlineWarning(ctx, order)
+		if err != nil {
+			log.Errorf("Warn unreleased otc order err: %v orderId: %s", err, exutil.UUIDtoA(order.Id))
+			failed++
+			continue
+		}
+		err = ecm.trades.MarkReleaseWarned(ctx, order.Id)
+		if err != nil {
+			log.Errorf("Mark unreleased otc order warned err: %v orderId: %s", err, exutil.UUIDtoA(order.Id))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d unreleased orders not warned", failed, len(orders))
+	}
+	return nil
+}
+
+func (ecm *expireCheckManager) appealOverdueOtcOrder(ctx context.Context) (err error) {
+	overdueOrders, err := ecm.trades.SearchOverduePaidOrders(ctx)
+	if err != nil {
+		log.Errorf("Search overdue otc order err: %v", err)
+		return
+	}
+	log.Infof("There are %d overdue otc orders found.", len(overdueOrders))
+	if len(overdueOrders) == 0 {
+		return nil
+	}
+	ctx = otcapi.WithActor(ctx, nil, orderstate.RoleSystem)
+	failed := 0
+	for _, order := range overdueOrders {
+		req := &pb.UpdateOtcOrderStatusRequest{
+			OrderId: order.GetId(),
+			Status:  pb.OtcOrder_APPEAL,
+		}
+		err := ecm.otcApis.UpdateOrder(ctx, req)
+		if err != nil {
+			// still paid, it is appealed again next run
+			log.Errorf("Appeal overdue otc order err: %v orderId: %s", err, exutil.UUIDtoA(order.Id))
+			failed++
+			continue
+		}
+		log.Infof("Overdue order: %s appealed", exutil.UUIDtoA(order.Id))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d overdue orders not appealed", failed, len(overdueOrders))
+	}
+	return nil
+}
+
+// scheduleQuotes turns scheduled quotes off outside their trading hours or once their owner
+// is inactive, and back on when they open again
+func (ecm *expireCheckManager) scheduleQuotes(ctx context.Context) (err error) {
+	quotes, err := ecm.quotes.SearchScheduledQuotes(ctx)
+	if err != nil {
+		log.Errorf("Search scheduled quotes err: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, q := range quotes {
+		open, err := q.Schedule.Open(now)
+		if err != nil {
+			log.Errorf("Invalid schedule of quote %s: %v", exutil.UUIDtoA(q.Id), err)
+			continue
+		}
+		var from, to pb.Quote_QuoteStatus
+		switch {
+		case q.Status == pb.Quote_ON && !open:
+			from, to = pb.Quote_ON, pb.Quote_OFF
+		case q.Status == pb.Quote_OFF && q.Schedule.Off && open:
+			from, to = pb.Quote_OFF, pb.Quote_ON
+		default:
+			continue
+		}
+		err = ecm.quotes.SetScheduledQuoteStatus(ctx, q.Id, from, to, exutil.NewUUID())
+		if err == repository.ErrQuoteModified {
+			// changed since it was searched, it is looked at again next run
+			continue
+		}
+		if err != nil {
+			log.Errorf("Set scheduled quote status err: %v quoteId: %s", err, exutil.UUIDtoA(q.Id))
+			return err
+		}
+		log.Infof("Scheduled quote %s turned %s", exutil.UUIDtoA(q.Id), to)
+	}
+	return nil
+}
+
+// closeExpiredQuotes closes the quotes past their listing expiry, releasing what they lock like
+// a close by their owner. A quote with open orders closes once they finish.
+func (ecm *expireCheckManager) closeExpiredQuotes(ctx context.Context) (err error) {
+	quotes, err := ecm.quotes.SearchExpiredQuotes(ctx, time.Now().UnixNano())
+	if err != nil {
+		log.Errorf("Search expired quotes err: %v", err)
+		return
+	}
+	log.Infof("There are %d expired quotes found.", len(quotes))
+	ctx = otcapi.WithActor(ctx, nil, orderstate.RoleSystem)
+	for _, q := range quotes {
+		err = ecm.otcApis.DeleteQuote(ctx, &pb.DeleteQuoteRequest{Id: q.Id})
+		if err != nil {
+			// a quote busy with an order is looked at again next run
+			log.Errorf("Close expired quote err: %v quoteId: %s", err, exutil.UUIDtoA(q.Id))
+			continue
+		}
+		log.Infof("Expired quote: %s closed", exutil.UUIDtoA(q.Id))
+	}
+	return nil
+}
+
+// SettleRebates pays accrued rebates out to the referrers from the platform fee account. A
+// rebate is credited with an event derived from it, so crediting it again after a failure to
+// mark it paid is a no-op. A rebate which fails is retried next run.
+func (ecm *expireCheckManager) SettleRebates(ctx context.Context) (err error) {
+	if ecm.conf.FeeAccountOwner == nil {
+		return fmt.Errorf("no fee account owner is configured")
+	}
+	rebates, err := ecm.rebates.SearchUnpaidRebates(ctx, rebateSettlementBatch)
+	if err != nil {
+		log.Errorf("Search unpaid rebates err: %v", err)
+		return
+	}
+	log.Infof("There are %d unpaid rebates found.", len(rebates))
+	failed := 0
+	for _, r := range rebates {
+		err := ecm.payRebate(ctx, r)
+		if err == errNoReferrerAccount {
+			// the rebate waits for the referrer to open one
+			log.Warnf("No %s account of referrer %s for rebate %s", r.Currency, exutil.UUIDtoA(r.Referrer), exutil.UUIDtoA(r.Id))
+			continue
+		}
+		if err != nil {
+			log.Errorf("Pay rebate err: %v rebateId: %s", err, exutil.UUIDtoA(r.Id))
+			failed++
+			continue
+		}
+		log.Infof("Rebate %s of %s %s paid", exutil.UUIDtoA(r.Id), r.Amount, r.Currency)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d rebates not paid", failed, len(rebates))
+	}
+	return nil
+}
+
+// rebatePayoutId is the event rebate r is credited with
+func rebatePayoutId(r *repository.RebateEntry) *pb.UUID {
+	h := sha256.New()
+	h.Write(r.Id.Bytes)
+	h.Write([]byte("payout"))
+	return &pb.UUID{Bytes: h.Sum(nil)[:len(r.Id.Bytes)]}
+}
+
+func (ecm *expireCheckManager) payRebate(ctx context.Context, r *repository.RebateEntry) error {
+	amount, ok := new(big.Int).SetString(r.Amount, 10)
+	if !ok {
+		return fmt.Errorf("invalid rebate amount %q", r.Amount)
+	}
+	platform, err := ecm.apis.FindMemberAccount(ctx, ecm.conf.FeeAccountOwner, r.CoinId)
+	if err != nil {
+		return err
+	}
+	if len(platform) == 0 {
+		return fmt.Errorf("no %s fee account", r.Currency)
+	}
+	referrer, err := ecm.apis.FindMemberAccount(ctx, r.Referrer, r.CoinId)
+	if err != nil {
+		return err
+	}
+	if len(referrer) == 0 {
+		return errNoReferrerAccount
+	}
+	payoutId := rebatePayoutId(r)
+	err = ecm.apis.LockAccountBalance(ctx, &api.LockBalance{
+		FromAmount: big.NewInt(0),
+		ToAmount:   amount,
+		MemberId:   ecm.conf.FeeAccountOwner,
+		CoinId:     r.CoinId,
+		ActivityId: payoutId,
+		Source:     pb.ActivitySource_ORDER,
+	})
+	if err != nil {
+		return err
+	}
+	err = ecm.apis.ReleaselockedBalance(ctx, &pb.ReleaseLockedBalanceRequest{
+		From:   platform[0].Id,
+		To:     referrer[0].Id,
+		Amount: r.Amount,
+		Order: &pb.OrderRef{
+			Id: r.OrderId,
+		},
+		Event: &pb.OrderEvent{
+			Id: payoutId,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = ecm.rebates.MarkRebatePaid(ctx, r.Id, payoutId, time.Now().UnixNano())
+	if err == repository.ErrRebatePaid {
+		// paid by an overlapping run
+		return nil
+	}
+	return err
+}
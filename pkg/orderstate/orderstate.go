@@ -0,0 +1,207 @@
+// Package orderstate defines the status transitions of an OTC order. The rpc layer uses it
+// to decide which side effects to run and the repository uses it to guard status writes,
+// so both always agree on what is allowed.
+package orderstate
+
+import (
+	"fmt"
+	"time"
+
+	pb "gitlab.com/sdce/protogo"
+)
+
+// Role is the part a member plays in an order
+type Role string
+
+const (
+	// RoleBuyer receives coin and pays the quote currency
+	RoleBuyer Role = "BUYER"
+	// RoleSeller sends coin and receives the quote currency
+	RoleSeller Role = "SELLER"
+	RoleAdmin  Role = "ADMIN"
+	// RoleSystem is used by background jobs such as the expire worker
+	RoleSystem Role = "SYSTEM"
+)
+
+const (
+	// ActorIdHeader is the grpc metadata key of the member acting on an order
+	ActorIdHeader = "actor-id"
+	// ActorRoleHeader is the grpc metadata key of the role of an admin or internal job acting
+	// on an order
+	ActorRoleHeader = "actor-role"
+)
+
+// Hook is a side effect of a transition, run by the rpc layer
+type Hook int
+
+const (
+	// HookPay moves the order value from the buyer to the seller
+	HookPay Hook = iota + 1
+	// HookRefund moves the order value back from the seller to the buyer
+	HookRefund
+	// HookReleaseCoin moves the order volume from the seller to the buyer and charges the fee.
+	// It cannot be undone, so it runs after the other hooks which move funds.
+	HookReleaseCoin
+	// HookReleaseLock returns the balance locked for the order to the order member
+	HookReleaseLock
+	// HookReleasePending releases the pending amount of the buyer
+	HookReleasePending
+	// HookQuoteComplete removes the order volume from the processing volume of the quote
+	HookQuoteComplete
+	// HookQuoteRestore puts the order volume, value and fee back onto the quote
+	HookQuoteRestore
+	// HookSettleAppeal moves the funds of an appealed order as decided by an arbitrator
+	HookSettleAppeal
+)
+
+var hookNames = map[Hook]string{
+	HookPay:            "pay",
+	HookRefund:         "refund",
+	HookReleaseCoin:    "release coin",
+	HookReleaseLock:    "release lock",
+	HookReleasePending: "release pending",
+	HookQuoteComplete:  "complete quote",
+	HookQuoteRestore:   "restore quote",
+	HookSettleAppeal:   "settle appeal",
+}
+
+func (h Hook) String() string {
+	return hookNames[h]
+}
+
+// IsQuoteUpdate reports whether the hook writes to the quote collection. Such hooks run
+// in the same transaction as the status change, after all other hooks have succeeded.
+func (h Hook) IsQuoteUpdate() bool {
+	return h == HookQuoteComplete || h == HookQuoteRestore
+}
+
+// Precondition is checked against the order before a transition is made
+type Precondition func(order *pb.OtcOrder) error
+
+// Transition is an allowed change of order status
+type Transition struct {
+	From pb.OtcOrder_OrderStatus
+	To   pb.OtcOrder_OrderStatus
+	// Roles which may trigger the transition
+	Roles         []Role
+	Preconditions []Precondition
+	// Hooks run in order
+	Hooks []Hook
+}
+
+type edge struct {
+	from, to pb.OtcOrder_OrderStatus
+}
+
+var transitions = map[edge]*Transition{}
+
+func init() {
+	for _, t := range []*Transition{
+		{
+			From:  pb.OtcOrder_UNPAID,
+			To:    pb.OtcOrder_PAID,
+			Roles: []Role{RoleBuyer},
+			Hooks: []Hook{HookPay},
+		},
+		{
+			From: pb.OtcOrder_UNPAID,
+			To:   pb.OtcOrder_CANCELLED,
+			// the system cancels the orders of a kill switch or a failed instant trade
+			Roles: []Role{RoleBuyer, RoleAdmin, RoleSystem},
+			Hooks: []Hook{HookReleaseLock, HookReleasePending, HookQuoteRestore},
+		},
+		{
+			From:          pb.OtcOrder_UNPAID,
+			To:            pb.OtcOrder_EXPIRED,
+			Roles:         []Role{RoleSystem, RoleAdmin},
+			Preconditions: []Precondition{pastExpiredTime},
+			Hooks:         []Hook{HookReleaseLock, HookReleasePending, HookQuoteRestore},
+		},
+		{
+			From:  pb.OtcOrder_UNPAID,
+			To:    pb.OtcOrder_APPEAL,
+			Roles: []Role{RoleBuyer, RoleSeller},
+		},
+		{
+			From:  pb.OtcOrder_PAID,
+			To:    pb.OtcOrder_COMPLETED,
+			Roles: []Role{RoleSeller, RoleAdmin},
+			Hooks: []Hook{HookReleasePending, HookReleaseCoin, HookQuoteComplete},
+		},
+		{
+			From:  pb.OtcOrder_PAID,
+			To:    pb.OtcOrder_UNPAID,
+			Roles: []Role{RoleSeller, RoleAdmin},
+			Hooks: []Hook{HookRefund},
+		},
+		{
+			From: pb.OtcOrder_PAID,
+			To:   pb.OtcOrder_APPEAL,
+			// the system escalates orders not released before their deadline
+			Roles: []Role{RoleBuyer, RoleSeller, RoleSystem},
+		},
+		{
+			From:  pb.OtcOrder_APPEAL,
+			To:    pb.OtcOrder_RESOLVED,
+			Roles: []Role{RoleAdmin},
+			Hooks: []Hook{HookSettleAppeal},
+		},
+		{
+			From:  pb.OtcOrder_APPEAL,
+			To:    pb.OtcOrder_CANCELLED,
+			Roles: []Role{RoleAdmin},
+			Hooks: []Hook{HookSettleAppeal},
+		},
+	} {
+		transitions[edge{t.From, t.To}] = t
+	}
+}
+
+// Lookup returns the transition from one status to another, or an error if the order
+// may not move between them
+func Lookup(from, to pb.OtcOrder_OrderStatus) (*Transition, error) {
+	t, ok := transitions[edge{from, to}]
+	if !ok {
+		return nil, fmt.Errorf("order transition invalid: %s to %s", from.String(), to.String())
+	}
+	return t, nil
+}
+
+// IsTerminal reports whether no transition leaves status
+func IsTerminal(status pb.OtcOrder_OrderStatus) bool {
+	for e := range transitions {
+		if e.from == status {
+			return false
+		}
+	}
+	return true
+}
+
+// Permits reports whether any of roles may trigger the transition
+func (t *Transition) Permits(roles ...Role) bool {
+	for _, allowed := range t.Roles {
+		for _, r := range roles {
+			if r == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckPreconditions returns the first precondition the order fails
+func (t *Transition) CheckPreconditions(order *pb.OtcOrder) error {
+	for _, p := range t.Preconditions {
+		if err := p(order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pastExpiredTime(order *pb.OtcOrder) error {
+	if order.ExpiredTime > time.Now().UnixNano() {
+		return fmt.Errorf("order cannot be expired before %s", time.Unix(0, order.ExpiredTime).String())
+	}
+	return nil
+}
@@ -5,17 +5,35 @@ import (
 	"fmt"
 	"time"
 
+	"gitlab.com/sdce/exlib/exutil"
 	"gitlab.com/sdce/exlib/service"
 	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 const (
 	apiCallLiveTime = 5 * time.Second
 )
 
+// WithActor returns a context which sends the acting member and role with OTC calls.
+// Either may be empty.
+func WithActor(ctx context.Context, memberId *pb.UUID, role orderstate.Role) context.Context {
+	var kv []string
+	if memberId != nil {
+		kv = append(kv, orderstate.ActorIdHeader, exutil.UUIDtoA(memberId))
+	}
+	if role != "" {
+		kv = append(kv, orderstate.ActorRoleHeader, string(role))
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
 type OTCApi interface {
 	UpdateOrder(ctx context.Context, in *pb.UpdateOtcOrderStatusRequest) (err error)
+	// DeleteQuote closes a quote, or marks it to close once its open orders finish
+	DeleteQuote(ctx context.Context, in *pb.DeleteQuoteRequest) (err error)
 }
 
 type Server struct {
@@ -52,3 +70,10 @@ func (o Server) UpdateOrder(ctx context.Context, in *pb.UpdateOtcOrderStatusRequ
 	}
 	return nil
 }
+
+func (o Server) DeleteQuote(ctx context.Context, in *pb.DeleteQuoteRequest) (err error) {
+	apiCtx, cancel := context.WithTimeout(ctx, apiCallLiveTime)
+	defer cancel()
+	_, err = o.OTC.DoDeleteQuote(apiCtx, in)
+	return err
+}
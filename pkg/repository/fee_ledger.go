@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	FeeLedgerCollection = "fee_ledger"
+
+	// FeeLedgerDayFormat is the layout of the UTC day a fee is booked on
+	FeeLedgerDayFormat = "2006-01-02"
+)
+
+// FeeRevenueGroup is what fee revenue is summed by
+type FeeRevenueGroup string
+
+const (
+	FeeRevenueByDay        FeeRevenueGroup = "day"
+	FeeRevenueByInstrument FeeRevenueGroup = "instrument"
+	FeeRevenueByMember     FeeRevenueGroup = "payer"
+)
+
+// FeeLedgerEntry is a fee collected by the platform on an order
+type FeeLedgerEntry struct {
+	Id       *pb.UUID `bson:"_id"`
+	OrderId  *pb.UUID `bson:"orderId"`
+	QuoteId  *pb.UUID `bson:"quoteId"`
+	EventId  *pb.UUID `bson:"eventId"`
+	Payer    *pb.UUID `bson:"payer"`
+	CoinId   *pb.UUID `bson:"coinId"`
+	Currency string   `bson:"currency"`
+	// Instrument is the lower case instrument code
+	Instrument string `bson:"instrument"`
+	Amount     string `bson:"amount"`
+	Time       int64  `bson:"time"`
+	Day        string `bson:"day"`
+}
+
+type FeeLedgerFilter struct {
+	From, To   int64
+	Instrument string
+	Payer      *pb.UUID
+}
+
+// FeeRevenue is the fee collected in a currency for one day, instrument or member
+type FeeRevenue struct {
+	Key      string
+	Currency string
+	Amount   string
+	Count    int64
+}
+
+type FeeLedgerRepository interface {
+	// RecordFee adds an entry to the ledger. Recording the same event twice is a no-op.
+	RecordFee(ctx context.Context, entry *FeeLedgerEntry) error
+	SumFees(ctx context.Context, filter *FeeLedgerFilter, group FeeRevenueGroup) ([]*FeeRevenue, error)
+}
+
+type feeLedgerRepoMongo struct {
+	DB *mongo.Collection
+}
+
+func NewFeeLedgerRepo(db *exmongo.Database) FeeLedgerRepository {
+	c := db.CreateCollection(FeeLedgerCollection)
+	_, err := c.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "eventId", Value: 1}},
+			Options: new(options.IndexOptions).SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "time", Value: 1}},
+		},
+	})
+	if err != nil {
+		log.Fatalf("Create index error %v", err)
+	}
+	return &feeLedgerRepoMongo{DB: c}
+}
+
+func (f *feeLedgerRepoMongo) RecordFee(ctx context.Context, entry *FeeLedgerEntry) error {
+	if entry.Id == nil {
+		entry.Id = exutil.NewUUID()
+	}
+	_, err := f.DB.InsertOne(ctx, entry)
+	if isDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *feeLedgerRepoMongo) SumFees(ctx context.Context, filter *FeeLedgerFilter, group FeeRevenueGroup) ([]*FeeRevenue, error) {
+	switch group {
+	case FeeRevenueByDay, FeeRevenueByInstrument, FeeRevenueByMember:
+	default:
+		return nil, fmt.Errorf("unknown fee revenue group %q", group)
+	}
+	match := bson.M{}
+	if filter.From != 0 || filter.To != 0 {
+		t := bson.M{}
+		if filter.From != 0 {
+			t["$gte"] = filter.From
+		}
+		if filter.To != 0 {
+			t["$lt"] = filter.To
+		}
+		match["time"] = t
+	}
+	if filter.Instrument != "" {
+		match["instrument"] = filter.Instrument
+	}
+	if filter.Payer != nil {
+		match["payer"] = filter.Payer
+	}
+	cur, err := f.DB.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    bson.M{"key": "$" + string(group), "currency": "$currency"},
+			"amount": bson.M{"$sum": bson.M{"$toDecimal": "$amount"}},
+			"count":  bson.M{"$sum": 1},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.key", Value: 1}, {Key: "_id.currency", Value: 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var out []*FeeRevenue
+	for cur.Next(ctx) {
+		var row struct {
+			Id struct {
+				Key      interface{} `bson:"key"`
+				Currency string      `bson:"currency"`
+			} `bson:"_id"`
+			Amount primitive.Decimal128 `bson:"amount"`
+			Count  int64                `bson:"count"`
+		}
+		if err := cur.Decode(&row); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprint(row.Id.Key)
+		if id, ok := row.Id.Key.(primitive.ObjectID); ok {
+			key = id.Hex()
+		}
+		out = append(out, &FeeRevenue{
+			Key:      key,
+			Currency: row.Id.Currency,
+			Amount:   row.Amount.String(),
+			Count:    row.Count,
+		})
+	}
+	return out, cur.Err()
+}
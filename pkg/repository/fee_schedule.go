@@ -0,0 +1,204 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	FeeScheduleCollection = "otc_fee_schedule"
+)
+
+// ErrFeeScheduleInEffect is returned when a schedule which already applies is changed
+var ErrFeeScheduleInEffect = errors.New("fee schedule is already in effect")
+
+// FeePayer says which party of an order pays the fee
+type FeePayer string
+
+const (
+	// FeePayerMaker charges the quote owner
+	FeePayerMaker FeePayer = "MAKER"
+	// FeePayerTaker charges the member placing the order
+	FeePayerTaker FeePayer = "TAKER"
+	// FeePayerBoth charges each party the rate of their own tier
+	FeePayerBoth FeePayer = "BOTH"
+)
+
+// FeeCurrency says which currency of the instrument a fee is charged in
+type FeeCurrency string
+
+const (
+	FeeCurrencyBase  FeeCurrency = "BASE"
+	FeeCurrencyQuote FeeCurrency = "QUOTE"
+)
+
+// FeePolicy says who pays the fee of an order and in which currency. Quotes keep the policy
+// they were created with in their "feePolicy" field.
+type FeePolicy struct {
+	Payer    FeePayer    `bson:"payer"`
+	Currency FeeCurrency `bson:"currency"`
+}
+
+// DefaultFeePolicy charges the maker in the instrument base
+var DefaultFeePolicy = FeePolicy{Payer: FeePayerMaker, Currency: FeeCurrencyBase}
+
+// ChargesMaker reports whether the quote owner pays a fee
+func (p FeePolicy) ChargesMaker() bool {
+	return p.Payer == FeePayerMaker || p.Payer == FeePayerBoth
+}
+
+// ChargesTaker reports whether the member placing the order pays a fee
+func (p FeePolicy) ChargesTaker() bool {
+	return p.Payer == FeePayerTaker || p.Payer == FeePayerBoth
+}
+
+// FeeTier is the rate charged to members whose completed volume over the last 30 days
+// is at least MinVolume, in smallest units of the instrument base
+type FeeTier struct {
+	MinVolume string `bson:"minVolume"`
+	Rate      string `bson:"rate"`
+}
+
+// FeeSchedule holds the fee tiers of an instrument and quote side from EffectiveFrom on.
+// A schedule without a side applies to both.
+type FeeSchedule struct {
+	Id *pb.UUID `bson:"_id"`
+	// Instrument is the lower case instrument code
+	Instrument    string       `bson:"instrument"`
+	Side          pb.OrderSide `bson:"side"`
+	EffectiveFrom int64        `bson:"effectiveFrom"`
+	// Policy of the orders on quotes created while the schedule is in effect
+	Policy FeePolicy `bson:"policy"`
+	// Tiers are ordered by MinVolume, starting at 0
+	Tiers []*FeeTier `bson:"tiers"`
+}
+
+type FeeScheduleFilter struct {
+	Instrument string
+	Side       pb.OrderSide
+	PageIdx    int64
+	PageSize   int64
+}
+
+type FeeScheduleRepository interface {
+	CreateFeeSchedule(ctx context.Context, schedule *FeeSchedule) (*pb.UUID, error)
+	GetFeeSchedule(ctx context.Context, id *pb.UUID) (*FeeSchedule, error)
+	// UpdateFeeSchedule replaces a schedule which is not in effect yet
+	UpdateFeeSchedule(ctx context.Context, schedule *FeeSchedule, now int64) error
+	// DeleteFeeSchedule removes a schedule which is not in effect yet
+	DeleteFeeSchedule(ctx context.Context, id *pb.UUID, now int64) error
+	SearchFeeSchedules(ctx context.Context, filter *FeeScheduleFilter) (out []*FeeSchedule, count int64, err error)
+	// FindEffectiveFeeSchedule returns the latest schedule of the instrument in effect at the
+	// given time, preferring one for the side over one for both sides. It returns nil if
+	// there is none.
+	FindEffectiveFeeSchedule(ctx context.Context, instrument string, side pb.OrderSide, at int64) (*FeeSchedule, error)
+}
+
+type feeScheduleRepoMongo struct {
+	DB *mongo.Collection
+}
+
+func NewFeeScheduleRepo(db *exmongo.Database) FeeScheduleRepository {
+	c := db.CreateCollection(FeeScheduleCollection)
+	_, err := c.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "instrument", Value: 1}, {Key: "effectiveFrom", Value: -1}},
+	})
+	if err != nil {
+		log.Fatalf("Create index error %v", err)
+	}
+	return &feeScheduleRepoMongo{DB: c}
+}
+
+func (f *feeScheduleRepoMongo) CreateFeeSchedule(ctx context.Context, schedule *FeeSchedule) (*pb.UUID, error) {
+	schedule.Id = exutil.NewUUID()
+	_, err := f.DB.InsertOne(ctx, schedule)
+	if err != nil {
+		return nil, err
+	}
+	return schedule.Id, nil
+}
+
+func (f *feeScheduleRepoMongo) GetFeeSchedule(ctx context.Context, id *pb.UUID) (*FeeSchedule, error) {
+	var out FeeSchedule
+	err := f.DB.FindOne(ctx, exmongo.IDFilter(id)).Decode(&out)
+	return &out, err
+}
+
+func (f *feeScheduleRepoMongo) UpdateFeeSchedule(ctx context.Context, schedule *FeeSchedule, now int64) error {
+	res, err := f.DB.ReplaceOne(ctx, bson.M{"$and": bson.A{
+		exmongo.IDFilter(schedule.Id),
+		bson.M{"effectiveFrom": bson.M{"$gt": now}},
+	}}, schedule)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrFeeScheduleInEffect
+	}
+	return nil
+}
+
+func (f *feeScheduleRepoMongo) DeleteFeeSchedule(ctx context.Context, id *pb.UUID, now int64) error {
+	res, err := f.DB.DeleteOne(ctx, bson.M{"$and": bson.A{
+		exmongo.IDFilter(id),
+		bson.M{"effectiveFrom": bson.M{"$gt": now}},
+	}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrFeeScheduleInEffect
+	}
+	return nil
+}
+
+func (f *feeScheduleRepoMongo) SearchFeeSchedules(ctx context.Context, filter *FeeScheduleFilter) (out []*FeeSchedule, count int64, err error) {
+	opts := &options.FindOptions{}
+	if filter.PageSize > 0 {
+		opts = exmongo.NewPaginationOptions(filter.PageIdx, filter.PageSize)
+	}
+	opts.SetSort(bson.D{{Key: "instrument", Value: 1}, {Key: "effectiveFrom", Value: -1}})
+	fobj := bson.M{}
+	if filter.Instrument != "" {
+		fobj["instrument"] = filter.Instrument
+	}
+	if filter.Side != pb.OrderSide_ORDER_SIDE_INVALID {
+		fobj["side"] = filter.Side
+	}
+	cur, err := f.DB.Find(ctx, fobj, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cur.Close(ctx)
+	count, err = f.DB.CountDocuments(ctx, fobj)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = exmongo.DecodeCursorToSlice(ctx, cur, &out)
+	return
+}
+
+func (f *feeScheduleRepoMongo) FindEffectiveFeeSchedule(ctx context.Context, instrument string, side pb.OrderSide, at int64) (*FeeSchedule, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "effectiveFrom", Value: -1}, {Key: "side", Value: -1}})
+	var out FeeSchedule
+	err := f.DB.FindOne(ctx, bson.M{
+		"instrument":    instrument,
+		"side":          bson.M{"$in": bson.A{side, pb.OrderSide_ORDER_SIDE_INVALID}},
+		"effectiveFrom": bson.M{"$lte": at},
+	}, opts).Decode(&out)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
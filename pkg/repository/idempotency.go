@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	IdempotencyCollection = "idempotency_key"
+
+	IdempotencyPending = "PENDING"
+	IdempotencyDone    = "DONE"
+
+	// idempotencyKeyTTL is how long a key and its result are kept
+	idempotencyKeyTTL = 24 * time.Hour
+
+	duplicateKeyErrorCode = 11000
+)
+
+// ErrIdempotencyKeyLost is returned when the result of a request is saved after its key expired
+var ErrIdempotencyKeyLost = errors.New("idempotency key is no longer pending")
+
+// IdempotencyRecord is the stored outcome of a request made with a client supplied idempotency key
+type IdempotencyRecord struct {
+	Key       string    `bson:"_id"`
+	Method    string    `bson:"method"`
+	MemberId  *pb.UUID  `bson:"memberId"`
+	Status    string    `bson:"status"`
+	ResultId  *pb.UUID  `bson:"resultId,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+type IdempotencyRepository interface {
+	// Reserve claims key for method. If the key is already taken the existing record is returned with reserved false.
+	// A pending key is never taken over, as its request may still be running: it stays pending
+	// until released or expired.
+	Reserve(ctx context.Context, key, method string, memberId *pb.UUID) (rec *IdempotencyRecord, reserved bool, err error)
+	Get(ctx context.Context, key, method string, memberId *pb.UUID) (*IdempotencyRecord, error)
+	// Complete saves the result of a reserved key, failing with ErrIdempotencyKeyLost if the
+	// key is no longer pending
+	Complete(ctx context.Context, rec *IdempotencyRecord, resultId *pb.UUID) error
+	Release(ctx context.Context, rec *IdempotencyRecord) error
+}
+
+type idempotencyRepoMongo struct {
+	DB *mongo.Collection
+}
+
+func NewIdempotencyRepo(db *exmongo.Database) IdempotencyRepository {
+	c := db.CreateCollection(IdempotencyCollection)
+	_, err := c.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: new(options.IndexOptions).SetExpireAfterSeconds(int32(idempotencyKeyTTL / time.Second)),
+	})
+	if err != nil {
+		log.Fatalf("Create index error %v", err)
+	}
+	return &idempotencyRepoMongo{DB: c}
+}
+
+// keys are scoped by method and member so that clients cannot collide with each other
+func idempotencyId(key, method string, memberId *pb.UUID) string {
+	return method + ":" + exutil.UUIDtoA(memberId) + ":" + key
+}
+
+func (m *idempotencyRepoMongo) Reserve(ctx context.Context, key, method string, memberId *pb.UUID) (rec *IdempotencyRecord, reserved bool, err error) {
+	rec = &IdempotencyRecord{
+		Key:       idempotencyId(key, method, memberId),
+		Method:    method,
+		MemberId:  memberId,
+		Status:    IdempotencyPending,
+		CreatedAt: time.Now().Truncate(time.Millisecond), // precision of a stored date
+	}
+	_, err = m.DB.InsertOne(ctx, rec)
+	if err == nil {
+		return rec, true, nil
+	}
+	if !isDuplicateKeyError(err) {
+		return nil, false, err
+	}
+
+	existing, err := m.Get(ctx, key, method, memberId)
+	return existing, false, err
+}
+
+func (m *idempotencyRepoMongo) Get(ctx context.Context, key, method string, memberId *pb.UUID) (*IdempotencyRecord, error) {
+	var out IdempotencyRecord
+	err := m.DB.FindOne(ctx, bson.M{"_id": idempotencyId(key, method, memberId)}).Decode(&out)
+	return &out, err
+}
+
+func (m *idempotencyRepoMongo) Complete(ctx context.Context, rec *IdempotencyRecord, resultId *pb.UUID) error {
+	res, err := m.DB.UpdateOne(ctx, bson.M{"_id": rec.Key, "status": IdempotencyPending, "createdAt": rec.CreatedAt},
+		bson.M{"$set": bson.M{"status": IdempotencyDone, "resultId": resultId}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrIdempotencyKeyLost
+	}
+	return nil
+}
+
+func (m *idempotencyRepoMongo) Release(ctx context.Context, rec *IdempotencyRecord) (err error) {
+	_, err = m.DB.DeleteOne(ctx, bson.M{"_id": rec.Key, "status": IdempotencyPending, "createdAt": rec.CreatedAt})
+	return
+}
+
+func isDuplicateKeyError(err error) bool {
+	if we, ok := err.(mongo.WriteException); ok {
+		for _, e := range we.WriteErrors {
+			if e.Code == duplicateKeyErrorCode {
+				return true
+			}
+		}
+	}
+	return false
+}
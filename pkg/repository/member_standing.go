@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"context"
+
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MemberStandingCollection = "otc_member_standing"
+)
+
+// MemberStanding is what quote eligibility rules know of a member beyond their otc orders.
+// The member service reports it, as member records do not carry it.
+type MemberStanding struct {
+	MemberId *pb.UUID `bson:"_id"`
+	KycLevel int32    `bson:"kycLevel"`
+	// RegisteredAt is when the member signed up, in unix nanoseconds
+	RegisteredAt int64 `bson:"registeredAt"`
+	UpdatedAt    int64 `bson:"updatedAt"`
+}
+
+// MemberStandingRepository stores the standing of members
+type MemberStandingRepository interface {
+	SetMemberStanding(ctx context.Context, standing *MemberStanding) error
+	// GetMemberStanding returns the standing of a member, nil if it was never reported
+	GetMemberStanding(ctx context.Context, memberId *pb.UUID) (*MemberStanding, error)
+}
+
+type memberStandingMongoRepo struct {
+	Standing *mongo.Collection
+}
+
+// NewMemberStandingRepo returns a member standing repository instance backed by MongoDB
+func NewMemberStandingRepo(db *exmongo.Database) MemberStandingRepository {
+	return &memberStandingMongoRepo{
+		Standing: db.CreateCollection(MemberStandingCollection),
+	}
+}
+
+func (m *memberStandingMongoRepo) SetMemberStanding(ctx context.Context, standing *MemberStanding) error {
+	_, err := m.Standing.ReplaceOne(ctx, exmongo.IDFilter(standing.MemberId), standing, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *memberStandingMongoRepo) GetMemberStanding(ctx context.Context, memberId *pb.UUID) (*MemberStanding, error) {
+	var out MemberStanding
+	err := m.Standing.FindOne(ctx, exmongo.IDFilter(memberId)).Decode(&out)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// QuoteEligibility restricts who can take a quote. It is kept in the "eligibility" field of
+// restricted quotes, rules left at zero do not apply.
+type QuoteEligibility struct {
+	MinKycLevel        int32 `bson:"minKycLevel,omitempty"`
+	MinCompletedTrades int64 `bson:"minCompletedTrades,omitempty"`
+	MinAccountAgeDays  int64 `bson:"minAccountAgeDays,omitempty"`
+	// Blocked members cannot take the quote
+	Blocked []*pb.UUID `bson:"blocked,omitempty"`
+}
+
+// Taker is what the eligibility rules of quotes are checked against
+type Taker struct {
+	MemberId        *pb.UUID
+	KycLevel        int32
+	CompletedTrades int64
+	AccountAgeDays  int64
+}
+
+// eligibleFilter matches the quotes taker may take, quotes without a rule match any taker
+func eligibleFilter(taker *Taker) bson.M {
+	return bson.M{
+		"eligibility.minKycLevel":        bson.M{"$not": bson.M{"$gt": taker.KycLevel}},
+		"eligibility.minCompletedTrades": bson.M{"$not": bson.M{"$gt": taker.CompletedTrades}},
+		"eligibility.minAccountAgeDays":  bson.M{"$not": bson.M{"$gt": taker.AccountAgeDays}},
+		"eligibility.blocked":            bson.M{"$ne": taker.MemberId},
+	}
+}
+
+func (m *quoteMongoRepo) SetQuoteEligibility(ctx context.Context, id *pb.UUID, eligibility *QuoteEligibility) error {
+	update := bson.M{"$set": bson.M{"eligibility": eligibility}}
+	if eligibility == nil {
+		update = bson.M{"$unset": bson.M{"eligibility": ""}}
+	}
+	_, err := m.Quote.UpdateOne(ctx, exmongo.IDFilter(id), update)
+	return err
+}
+
+func (m *quoteMongoRepo) GetQuoteEligibility(ctx context.Context, id *pb.UUID) (*QuoteEligibility, error) {
+	var out struct {
+		Eligibility *QuoteEligibility `bson:"eligibility"`
+	}
+	err := m.Quote.FindOne(ctx, exmongo.IDFilter(id), options.FindOne().SetProjection(bson.M{"eligibility": 1})).Decode(&out)
+	return out.Eligibility, err
+}
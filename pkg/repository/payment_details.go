@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	PaymentDetailsCollection = "otc_payment_details"
+)
+
+// PaymentDetails is where a member is paid by a payment method, like the bank account name
+// and number. A member has one set of details per method.
+type PaymentDetails struct {
+	MemberId  *pb.UUID          `bson:"memberId"`
+	Method    pb.PaymentMethod  `bson:"method"`
+	Details   map[string]string `bson:"details"`
+	UpdatedAt int64             `bson:"updatedAt"`
+}
+
+// OrderPayment is the method an order is paid by and the payee details at the time it was
+// placed, kept in the "payment" field of the order
+type OrderPayment struct {
+	Method  pb.PaymentMethod  `bson:"method"`
+	Payee   *pb.UUID          `bson:"payee"`
+	Details map[string]string `bson:"details"`
+}
+
+// PaymentDetailsRepository stores the payment details of members
+type PaymentDetailsRepository interface {
+	// SetPaymentDetails replaces the details of the member for the method
+	SetPaymentDetails(ctx context.Context, details *PaymentDetails) error
+	RemovePaymentDetails(ctx context.Context, memberId *pb.UUID, method pb.PaymentMethod) error
+	// GetPaymentDetails returns the details of the member for the method, nil if not set up
+	GetPaymentDetails(ctx context.Context, memberId *pb.UUID, method pb.PaymentMethod) (*PaymentDetails, error)
+	// ListPaymentMethods returns the methods the member has set up
+	ListPaymentMethods(ctx context.Context, memberId *pb.UUID) ([]pb.PaymentMethod, error)
+}
+
+type paymentDetailsMongoRepo struct {
+	Details *mongo.Collection
+}
+
+// NewPaymentDetailsRepo returns a payment details repository instance backed by MongoDB
+func NewPaymentDetailsRepo(db *exmongo.Database) PaymentDetailsRepository {
+	c := db.CreateCollection(PaymentDetailsCollection)
+	_, err := c.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "memberId", Value: 1}, {Key: "method", Value: 1}},
+		Options: new(options.IndexOptions).SetUnique(true),
+	})
+	if err != nil {
+		log.Fatalf("Create index error %v", err)
+	}
+	return &paymentDetailsMongoRepo{Details: c}
+}
+
+func (m *paymentDetailsMongoRepo) SetPaymentDetails(ctx context.Context, details *PaymentDetails) error {
+	_, err := m.Details.ReplaceOne(ctx,
+		bson.M{"memberId": details.MemberId, "method": details.Method},
+		details, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *paymentDetailsMongoRepo) RemovePaymentDetails(ctx context.Context, memberId *pb.UUID, method pb.PaymentMethod) error {
+	_, err := m.Details.DeleteOne(ctx, bson.M{"memberId": memberId, "method": method})
+	return err
+}
+
+func (m *paymentDetailsMongoRepo) GetPaymentDetails(ctx context.Context, memberId *pb.UUID, method pb.PaymentMethod) (*PaymentDetails, error) {
+	var out PaymentDetails
+	err := m.Details.FindOne(ctx, bson.M{"memberId": memberId, "method": method}).Decode(&out)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (m *paymentDetailsMongoRepo) ListPaymentMethods(ctx context.Context, memberId *pb.UUID) ([]pb.PaymentMethod, error) {
+	cur, err := m.Details.Find(ctx, bson.M{"memberId": memberId}, options.Find().SetProjection(bson.M{"method": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var methods []pb.PaymentMethod
+	for cur.Next(ctx) {
+		var row struct {
+			Method pb.PaymentMethod `bson:"method"`
+		}
+		if err := cur.Decode(&row); err != nil {
+			return nil, err
+		}
+		methods = append(methods, row.Method)
+	}
+	return methods, cur.Err()
+}
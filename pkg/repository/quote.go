@@ -2,6 +2,8 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"regexp"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -25,16 +27,63 @@ type QuoteFilter struct {
 	Side          pb.OrderSide
 	BaseCurrency  string
 	QuoteCurrency string
-	PageIdx       int64
-	PageSize      int64
+	// Instrument code, matched case insensitively
+	Instrument string
+	// PaymentMethod limits the quotes to those accepting it, any when not set
+	PaymentMethod pb.PaymentMethod
+	// Taker leaves out the quotes whose eligibility rules the taker does not meet
+	Taker    *Taker
+	PageIdx  int64
+	PageSize int64
 }
 
+// QuoteRepository stores otc quotes. Calls made with a context handed out by a
+// Transactor are part of its transaction.
 type QuoteRepository interface {
 	CreateQuote(ctx context.Context, data *pb.Quote) (*pb.UUID, error)
 	SearchQuotes(ctx context.Context, filter *QuoteFilter) (out []*pb.Quote, count int64, err error)
 	GetQuote(ctx context.Context, id *pb.UUID) (*pb.Quote, error)
 	UpdateQuote(ctx context.Context, id *pb.UUID, fields bson.M) error
+	CompareAndUpdateQuote(ctx context.Context, id *pb.UUID, expected bson.M, fields bson.M) error
 	DeleteQuote(ctx context.Context, id, eventId *pb.UUID) error
+	SetQuoteFeePolicy(ctx context.Context, id *pb.UUID, policy FeePolicy) error
+	// GetQuoteFeePolicy returns the fee policy a quote was created with, nil if it has none
+	GetQuoteFeePolicy(ctx context.Context, id *pb.UUID) (*FeePolicy, error)
+	SetQuotePricing(ctx context.Context, id *pb.UUID, pricing *QuotePricing) error
+	// GetQuotePricing returns the pricing of a floating quote, nil if its price is fixed
+	GetQuotePricing(ctx context.Context, id *pb.UUID) (*QuotePricing, error)
+	// GetQuotePricings returns the pricing of the floating quotes among ids, by quote id string
+	GetQuotePricings(ctx context.Context, ids []*pb.UUID) (map[string]*QuotePricing, error)
+	// SetQuoteEligibility sets who can take a quote, nil lets anyone take it
+	SetQuoteEligibility(ctx context.Context, id *pb.UUID, eligibility *QuoteEligibility) error
+	// GetQuoteEligibility returns the eligibility rules of a quote, nil if anyone can take it
+	GetQuoteEligibility(ctx context.Context, id *pb.UUID) (*QuoteEligibility, error)
+	// SetQuoteSchedule sets the trading hours of a quote, nil removes them
+	SetQuoteSchedule(ctx context.Context, id *pb.UUID, schedule *QuoteSchedule) error
+	// GetQuoteSchedule returns the schedule of a quote, nil if it is not scheduled
+	GetQuoteSchedule(ctx context.Context, id *pb.UUID) (*QuoteSchedule, error)
+	// SearchScheduledQuotes returns the scheduled quotes which are on or off
+	SearchScheduledQuotes(ctx context.Context) ([]*ScheduledQuote, error)
+	// TouchQuoteSchedules records the owner of scheduled quotes as active at now
+	TouchQuoteSchedules(ctx context.Context, owner *pb.UUID, now int64) error
+	SetScheduledQuoteStatus(ctx context.Context, id *pb.UUID, from, to pb.Quote_QuoteStatus, eventId *pb.UUID) error
+	// PauseQuote turns a quote off with pause, ErrQuoteModified if it no longer holds the expected values
+	PauseQuote(ctx context.Context, id *pb.UUID, expected bson.M, pause *QuotePause, eventId *pb.UUID) error
+	// ResumeQuote turns a paused quote back on, ErrQuoteModified if its pause has changed
+	ResumeQuote(ctx context.Context, id *pb.UUID, released string, eventId *pb.UUID) error
+	// GetQuotePause returns the pause of a quote, nil if its owner has not paused it
+	GetQuotePause(ctx context.Context, id *pb.UUID) (*QuotePause, error)
+	// CloseQuote closes a quote, ErrQuoteModified if it no longer holds the expected values.
+	// The actor of the close is recorded unless it is the owner.
+	CloseQuote(ctx context.Context, id *pb.UUID, expected bson.M, eventId *pb.UUID, actor *EventActor) error
+	// SetQuoteExpiry sets when a quote stops being listed, 0 lists it until it is closed
+	SetQuoteExpiry(ctx context.Context, id *pb.UUID, expiresAt int64) error
+	// GetQuoteExpiry returns when a quote stops being listed, 0 if it does not expire
+	GetQuoteExpiry(ctx context.Context, id *pb.UUID) (int64, error)
+	// SearchExpiredQuotes returns the quotes expired by now which are not closed or closing
+	SearchExpiredQuotes(ctx context.Context, now int64) ([]*pb.Quote, error)
+	// QuoteDepth sums the remaining quotes on the shelf by price level, best price first
+	QuoteDepth(ctx context.Context, filter *DepthFilter) ([]*DepthLevel, error)
 	CreateSDCEQuote(ctx context.Context, ticker string, buyUnitPrice *pb.UnitPrice, sellUnitPrice *pb.UnitPrice) error
 	SearchSDCEQuote(ctx context.Context, ticker string) (out *pb.CurrencyQuote, err error)
 }
@@ -44,6 +93,39 @@ const (
 	SDCEQuoteCollection = "sdce_quote"
 )
 
+type DepthFilter struct {
+	// Instrument code, matched case insensitively
+	Instrument    string
+	Side          pb.OrderSide
+	PaymentMethod pb.PaymentMethod
+	// MaxDepth is the number of price levels returned, 0 for all
+	MaxDepth int64
+}
+
+// DepthLevel is the quotes of one side at one price. Volume and Value are what remains on
+// the quotes, MinValue and MaxValue the widest order limits among them.
+type DepthLevel struct {
+	Price    float64
+	Volume   string
+	Value    string
+	Count    int64
+	MinValue string
+	MaxValue string
+}
+
+// QuotePricing pegs the price of a quote to the SDCE reference price of its instrument.
+// It is kept in the "pricing" field of floating quotes, quotes without one have a fixed price.
+type QuotePricing struct {
+	// Premium is the percent added to the reference price, negative for a discount
+	Premium string `bson:"premium"`
+	// Floor and Ceiling bound the price in whole quote currency per whole base, empty for none
+	Floor   string `bson:"floor,omitempty"`
+	Ceiling string `bson:"ceiling,omitempty"`
+}
+
+// ErrQuoteModified is returned by CompareAndUpdateQuote when the quote no longer holds the expected values
+var ErrQuoteModified = errors.New("quote has been modified concurrently")
+
 // NewQuoteRepo returns a quote repository instance backed by MongoDB
 func NewQuoteRepo(db *exmongo.Database) QuoteRepository {
 	c := db.CreateCollection(SDCEQuoteCollection)
@@ -102,6 +184,17 @@ func (m *quoteMongoRepo) SearchQuotes(ctx context.Context, filter *QuoteFilter)
 	if filter.QuoteCurrency != "" {
 		fobj["instrument.quote.symbol"] = filter.QuoteCurrency
 	}
+	if filter.Instrument != "" {
+		fobj["instrument.code"] = bson.M{"$regex": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(filter.Instrument) + "$", Options: "i"}}
+	}
+	if filter.PaymentMethod != pb.PaymentMethod_INVALID_METHOD {
+		fobj["acceptedPaymentMethods"] = filter.PaymentMethod
+	}
+	if filter.Taker != nil {
+		for k, v := range eligibleFilter(filter.Taker) {
+			fobj[k] = v
+		}
+	}
 	cur, err := m.Quote.Find(ctx, fobj, opts)
 	if err != nil {
 		return nil, 0, err
@@ -116,14 +209,143 @@ func (m *quoteMongoRepo) SearchQuotes(ctx context.Context, filter *QuoteFilter)
 	return
 }
 
+func (m *quoteMongoRepo) QuoteDepth(ctx context.Context, filter *DepthFilter) ([]*DepthLevel, error) {
+	match := bson.M{
+		"status": pb.Quote_ON,
+		"side":   filter.Side,
+		"volume": bson.M{"$ne": "0"},
+	}
+	if filter.Instrument != "" {
+		match["instrument.code"] = bson.M{"$regex": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(filter.Instrument) + "$", Options: "i"}}
+	}
+	if filter.PaymentMethod != pb.PaymentMethod_INVALID_METHOD {
+		match["acceptedPaymentMethods"] = filter.PaymentMethod
+	}
+	order := 1
+	if filter.Side == pb.OrderSide_BID {
+		order = -1
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      "$price",
+			"volume":   bson.M{"$sum": bson.M{"$toDecimal": "$volume"}},
+			"value":    bson.M{"$sum": bson.M{"$toDecimal": "$value"}},
+			"count":    bson.M{"$sum": 1},
+			"minValue": bson.M{"$min": bson.M{"$toDecimal": "$minValue"}},
+			"maxValue": bson.M{"$max": bson.M{"$toDecimal": "$maxValue"}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: order}}}},
+	}
+	if filter.MaxDepth > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: filter.MaxDepth}})
+	}
+	cur, err := m.Quote.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var out []*DepthLevel
+	for cur.Next(ctx) {
+		var row struct {
+			Price    float64              `bson:"_id"`
+			Volume   primitive.Decimal128 `bson:"volume"`
+			Value    primitive.Decimal128 `bson:"value"`
+			Count    int64                `bson:"count"`
+			MinValue primitive.Decimal128 `bson:"minValue"`
+			MaxValue primitive.Decimal128 `bson:"maxValue"`
+		}
+		if err := cur.Decode(&row); err != nil {
+			return nil, err
+		}
+		out = append(out, &DepthLevel{
+			Price:    row.Price,
+			Volume:   row.Volume.String(),
+			Value:    row.Value.String(),
+			Count:    row.Count,
+			MinValue: row.MinValue.String(),
+			MaxValue: row.MaxValue.String(),
+		})
+	}
+	return out, cur.Err()
+}
+
 func (m *quoteMongoRepo) GetQuote(ctx context.Context, id *pb.UUID) (*pb.Quote, error) {
 	var out pb.Quote
 	err := m.Quote.FindOne(ctx, exmongo.IDFilter(id)).Decode(&out)
 	return &out, err
 }
 
+func (m *quoteMongoRepo) SetQuoteFeePolicy(ctx context.Context, id *pb.UUID, policy FeePolicy) error {
+	_, err := m.Quote.UpdateOne(ctx, exmongo.IDFilter(id), bson.M{"$set": bson.M{"feePolicy": policy}})
+	return err
+}
+
+func (m *quoteMongoRepo) GetQuoteFeePolicy(ctx context.Context, id *pb.UUID) (*FeePolicy, error) {
+	var out struct {
+		FeePolicy *FeePolicy `bson:"feePolicy"`
+	}
+	err := m.Quote.FindOne(ctx, exmongo.IDFilter(id), options.FindOne().SetProjection(bson.M{"feePolicy": 1})).Decode(&out)
+	return out.FeePolicy, err
+}
+
+func (m *quoteMongoRepo) SetQuotePricing(ctx context.Context, id *pb.UUID, pricing *QuotePricing) error {
+	_, err := m.Quote.UpdateOne(ctx, exmongo.IDFilter(id), bson.M{"$set": bson.M{"pricing": pricing}})
+	return err
+}
+
+func (m *quoteMongoRepo) GetQuotePricing(ctx context.Context, id *pb.UUID) (*QuotePricing, error) {
+	var out struct {
+		Pricing *QuotePricing `bson:"pricing"`
+	}
+	err := m.Quote.FindOne(ctx, exmongo.IDFilter(id), options.FindOne().SetProjection(bson.M{"pricing": 1})).Decode(&out)
+	return out.Pricing, err
+}
+
+func (m *quoteMongoRepo) GetQuotePricings(ctx context.Context, ids []*pb.UUID) (map[string]*QuotePricing, error) {
+	out := map[string]*QuotePricing{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	cur, err := m.Quote.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "pricing": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"pricing": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var row struct {
+			Id      *pb.UUID      `bson:"_id"`
+			Pricing *QuotePricing `bson:"pricing"`
+		}
+		if err := cur.Decode(&row); err != nil {
+			return nil, err
+		}
+		out[exutil.UUIDtoA(row.Id)] = row.Pricing
+	}
+	return out, cur.Err()
+}
+
 func (m *quoteMongoRepo) UpdateQuote(ctx context.Context, id *pb.UUID, fields bson.M) (err error) {
+	_, err = m.Quote.UpdateOne(ctx, exmongo.IDFilter(id), quoteUpdateObj(fields))
+	return err
+}
 
+// CompareAndUpdateQuote applies fields only if the quote still holds the expected values,
+// otherwise ErrQuoteModified is returned and nothing is written.
+func (m *quoteMongoRepo) CompareAndUpdateQuote(ctx context.Context, id *pb.UUID, expected bson.M, fields bson.M) error {
+	filter := bson.M{"$and": bson.A{exmongo.IDFilter(id), expected}}
+	res, err := m.Quote.UpdateOne(ctx, filter, quoteUpdateObj(fields))
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrQuoteModified
+	}
+	return nil
+}
+
+func quoteUpdateObj(fields bson.M) bson.M {
 	event := pb.OrderEvent{
 		Type: pb.OrderEventType_UPDATE_ORDER,
 		Time: time.Now().UnixNano(),
@@ -150,8 +372,7 @@ func (m *quoteMongoRepo) UpdateQuote(ctx context.Context, id *pb.UUID, fields bs
 			"events": event,
 		}
 	}
-	_, err = m.Quote.UpdateOne(ctx, exmongo.IDFilter(id), mobj)
-	return err
+	return mobj
 }
 
 func (m *quoteMongoRepo) DeleteQuote(ctx context.Context, id, eventId *pb.UUID) error {
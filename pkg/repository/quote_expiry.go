@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"context"
+
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The listing expiry of a quote is kept in its "expiresAt" field, in unix nanoseconds. Quotes
+// without one are listed until they are closed.
+
+func (m *quoteMongoRepo) SetQuoteExpiry(ctx context.Context, id *pb.UUID, expiresAt int64) error {
+	update := bson.M{"$set": bson.M{"expiresAt": expiresAt}}
+	if expiresAt == 0 {
+		update = bson.M{"$unset": bson.M{"expiresAt": ""}}
+	}
+	_, err := m.Quote.UpdateOne(ctx, exmongo.IDFilter(id), update)
+	return err
+}
+
+func (m *quoteMongoRepo) GetQuoteExpiry(ctx context.Context, id *pb.UUID) (int64, error) {
+	var out struct {
+		ExpiresAt int64 `bson:"expiresAt"`
+	}
+	err := m.Quote.FindOne(ctx, exmongo.IDFilter(id), options.FindOne().SetProjection(bson.M{"expiresAt": 1})).Decode(&out)
+	return out.ExpiresAt, err
+}
+
+func (m *quoteMongoRepo) SearchExpiredQuotes(ctx context.Context, now int64) ([]*pb.Quote, error) {
+	filter := bson.M{
+		"expiresAt":          bson.M{"$lte": now},
+		"status":             bson.M{"$in": bson.A{pb.Quote_ON, pb.Quote_OFF}},
+		"pause.closePending": bson.M{"$ne": true},
+	}
+	cur, err := m.Quote.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var out []*pb.Quote
+	for cur.Next(ctx) {
+		q := &pb.Quote{}
+		if err := cur.Decode(q); err != nil {
+			return nil, err
+		}
+		out = append(out, q)
+	}
+	return out, cur.Err()
+}
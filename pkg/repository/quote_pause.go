@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// QuotePause is kept in the "pause" field of a quote its owner took off the shelf, while the
+// orders already placed on it finish
+type QuotePause struct {
+	// Released is how much of the quote's lock was given back to the owner, relocked on resume
+	Released string `bson:"released"`
+	// ClosePending closes the quote once its last open order finishes
+	ClosePending bool `bson:"closePending,omitempty"`
+	// ClosedBy is who closed the quote, when not its owner
+	ClosedBy *EventActor `bson:"closedBy,omitempty"`
+	PausedAt int64       `bson:"pausedAt"`
+}
+
+// PauseQuote turns a quote off with pause, if it still holds the expected values
+func (m *quoteMongoRepo) PauseQuote(ctx context.Context, id *pb.UUID, expected bson.M, pause *QuotePause, eventId *pb.UUID) error {
+	return m.setQuoteStatus(ctx, id, expected, eventId, pb.OrderEventType_UPDATE_ORDER, bson.M{
+		"$set": bson.M{"status": pb.Quote_OFF, "pause": pause},
+	})
+}
+
+// ResumeQuote puts a paused quote back on the shelf, if its pause still has the released amount
+func (m *quoteMongoRepo) ResumeQuote(ctx context.Context, id *pb.UUID, released string, eventId *pb.UUID) error {
+	expected := bson.M{"status": pb.Quote_OFF, "pause.released": released, "pause.closePending": bson.M{"$ne": true}}
+	return m.setQuoteStatus(ctx, id, expected, eventId, pb.OrderEventType_UPDATE_ORDER, bson.M{
+		"$set":   bson.M{"status": pb.Quote_ON},
+		"$unset": bson.M{"pause": ""},
+	})
+}
+
+// CloseQuote closes a quote like DeleteQuote, if it still holds the expected values. The actor
+// is kept in the "eventActors" array of the quote, like on orders.
+func (m *quoteMongoRepo) CloseQuote(ctx context.Context, id *pb.UUID, expected bson.M, eventId *pb.UUID, actor *EventActor) error {
+	update := bson.M{"$set": bson.M{"status": pb.Quote_CLOSED}}
+	if actor != nil {
+		actor.EventId = eventId
+		update["$push"] = bson.M{"eventActors": actor}
+	}
+	return m.setQuoteStatus(ctx, id, expected, eventId, pb.OrderEventType_CANCEL_ORDER, update)
+}
+
+func (m *quoteMongoRepo) GetQuotePause(ctx context.Context, id *pb.UUID) (*QuotePause, error) {
+	var out struct {
+		Pause *QuotePause `bson:"pause"`
+	}
+	err := m.Quote.FindOne(ctx, exmongo.IDFilter(id), options.FindOne().SetProjection(bson.M{"pause": 1})).Decode(&out)
+	return out.Pause, err
+}
+
+func (m *quoteMongoRepo) setQuoteStatus(ctx context.Context, id *pb.UUID, expected bson.M, eventId *pb.UUID, eventType pb.OrderEventType, update bson.M) error {
+	push, _ := update["$push"].(bson.M)
+	if push == nil {
+		push = bson.M{}
+		update["$push"] = push
+	}
+	push["events"] = pb.OrderEvent{
+		Id:   eventId,
+		Type: eventType,
+		Time: time.Now().UnixNano(),
+	}
+	res, err := m.Quote.UpdateOne(ctx, bson.M{"$and": bson.A{exmongo.IDFilter(id), expected}}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrQuoteModified
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const clockLayout = "15:04"
+
+// QuoteSchedule keeps a quote on the shelf only while its owner trades. It is kept in the
+// "schedule" field of scheduled quotes.
+type QuoteSchedule struct {
+	// Timezone is the IANA name of the zone the windows are in, UTC when empty
+	Timezone string `bson:"timezone"`
+	// Windows are the weekly trading hours, the quote trades all week when there are none
+	Windows []TradingWindow `bson:"windows,omitempty"`
+	// AutoOffMinutes turns the quote off once its owner is inactive for as long, 0 for never
+	AutoOffMinutes int64 `bson:"autoOffMinutes,omitempty"`
+	// LastActive is when the owner was last active, in unix nanoseconds
+	LastActive int64 `bson:"lastActive"`
+	// Off is set while the schedule keeps the quote off, only those quotes are turned on again
+	Off bool `bson:"off"`
+}
+
+// TradingWindow is a weekly period a quote trades in
+type TradingWindow struct {
+	// Day is the day of the week the window starts on
+	Day time.Weekday `bson:"day"`
+	// Start and End are times of day like "09:30", a window ending before it starts ends the next day
+	Start string `bson:"start"`
+	End   string `bson:"end"`
+}
+
+// ScheduledQuote is the status and schedule of a quote the schedule worker toggles
+type ScheduledQuote struct {
+	Id       *pb.UUID             `bson:"_id"`
+	Owner    *pb.UUID             `bson:"owner"`
+	Status   pb.Quote_QuoteStatus `bson:"status"`
+	Schedule *QuoteSchedule       `bson:"schedule"`
+}
+
+// Validate checks the timezone and windows of the schedule
+func (s *QuoteSchedule) Validate() error {
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q", s.Timezone)
+	}
+	for _, w := range s.Windows {
+		if w.Day < time.Sunday || w.Day > time.Saturday {
+			return fmt.Errorf("invalid day %d", w.Day)
+		}
+		start, err := clockOf(w.Start)
+		if err != nil {
+			return err
+		}
+		end, err := clockOf(w.End)
+		if err != nil {
+			return err
+		}
+		if start == end {
+			return fmt.Errorf("window %s %s-%s is empty", w.Day, w.Start, w.End)
+		}
+	}
+	if s.AutoOffMinutes < 0 {
+		return fmt.Errorf("invalid auto off minutes %d", s.AutoOffMinutes)
+	}
+	return nil
+}
+
+// InWindow reports whether now is within the trading hours of the schedule
+func (s *QuoteSchedule) InWindow(now time.Time) (bool, error) {
+	if len(s.Windows) == 0 {
+		return true, nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return false, fmt.Errorf("invalid timezone %q", s.Timezone)
+	}
+	now = now.In(loc)
+	for _, w := range s.Windows {
+		start, err := clockOf(w.Start)
+		if err != nil {
+			return false, err
+		}
+		end, err := clockOf(w.End)
+		if err != nil {
+			return false, err
+		}
+		// the last time the window opened, a week ago if it opens later today
+		y, m, d := now.Date()
+		days := (int(now.Weekday()) - int(w.Day) + 7) % 7
+		from := time.Date(y, m, d-days, 0, 0, 0, 0, loc).Add(start)
+		if from.After(now) {
+			from = from.AddDate(0, 0, -7)
+		}
+		length := end - start
+		if length < 0 {
+			length += 24 * time.Hour
+		}
+		if now.Before(from.Add(length)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Inactive reports whether the owner has been inactive long enough for the quote to turn off
+func (s *QuoteSchedule) Inactive(now time.Time) bool {
+	if s.AutoOffMinutes == 0 {
+		return false
+	}
+	return now.Sub(time.Unix(0, s.LastActive)) > time.Duration(s.AutoOffMinutes)*time.Minute
+}
+
+// Open reports whether the quote should be on the shelf at now
+func (s *QuoteSchedule) Open(now time.Time) (bool, error) {
+	in, err := s.InWindow(now)
+	return in && !s.Inactive(now), err
+}
+
+func clockOf(s string) (time.Duration, error) {
+	t, err := time.Parse(clockLayout, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (m *quoteMongoRepo) SetQuoteSchedule(ctx context.Context, id *pb.UUID, schedule *QuoteSchedule) error {
+	update := bson.M{"$set": bson.M{"schedule": schedule}}
+	if schedule == nil {
+		update = bson.M{"$unset": bson.M{"schedule": ""}}
+	}
+	_, err := m.Quote.UpdateOne(ctx, exmongo.IDFilter(id), update)
+	return err
+}
+
+func (m *quoteMongoRepo) GetQuoteSchedule(ctx context.Context, id *pb.UUID) (*QuoteSchedule, error) {
+	var out struct {
+		Schedule *QuoteSchedule `bson:"schedule"`
+	}
+	err := m.Quote.FindOne(ctx, exmongo.IDFilter(id), options.FindOne().SetProjection(bson.M{"schedule": 1})).Decode(&out)
+	return out.Schedule, err
+}
+
+func (m *quoteMongoRepo) SearchScheduledQuotes(ctx context.Context) ([]*ScheduledQuote, error) {
+	filter := bson.M{
+		"schedule": bson.M{"$exists": true},
+		"status":   bson.M{"$in": bson.A{pb.Quote_ON, pb.Quote_OFF}},
+	}
+	cur, err := m.Quote.Find(ctx, filter, options.Find().SetProjection(bson.M{"owner": 1, "status": 1, "schedule": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var out []*ScheduledQuote
+	for cur.Next(ctx) {
+		var q ScheduledQuote
+		if err := cur.Decode(&q); err != nil {
+			return nil, err
+		}
+		out = append(out, &q)
+	}
+	return out, cur.Err()
+}
+
+func (m *quoteMongoRepo) TouchQuoteSchedules(ctx context.Context, owner *pb.UUID, now int64) error {
+	_, err := m.Quote.UpdateMany(ctx,
+		bson.M{"owner": owner, "schedule": bson.M{"$exists": true}},
+		bson.M{"$set": bson.M{"schedule.lastActive": now}})
+	return err
+}
+
+// SetScheduledQuoteStatus turns a quote on or off for its schedule, if it is still in the
+// from status. A quote is only turned on when the schedule turned it off, it has volume left
+// and its owner has not paused it.
+func (m *quoteMongoRepo) SetScheduledQuoteStatus(ctx context.Context, id *pb.UUID, from, to pb.Quote_QuoteStatus, eventId *pb.UUID) error {
+	expected := bson.M{"status": from, "schedule": bson.M{"$exists": true}}
+	if to == pb.Quote_ON {
+		expected["schedule.off"] = true
+		expected["volume"] = bson.M{"$ne": "0"}
+		expected["pause"] = bson.M{"$exists": false}
+	}
+	filter := bson.M{"$and": bson.A{exmongo.IDFilter(id), expected}}
+	event := pb.OrderEvent{
+		Id:   eventId,
+		Type: pb.OrderEventType_UPDATE_ORDER,
+		Time: time.Now().UnixNano(),
+	}
+	res, err := m.Quote.UpdateOne(ctx, filter, bson.M{
+		"$set":  bson.M{"status": to, "schedule.off": to == pb.Quote_OFF},
+		"$push": bson.M{"events": event},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrQuoteModified
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	RebateLedgerCollection = "rebate_ledger"
+)
+
+// ErrRebatePaid is returned when paying a rebate which has been paid already
+var ErrRebatePaid = errors.New("rebate is already paid")
+
+type RebateStatus string
+
+const (
+	RebateAccrued RebateStatus = "ACCRUED"
+	RebatePaid    RebateStatus = "PAID"
+)
+
+// RebateEntry is the part of a collected fee owed to the referrer of the member who paid it
+type RebateEntry struct {
+	Id *pb.UUID `bson:"_id"`
+	// FeeEventId is the event the fee was collected with, a fee earns one rebate at most
+	FeeEventId *pb.UUID `bson:"feeEventId"`
+	OrderId    *pb.UUID `bson:"orderId"`
+	Referrer   *pb.UUID `bson:"referrer"`
+	Referee    *pb.UUID `bson:"referee"`
+	CoinId     *pb.UUID `bson:"coinId"`
+	Currency   string   `bson:"currency"`
+	// Instrument is the lower case instrument code
+	Instrument string       `bson:"instrument"`
+	Fee        string       `bson:"fee"`
+	Amount     string       `bson:"amount"`
+	Status     RebateStatus `bson:"status"`
+	// PayoutId is the event the rebate was credited with
+	PayoutId *pb.UUID `bson:"payoutId,omitempty"`
+	Time     int64    `bson:"time"`
+	PaidTime int64    `bson:"paidTime,omitempty"`
+}
+
+type RebateFilter struct {
+	Referrer *pb.UUID
+	Status   RebateStatus
+	PageIdx  int64
+	PageSize int64
+}
+
+// RebateSum is the rebate of a referrer in a currency and status
+type RebateSum struct {
+	Currency string
+	Status   RebateStatus
+	Amount   string
+	Count    int64
+}
+
+type RebateLedgerRepository interface {
+	// AccrueRebate adds an accrued rebate. Accruing for the same fee event twice is a no-op.
+	AccrueRebate(ctx context.Context, entry *RebateEntry) error
+	SearchRebates(ctx context.Context, filter *RebateFilter) (out []*RebateEntry, count int64, err error)
+	SumRebates(ctx context.Context, referrer *pb.UUID) ([]*RebateSum, error)
+	// SearchUnpaidRebates returns up to limit accrued rebates, oldest first
+	SearchUnpaidRebates(ctx context.Context, limit int64) ([]*RebateEntry, error)
+	// MarkRebatePaid records that an accrued rebate was credited with payoutId, ErrRebatePaid if
+	// it is not accrued any more
+	MarkRebatePaid(ctx context.Context, id, payoutId *pb.UUID, paidTime int64) error
+}
+
+type rebateLedgerRepoMongo struct {
+	DB *mongo.Collection
+}
+
+func NewRebateLedgerRepo(db *exmongo.Database) RebateLedgerRepository {
+	c := db.CreateCollection(RebateLedgerCollection)
+	_, err := c.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "feeEventId", Value: 1}},
+			Options: new(options.IndexOptions).SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "referrer", Value: 1}, {Key: "time", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "time", Value: 1}},
+		},
+	})
+	if err != nil {
+		log.Fatalf("Create index error %v", err)
+	}
+	return &rebateLedgerRepoMongo{DB: c}
+}
+
+func (r *rebateLedgerRepoMongo) AccrueRebate(ctx context.Context, entry *RebateEntry) error {
+	if entry.Id == nil {
+		entry.Id = exutil.NewUUID()
+	}
+	entry.Status = RebateAccrued
+	_, err := r.DB.InsertOne(ctx, entry)
+	if isDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func (r *rebateLedgerRepoMongo) SearchRebates(ctx context.Context, filter *RebateFilter) (out []*RebateEntry, count int64, err error) {
+	opts := &options.FindOptions{}
+	if filter.PageSize > 0 {
+		opts = exmongo.NewPaginationOptions(filter.PageIdx, filter.PageSize)
+	}
+	opts.SetSort(bson.M{"time": -1})
+	fobj := bson.M{}
+	if filter.Referrer != nil {
+		fobj["referrer"] = filter.Referrer
+	}
+	if filter.Status != "" {
+		fobj["status"] = filter.Status
+	}
+	cur, err := r.DB.Find(ctx, fobj, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cur.Close(ctx)
+	count, err = r.DB.CountDocuments(ctx, fobj)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = exmongo.DecodeCursorToSlice(ctx, cur, &out)
+	return
+}
+
+func (r *rebateLedgerRepoMongo) SumRebates(ctx context.Context, referrer *pb.UUID) ([]*RebateSum, error) {
+	cur, err := r.DB.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"referrer": referrer}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    bson.M{"currency": "$currency", "status": "$status"},
+			"amount": bson.M{"$sum": bson.M{"$toDecimal": "$amount"}},
+			"count":  bson.M{"$sum": 1},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.currency", Value: 1}, {Key: "_id.status", Value: 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var out []*RebateSum
+	for cur.Next(ctx) {
+		var row struct {
+			Id struct {
+				Currency string       `bson:"currency"`
+				Status   RebateStatus `bson:"status"`
+			} `bson:"_id"`
+			Amount primitive.Decimal128 `bson:"amount"`
+			Count  int64                `bson:"count"`
+		}
+		if err := cur.Decode(&row); err != nil {
+			return nil, err
+		}
+		out = append(out, &RebateSum{
+			Currency: row.Id.Currency,
+			Status:   row.Id.Status,
+			Amount:   row.Amount.String(),
+			Count:    row.Count,
+		})
+	}
+	return out, cur.Err()
+}
+
+func (r *rebateLedgerRepoMongo) SearchUnpaidRebates(ctx context.Context, limit int64) (out []*RebateEntry, err error) {
+	opts := options.Find().SetSort(bson.M{"time": 1}).SetLimit(limit)
+	cur, err := r.DB.Find(ctx, bson.M{"status": RebateAccrued}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	err = exmongo.DecodeCursorToSlice(ctx, cur, &out)
+	return
+}
+
+func (r *rebateLedgerRepoMongo) MarkRebatePaid(ctx context.Context, id, payoutId *pb.UUID, paidTime int64) error {
+	res, err := r.DB.UpdateOne(ctx, bson.M{"$and": bson.A{
+		exmongo.IDFilter(id),
+		bson.M{"status": RebateAccrued},
+	}}, bson.M{"$set": bson.M{
+		"status":   RebatePaid,
+		"payoutId": payoutId,
+		"paidTime": paidTime,
+	}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrRebatePaid
+	}
+	return nil
+}
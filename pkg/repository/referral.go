@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ReferralCollection = "otc_referral"
+)
+
+// ErrReferralExists is returned when a member who already has a referrer is referred again
+var ErrReferralExists = errors.New("member already has a referrer")
+
+// Referral links a member to the member who referred them
+type Referral struct {
+	Id       *pb.UUID `bson:"_id"`
+	Referee  *pb.UUID `bson:"referee"`
+	Referrer *pb.UUID `bson:"referrer"`
+	// Share of the fees paid by the referee credited to the referrer, empty for the configured share
+	Share string `bson:"share,omitempty"`
+	Time  int64  `bson:"time"`
+}
+
+type ReferralRepository interface {
+	// CreateReferral returns ErrReferralExists if the referee already has a referrer
+	CreateReferral(ctx context.Context, referral *Referral) (*pb.UUID, error)
+	// GetReferral returns the referral of a referee, nil if they were not referred
+	GetReferral(ctx context.Context, referee *pb.UUID) (*Referral, error)
+	SearchReferrals(ctx context.Context, referrer *pb.UUID, pageIdx, pageSize int64) (out []*Referral, count int64, err error)
+}
+
+type referralRepoMongo struct {
+	DB *mongo.Collection
+}
+
+func NewReferralRepo(db *exmongo.Database) ReferralRepository {
+	c := db.CreateCollection(ReferralCollection)
+	_, err := c.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "referee", Value: 1}},
+			Options: new(options.IndexOptions).SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "referrer", Value: 1}},
+		},
+	})
+	if err != nil {
+		log.Fatalf("Create index error %v", err)
+	}
+	return &referralRepoMongo{DB: c}
+}
+
+func (r *referralRepoMongo) CreateReferral(ctx context.Context, referral *Referral) (*pb.UUID, error) {
+	referral.Id = exutil.NewUUID()
+	_, err := r.DB.InsertOne(ctx, referral)
+	if isDuplicateKeyError(err) {
+		return nil, ErrReferralExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return referral.Id, nil
+}
+
+func (r *referralRepoMongo) GetReferral(ctx context.Context, referee *pb.UUID) (*Referral, error) {
+	var out Referral
+	err := r.DB.FindOne(ctx, bson.M{"referee": referee}).Decode(&out)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (r *referralRepoMongo) SearchReferrals(ctx context.Context, referrer *pb.UUID, pageIdx, pageSize int64) (out []*Referral, count int64, err error) {
+	opts := &options.FindOptions{}
+	if pageSize > 0 {
+		opts = exmongo.NewPaginationOptions(pageIdx, pageSize)
+	}
+	opts.SetSort(bson.M{"time": -1})
+	fobj := bson.M{"referrer": referrer}
+	cur, err := r.DB.Find(ctx, fobj, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cur.Close(ctx)
+	count, err = r.DB.CountDocuments(ctx, fobj)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = exmongo.DecodeCursorToSlice(ctx, cur, &out)
+	return
+}
@@ -2,12 +2,16 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/big"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"gitlab.com/sdce/exlib/exutil"
 	exmongo "gitlab.com/sdce/exlib/mongo"
 	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -18,6 +22,10 @@ const (
 	OtcOrder = "otc_order"
 )
 
+// instrumentCodeCollation compares instrument codes ignoring case. Queries by code use it
+// to match the index on the code.
+var instrumentCodeCollation = &options.Collation{Locale: "en", Strength: 2}
+
 type OrderFilter struct {
 	MemberId      *pb.UUID
 	Status        []pb.OtcOrder_OrderStatus
@@ -28,24 +36,120 @@ type OrderFilter struct {
 	PageSize      int64
 }
 
+// EventActor records who made an order event and why. It is kept in the
+// "eventActors" array of the order, next to the event it belongs to.
+type EventActor struct {
+	EventId  *pb.UUID        `bson:"eventId"`
+	MemberId *pb.UUID        `bson:"memberId,omitempty"`
+	Role     orderstate.Role `bson:"role"`
+	Reason   string          `bson:"reason,omitempty"`
+}
+
+// OrderAmendment is a proposed reduction of an unpaid order, kept in the "amendment"
+// field of the order until the counterparty agrees to it
+type OrderAmendment struct {
+	Volume     string   `bson:"volume"`
+	Value      string   `bson:"value"`
+	ProposedBy *pb.UUID `bson:"proposedBy"`
+	Time       int64    `bson:"time"`
+}
+
+// OrderFees is the fee of an order by party, kept in the "fees" field of the order next to
+// the total in "fee". Orders without it charge the whole fee to the maker in the instrument base.
+type OrderFees struct {
+	Currency FeeCurrency `bson:"currency"`
+	Maker    string      `bson:"maker"`
+	Taker    string      `bson:"taker"`
+}
+
+// OrderPricing is the SDCE reference price an order on a floating quote was priced from,
+// kept in the "pricing" field of the order. Prices are in whole quote currency per whole base.
+type OrderPricing struct {
+	Reference string `bson:"reference"`
+	Premium   string `bson:"premium"`
+	Price     string `bson:"price"`
+}
+
+// OtcTradeRepository stores otc orders. Calls made with a context handed out by a
+// Transactor are part of its transaction.
 type OtcTradeRepository interface {
 	CreateOtcOrder(ctx context.Context, data *pb.OtcOrder, eventId *pb.UUID) (*pb.UUID, error)
 	SearchOtcOrders(ctx context.Context, filter *OrderFilter) (out []*pb.OtcOrder, count int64, err error)
 	GetOtcOrder(ctx context.Context, id *pb.UUID) (*pb.OtcOrder, error)
-	UpdateOtcOrder(ctx context.Context, id *pb.UUID, volume, value string) error
-	UpdateOtcOrderStatus(ctx context.Context, id, eventId *pb.UUID, status pb.OtcOrder_OrderStatus) error
+	UpdateOtcOrder(ctx context.Context, id *pb.UUID, volume, value, fee string) error
+	// AmendOtcOrder updates the amounts of an order like UpdateOtcOrder, failing with
+	// ErrOrderStatusChanged if the order is no longer in status from
+	AmendOtcOrder(ctx context.Context, id *pb.UUID, from pb.OtcOrder_OrderStatus, volume, value, fee string) error
+	SetOtcOrderFees(ctx context.Context, id *pb.UUID, fees *OrderFees) error
+	// GetOtcOrderFees returns the fee of an order by party, nil if it was not recorded
+	GetOtcOrderFees(ctx context.Context, id *pb.UUID) (*OrderFees, error)
+	SetOtcOrderPricing(ctx context.Context, id *pb.UUID, pricing *OrderPricing) error
+	// GetOtcOrderPricing returns the reference price of an order, nil if its quote had a fixed price
+	GetOtcOrderPricing(ctx context.Context, id *pb.UUID) (*OrderPricing, error)
+	// SetOtcOrderPayment records the payment method and payee details of an order
+	SetOtcOrderPayment(ctx context.Context, id *pb.UUID, payment *OrderPayment) error
+	// GetOtcOrderPayment returns the payment of an order, nil if it was not recorded
+	GetOtcOrderPayment(ctx context.Context, id *pb.UUID) (*OrderPayment, error)
+	// ProposeOtcOrderAmendment replaces the pending amendment of an unpaid order
+	ProposeOtcOrderAmendment(ctx context.Context, id *pb.UUID, amendment *OrderAmendment) error
+	// GetOtcOrderAmendment returns the pending amendment of an order, nil if there is none
+	GetOtcOrderAmendment(ctx context.Context, id *pb.UUID) (*OrderAmendment, error)
+	// RemoveOtcOrderAmendment removes amendment from an unpaid order, failing if it is no longer pending
+	RemoveOtcOrderAmendment(ctx context.Context, id *pb.UUID, amendment *OrderAmendment) error
+	// UpdateOtcOrderStatus moves an order from status from to status to and pushes an update
+	// event, recording actor on it when given. It fails with ErrOrderStatusChanged if the order
+	// is no longer in status from.
+	UpdateOtcOrderStatus(ctx context.Context, id, eventId *pb.UUID, from, to pb.OtcOrder_OrderStatus, actor *EventActor) error
+	// RevertOtcOrderStatus undoes the status update of eventId, moving the order from status
+	// to back to status from
+	RevertOtcOrderStatus(ctx context.Context, id, eventId *pb.UUID, from, to pb.OtcOrder_OrderStatus) error
+	// GetAppealFrom returns the status an order was in when it was appealed
+	GetAppealFrom(ctx context.Context, id *pb.UUID) (pb.OtcOrder_OrderStatus, error)
 	UpdateOtcOrderChatroomId(ctx context.Context, id *pb.UUID, roomId string) error
-	DeleteOtcOrder(ctx context.Context, id *pb.UUID) error
 	SearchExpiredOtcOrders(ctx context.Context) (out []*pb.OtcOrder, err error)
+	// SetReleaseDeadline stamps the time by which the seller of a paid order has to release coin
+	SetReleaseDeadline(ctx context.Context, id *pb.UUID, deadline int64) error
+	// SearchOverduePaidOrders returns paid orders past their release deadline
+	SearchOverduePaidOrders(ctx context.Context) (out []*pb.OtcOrder, err error)
+	// SearchUnwarnedPaidOrders returns paid orders with a release deadline before the given
+	// time which have not been warned about yet
+	SearchUnwarnedPaidOrders(ctx context.Context, before int64) (out []*pb.OtcOrder, err error)
+	MarkReleaseWarned(ctx context.Context, id *pb.UUID) error
+	// SumCompletedVolume returns the volume of the orders of an instrument, in any case, the
+	// member took part in which were completed since the given time
+	SumCompletedVolume(ctx context.Context, memberId *pb.UUID, instrument string, since int64) (*big.Int, error)
+	// CountCompletedOrders returns the number of completed orders the member took part in
+	CountCompletedOrders(ctx context.Context, memberId *pb.UUID) (int64, error)
 }
 
+// ErrOrderStatusChanged is returned by status updates of an order which is no longer in the
+// status the update was checked against
+var ErrOrderStatusChanged = errors.New("order status has been changed concurrently")
+
+// ErrNoPaymentMethod is returned by CreateOtcOrder for orders without a payment method
+var ErrNoPaymentMethod = errors.New("order has no payment method")
+
 type otcTradeRepoMongo struct {
 	DB *mongo.Collection
 }
 
 //NewOtcTradeRepository returns a quote repository instance backed by MongoDB
 func NewOtcTradeRepository(db *exmongo.Database) OtcTradeRepository {
-	return &otcTradeRepoMongo{DB: db.CreateCollection(OtcOrder)}
+	c := db.CreateCollection(OtcOrder)
+	_, err := c.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "memberId", Value: 1}, {Key: "instrument.code", Value: 1}, {Key: "releasedTime", Value: 1}},
+			Options: new(options.IndexOptions).SetCollation(instrumentCodeCollation),
+		},
+		{
+			Keys:    bson.D{{Key: "quoteowner", Value: 1}, {Key: "instrument.code", Value: 1}, {Key: "releasedTime", Value: 1}},
+			Options: new(options.IndexOptions).SetCollation(instrumentCodeCollation),
+		},
+	})
+	if err != nil {
+		log.Fatalf("Create index error %v", err)
+	}
+	return &otcTradeRepoMongo{DB: c}
 }
 
 func (o *otcTradeRepoMongo) CreateOtcOrder(ctx context.Context, data *pb.OtcOrder, eventId *pb.UUID) (*pb.UUID, error) {
@@ -53,7 +157,7 @@ func (o *otcTradeRepoMongo) CreateOtcOrder(ctx context.Context, data *pb.OtcOrde
 		data.Id = exutil.NewUUID()
 	}
 	if data.Method == pb.PaymentMethod_INVALID_METHOD {
-		data.Method = pb.PaymentMethod_BANK
+		return nil, ErrNoPaymentMethod
 	}
 	if eventId == nil {
 		eventId = exutil.NewUUID()
@@ -68,11 +172,10 @@ func (o *otcTradeRepoMongo) CreateOtcOrder(ctx context.Context, data *pb.OtcOrde
 		Time:             time.Now().UnixNano(),
 	}}
 	res, err := o.DB.InsertOne(ctx, data)
-	insertedID := res.InsertedID.(primitive.ObjectID)
 	if err != nil {
 		return nil, err
 	}
-
+	insertedID := res.InsertedID.(primitive.ObjectID)
 	return &pb.UUID{Bytes: insertedID[:]}, nil
 }
 
@@ -123,15 +226,8 @@ func (o *otcTradeRepoMongo) GetOtcOrder(ctx context.Context, id *pb.UUID) (*pb.O
 	return &out, err
 }
 
-func (o *otcTradeRepoMongo) UpdateOtcOrderStatus(ctx context.Context, id, eventId *pb.UUID, status pb.OtcOrder_OrderStatus) (err error) {
-	res := o.DB.FindOne(ctx, exmongo.IDFilter(id))
-	if res.Err() != nil {
-		err = res.Err()
-		return
-	}
-	order := &pb.OtcOrder{}
-	err = res.Decode(order)
-	if err != nil {
+func (o *otcTradeRepoMongo) UpdateOtcOrderStatus(ctx context.Context, id, eventId *pb.UUID, from, to pb.OtcOrder_OrderStatus, actor *EventActor) (err error) {
+	if _, err = orderstate.Lookup(from, to); err != nil {
 		return
 	}
 	event := pb.OrderEvent{
@@ -139,29 +235,76 @@ func (o *otcTradeRepoMongo) UpdateOtcOrderStatus(ctx context.Context, id, eventI
 		Type: pb.OrderEventType_UPDATE_ORDER,
 		Time: time.Now().UnixNano(),
 	}
-
-	if (order.Status == pb.OtcOrder_CANCELLED || order.Status == pb.OtcOrder_RESOLVED) ||
-		(order.Status == pb.OtcOrder_UNPAID && status != pb.OtcOrder_PAID && status != pb.OtcOrder_CANCELLED && status != pb.OtcOrder_APPEAL && status != pb.OtcOrder_EXPIRED) ||
-		(order.Status == pb.OtcOrder_PAID && status != pb.OtcOrder_APPEAL && status != pb.OtcOrder_COMPLETED && status != pb.OtcOrder_UNPAID) ||
-		(order.Status == pb.OtcOrder_APPEAL && status != pb.OtcOrder_RESOLVED && status != pb.OtcOrder_CANCELLED) {
-		err = fmt.Errorf("order transition invalid: %s to %s", order.Status.String(), status.String())
-		return
-	}
-	mOb := bson.M{"status": status}
+	mOb := bson.M{"status": to}
 	mOb["lastUpdatedTime"] = time.Now().UnixNano()
-	if status == pb.OtcOrder_COMPLETED {
+	if to == pb.OtcOrder_COMPLETED {
 		mOb["releasedTime"] = time.Now().UnixNano()
 	}
+	if to == pb.OtcOrder_APPEAL {
+		mOb["appealFrom"] = from
+	}
+	push := bson.M{"events": event}
+	if actor != nil {
+		actor.EventId = eventId
+		push["eventActors"] = actor
+	}
 
-	_, err = o.DB.UpdateOne(ctx, exmongo.IDFilter(id),
+	// only move from the status the transition was checked against
+	result, err := o.DB.UpdateOne(ctx, bson.M{"$and": bson.A{exmongo.IDFilter(id), bson.M{"status": from}}},
 		bson.M{
 			"$set":  mOb,
-			"$push": bson.M{"events": event},
+			"$push": push,
 		},
 	)
+	if err != nil {
+		return
+	}
+	if result.MatchedCount == 0 {
+		err = ErrOrderStatusChanged
+	}
 	return
 }
 
+func (o *otcTradeRepoMongo) RevertOtcOrderStatus(ctx context.Context, id, eventId *pb.UUID, from, to pb.OtcOrder_OrderStatus) error {
+	update := bson.M{
+		"$set":  bson.M{"status": from, "lastUpdatedTime": time.Now().UnixNano()},
+		"$pull": bson.M{"events": bson.M{"id": eventId}, "eventActors": bson.M{"eventId": eventId}},
+	}
+	switch to {
+	case pb.OtcOrder_COMPLETED:
+		update["$unset"] = bson.M{"releasedTime": ""}
+	case pb.OtcOrder_APPEAL:
+		update["$unset"] = bson.M{"appealFrom": ""}
+	}
+	res, err := o.DB.UpdateOne(ctx, bson.M{"$and": bson.A{exmongo.IDFilter(id), bson.M{"status": to, "events.id": eventId}}}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrOrderStatusChanged
+	}
+	return nil
+}
+
+func (o *otcTradeRepoMongo) GetAppealFrom(ctx context.Context, id *pb.UUID) (pb.OtcOrder_OrderStatus, error) {
+	var out struct {
+		Status     pb.OtcOrder_OrderStatus  `bson:"status"`
+		AppealFrom *pb.OtcOrder_OrderStatus `bson:"appealFrom"`
+	}
+	err := o.DB.FindOne(ctx, exmongo.IDFilter(id)).Decode(&out)
+	if err != nil {
+		return 0, err
+	}
+	if out.Status != pb.OtcOrder_APPEAL {
+		return 0, fmt.Errorf("order is not in appeal: %s", out.Status.String())
+	}
+	if out.AppealFrom == nil {
+		// appealed before the origin was recorded
+		return 0, fmt.Errorf("order was appealed from an unknown status")
+	}
+	return *out.AppealFrom, nil
+}
+
 func (o *otcTradeRepoMongo) UpdateOtcOrderChatroomId(ctx context.Context, id *pb.UUID, roomId string) (err error) {
 	res := o.DB.FindOne(ctx, exmongo.IDFilter(id))
 	if res.Err() != nil {
@@ -182,14 +325,39 @@ func (o *otcTradeRepoMongo) UpdateOtcOrderChatroomId(ctx context.Context, id *pb
 	return
 }
 
-func (o *otcTradeRepoMongo) UpdateOtcOrder(ctx context.Context, id *pb.UUID, volume, value string) error {
+func (o *otcTradeRepoMongo) UpdateOtcOrder(ctx context.Context, id *pb.UUID, volume, value, fee string) error {
+	fields, err := orderAmountsUpdate(volume, value, fee)
+	if err != nil {
+		return err
+	}
+	_, err = o.DB.UpdateOne(ctx, exmongo.IDFilter(id), fields)
+	return err
+}
+
+func (o *otcTradeRepoMongo) AmendOtcOrder(ctx context.Context, id *pb.UUID, from pb.OtcOrder_OrderStatus, volume, value, fee string) error {
+	fields, err := orderAmountsUpdate(volume, value, fee)
+	if err != nil {
+		return err
+	}
+	result, err := o.DB.UpdateOne(ctx, bson.M{"$and": bson.A{exmongo.IDFilter(id), bson.M{"status": from}}}, fields)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrOrderStatusChanged
+	}
+	return nil
+}
+
+// orderAmountsUpdate sets the amounts of an order and pushes an update event
+func orderAmountsUpdate(volume, value, fee string) (bson.M, error) {
 	valNum, err := exutil.Float(value)
 	if err != nil {
-		return fmt.Errorf("cannot decode value %v to float", value)
+		return nil, fmt.Errorf("cannot decode value %v to float", value)
 	}
 	volNum, err := exutil.Float(volume)
 	if err != nil {
-		return fmt.Errorf("cannot decode value %v to float", volume)
+		return nil, fmt.Errorf("cannot decode value %v to float", volume)
 	}
 
 	price, _ := valNum.Quo(valNum, volNum).Float64()
@@ -202,29 +370,92 @@ func (o *otcTradeRepoMongo) UpdateOtcOrder(ctx context.Context, id *pb.UUID, vol
 		Time:           time.Now().UnixNano(),
 	}
 
-	fields := bson.M{
-		"$set":  bson.M{"volume": volume, "value": value, "price": price},
+	return bson.M{
+		"$set":  bson.M{"volume": volume, "value": value, "price": price, "fee": fee},
 		"$push": bson.M{"events": event},
-	}
-	_, err = o.DB.UpdateOne(ctx, exmongo.IDFilter(id), fields)
+	}, nil
+}
+
+func (o *otcTradeRepoMongo) SetOtcOrderFees(ctx context.Context, id *pb.UUID, fees *OrderFees) error {
+	_, err := o.DB.UpdateOne(ctx, exmongo.IDFilter(id), bson.M{"$set": bson.M{"fees": fees}})
 	return err
 }
 
-func (o *otcTradeRepoMongo) DeleteOtcOrder(ctx context.Context, id *pb.UUID) error {
-	event := pb.OrderEvent{
-		Type: pb.OrderEventType_CANCEL_ORDER,
-		Time: time.Now().UnixNano(),
+func (o *otcTradeRepoMongo) GetOtcOrderFees(ctx context.Context, id *pb.UUID) (*OrderFees, error) {
+	var out struct {
+		Fees *OrderFees `bson:"fees"`
 	}
+	err := o.DB.FindOne(ctx, exmongo.IDFilter(id), options.FindOne().SetProjection(bson.M{"fees": 1})).Decode(&out)
+	return out.Fees, err
+}
 
-	_, err := o.DB.UpdateOne(ctx, exmongo.IDFilter(id),
-		bson.M{
-			"$set": bson.M{"status": pb.OtcOrder_CANCELLED},
-			"$push": bson.M{
-				"events": event}})
+func (o *otcTradeRepoMongo) SetOtcOrderPricing(ctx context.Context, id *pb.UUID, pricing *OrderPricing) error {
+	_, err := o.DB.UpdateOne(ctx, exmongo.IDFilter(id), bson.M{"$set": bson.M{"pricing": pricing}})
+	return err
+}
 
+func (o *otcTradeRepoMongo) GetOtcOrderPricing(ctx context.Context, id *pb.UUID) (*OrderPricing, error) {
+	var out struct {
+		Pricing *OrderPricing `bson:"pricing"`
+	}
+	err := o.DB.FindOne(ctx, exmongo.IDFilter(id), options.FindOne().SetProjection(bson.M{"pricing": 1})).Decode(&out)
+	return out.Pricing, err
+}
+
+func (o *otcTradeRepoMongo) SetOtcOrderPayment(ctx context.Context, id *pb.UUID, payment *OrderPayment) error {
+	_, err := o.DB.UpdateOne(ctx, exmongo.IDFilter(id), bson.M{"$set": bson.M{"payment": payment}})
 	return err
 }
 
+func (o *otcTradeRepoMongo) GetOtcOrderPayment(ctx context.Context, id *pb.UUID) (*OrderPayment, error) {
+	var out struct {
+		Payment *OrderPayment `bson:"payment"`
+	}
+	err := o.DB.FindOne(ctx, exmongo.IDFilter(id), options.FindOne().SetProjection(bson.M{"payment": 1})).Decode(&out)
+	return out.Payment, err
+}
+
+func (o *otcTradeRepoMongo) ProposeOtcOrderAmendment(ctx context.Context, id *pb.UUID, amendment *OrderAmendment) error {
+	res, err := o.DB.UpdateOne(ctx, bson.M{"$and": bson.A{exmongo.IDFilter(id), bson.M{"status": pb.OtcOrder_UNPAID}}},
+		bson.M{"$set": bson.M{"amendment": amendment}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("only unpaid orders can be amended")
+	}
+	return nil
+}
+
+func (o *otcTradeRepoMongo) GetOtcOrderAmendment(ctx context.Context, id *pb.UUID) (*OrderAmendment, error) {
+	var out struct {
+		Amendment *OrderAmendment `bson:"amendment"`
+	}
+	err := o.DB.FindOne(ctx, exmongo.IDFilter(id)).Decode(&out)
+	return out.Amendment, err
+}
+
+func (o *otcTradeRepoMongo) RemoveOtcOrderAmendment(ctx context.Context, id *pb.UUID, amendment *OrderAmendment) error {
+	res, err := o.DB.UpdateOne(ctx,
+		bson.M{"$and": bson.A{
+			exmongo.IDFilter(id),
+			bson.M{
+				"status":               pb.OtcOrder_UNPAID,
+				"amendment.volume":     amendment.Volume,
+				"amendment.value":      amendment.Value,
+				"amendment.proposedBy": amendment.ProposedBy,
+			},
+		}},
+		bson.M{"$unset": bson.M{"amendment": ""}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("order amendment is no longer pending")
+	}
+	return nil
+}
+
 func (o *otcTradeRepoMongo) SearchExpiredOtcOrders(ctx context.Context) (out []*pb.OtcOrder, err error) {
 	timeofNow := time.Now().UnixNano()
 	fobj := bson.D{
@@ -239,3 +470,89 @@ func (o *otcTradeRepoMongo) SearchExpiredOtcOrders(ctx context.Context) (out []*
 	err = exmongo.DecodeCursorToSlice(ctx, cur, &out)
 	return
 }
+
+func (o *otcTradeRepoMongo) SetReleaseDeadline(ctx context.Context, id *pb.UUID, deadline int64) (err error) {
+	_, err = o.DB.UpdateOne(ctx, exmongo.IDFilter(id),
+		bson.M{
+			"$set":   bson.M{"releaseDeadline": deadline},
+			"$unset": bson.M{"releaseWarned": ""},
+		},
+	)
+	return
+}
+
+func (o *otcTradeRepoMongo) SearchOverduePaidOrders(ctx context.Context) (out []*pb.OtcOrder, err error) {
+	fobj := bson.D{
+		{Key: "releaseDeadline", Value: bson.M{"$lte": time.Now().UnixNano()}},
+		{Key: "status", Value: pb.OtcOrder_PAID},
+	}
+	cur, err := o.DB.Find(ctx, fobj, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	err = exmongo.DecodeCursorToSlice(ctx, cur, &out)
+	return
+}
+
+func (o *otcTradeRepoMongo) SearchUnwarnedPaidOrders(ctx context.Context, before int64) (out []*pb.OtcOrder, err error) {
+	fobj := bson.D{
+		{Key: "releaseDeadline", Value: bson.M{"$lte": before}},
+		{Key: "status", Value: pb.OtcOrder_PAID},
+		{Key: "releaseWarned", Value: bson.M{"$ne": true}},
+	}
+	cur, err := o.DB.Find(ctx, fobj, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	err = exmongo.DecodeCursorToSlice(ctx, cur, &out)
+	return
+}
+
+func (o *otcTradeRepoMongo) MarkReleaseWarned(ctx context.Context, id *pb.UUID) (err error) {
+	_, err = o.DB.UpdateOne(ctx, exmongo.IDFilter(id), bson.M{"$set": bson.M{"releaseWarned": true}})
+	return
+}
+
+func (o *otcTradeRepoMongo) SumCompletedVolume(ctx context.Context, memberId *pb.UUID, instrument string, since int64) (*big.Int, error) {
+	fobj := bson.M{
+		"$or": bson.A{
+			bson.M{"memberId": memberId},
+			bson.M{"quoteowner": memberId},
+		},
+		"instrument.code": instrument,
+		"status":          pb.OtcOrder_COMPLETED,
+		"releasedTime":    bson.M{"$gte": since},
+	}
+	cur, err := o.DB.Find(ctx, fobj, options.Find().SetProjection(bson.M{"volume": 1}).SetCollation(instrumentCodeCollation))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	total := new(big.Int)
+	for cur.Next(ctx) {
+		var order struct {
+			Volume string `bson:"volume"`
+		}
+		if err := cur.Decode(&order); err != nil {
+			return nil, err
+		}
+		volume, ok := new(big.Int).SetString(order.Volume, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid volume %q of completed order", order.Volume)
+		}
+		total.Add(total, volume)
+	}
+	return total, cur.Err()
+}
+
+func (o *otcTradeRepoMongo) CountCompletedOrders(ctx context.Context, memberId *pb.UUID) (int64, error) {
+	return o.DB.CountDocuments(ctx, bson.M{
+		"$or": bson.A{
+			bson.M{"memberId": memberId},
+			bson.M{"quoteowner": memberId},
+		},
+		"status": pb.OtcOrder_COMPLETED,
+	})
+}
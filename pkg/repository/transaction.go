@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	maxTransactionRetries = 3
+)
+
+// Transactor runs a unit of work in a MongoDB multi-document transaction.
+// Repository calls made with the context handed to fn join the transaction, so
+// fn must only contain database writes: it may be run more than once when the
+// transaction is retried.
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type mongoTransactor struct {
+	client    *mongo.Client
+	supported bool
+}
+
+// NewTransactor returns a Transactor for db. Transactions need a replica set or a
+// sharded cluster; on a standalone server the unit of work runs without one.
+func NewTransactor(db *exmongo.Database) Transactor {
+	var res bson.M
+	err := db.Db.RunCommand(context.Background(), bson.D{{Key: "isMaster", Value: 1}}).Decode(&res)
+	if err != nil {
+		log.Errorf("Failed to check MongoDB topology: %v", err)
+	}
+	_, isReplicaSet := res["setName"]
+	supported := err == nil && (isReplicaSet || res["msg"] == "isdbgrid")
+	if !supported {
+		log.Warn("MongoDB replica set is not available, quote and order writes will not run in transactions")
+	}
+	return &mongoTransactor{
+		client:    db.Db.Client(),
+		supported: supported,
+	}
+}
+
+func (t *mongoTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	if !t.supported {
+		return fn(ctx)
+	}
+	for i := 0; i < maxTransactionRetries; i++ {
+		err = t.client.UseSession(ctx, func(sc mongo.SessionContext) error {
+			if err := sc.StartTransaction(); err != nil {
+				return err
+			}
+			if err := fn(sc); err != nil {
+				if abortErr := sc.AbortTransaction(sc); abortErr != nil {
+					log.Errorf("Failed to abort transaction: %v", abortErr)
+				}
+				return err
+			}
+			return sc.CommitTransaction(sc)
+		})
+		if !isTransientTransactionError(err) {
+			return
+		}
+		log.Warnf("Transient transaction error, retrying: %v", err)
+	}
+	return
+}
+
+// InTransaction reports whether ctx belongs to a unit of work started by a Transactor
+// which runs in a real transaction.
+func InTransaction(ctx context.Context) bool {
+	_, ok := ctx.(mongo.SessionContext)
+	return ok
+}
+
+func isTransientTransactionError(err error) bool {
+	cmdErr, ok := err.(mongo.CommandError)
+	return ok && cmdErr.HasErrorLabel("TransientTransactionError")
+}
@@ -0,0 +1,116 @@
+package rpc
+
+import (
+	"bytes"
+
+	"gitlab.com/sdce/exlib/exutil"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// orderActor is the caller acting on an order, sent in the request metadata
+type orderActor struct {
+	memberId *pb.UUID
+	// role is set for admins and internal jobs only
+	role orderstate.Role
+	// reason is recorded with the status changes made by the actor
+	reason string
+}
+
+// systemActor is the service itself, acting for a job or for a member's request on orders
+// the member may not change directly
+var systemActor = &orderActor{role: orderstate.RoleSystem}
+
+// actorFromContext reads the actor from the request metadata. The service does not
+// authenticate callers: the gateway in front of it authenticates the client, strips any
+// actor headers the client sent and sets them from the session, and internal jobs set them
+// with otcapi.WithActor. The service must only be reachable through the gateway and from
+// the internal network.
+func actorFromContext(ctx context.Context) (*orderActor, error) {
+	a := &orderActor{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ids := md.Get(orderstate.ActorIdHeader); len(ids) > 0 {
+		id, err := exutil.AtoUUID(ids[0])
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid acting member: %s", ids[0])
+		}
+		a.memberId = id
+	}
+	if roles := md.Get(orderstate.ActorRoleHeader); len(roles) > 0 {
+		a.role = orderstate.Role(roles[0])
+		if a.role != orderstate.RoleAdmin && a.role != orderstate.RoleSystem {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid acting role: %s", roles[0])
+		}
+	}
+	if a.memberId == nil && a.role == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "acting member is required")
+	}
+	return a, nil
+}
+
+// requireAdmin returns the actor of the request, or an error unless it is an admin
+func requireAdmin(ctx context.Context) (*orderActor, error) {
+	return requireRole(ctx, orderstate.RoleAdmin)
+}
+
+// requireRole returns the actor of the request, or an error unless it acts in one of roles
+func requireRole(ctx context.Context, roles ...orderstate.Role) (*orderActor, error) {
+	actor, err := actorFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range roles {
+		if actor.role == r {
+			return actor, nil
+		}
+	}
+	return nil, status.Errorf(codes.PermissionDenied, "%s is not one of %v", actor, roles)
+}
+
+// rolesIn returns the roles the actor plays in order. The order member buys on BID
+// orders and sells on ASK orders, the quote owner takes the other side.
+func (a *orderActor) rolesIn(order *pb.OtcOrder) (roles []orderstate.Role) {
+	if a.role != "" {
+		roles = append(roles, a.role)
+	}
+	if a.memberId == nil {
+		return
+	}
+	buyer, seller := order.MemberId, order.QuoteOwner
+	if order.Side == pb.OrderSide_ASK {
+		buyer, seller = seller, buyer
+	}
+	if sameUUID(a.memberId, buyer) {
+		roles = append(roles, orderstate.RoleBuyer)
+	}
+	if sameUUID(a.memberId, seller) {
+		roles = append(roles, orderstate.RoleSeller)
+	}
+	return
+}
+
+// authorize returns the role which allows the actor to make transition t on order
+func (a *orderActor) authorize(t *orderstate.Transition, order *pb.OtcOrder) (orderstate.Role, error) {
+	for _, r := range a.rolesIn(order) {
+		if t.Permits(r) {
+			return r, nil
+		}
+	}
+	return "", status.Errorf(codes.PermissionDenied, "%s may not move order %s from %s to %s",
+		a.String(), exutil.UUIDtoA(order.Id), t.From.String(), t.To.String())
+}
+
+func (a *orderActor) String() string {
+	if a.memberId == nil {
+		return string(a.role)
+	}
+	return "member " + exutil.UUIDtoA(a.memberId)
+}
+
+func sameUUID(a, b *pb.UUID) bool {
+	return a != nil && b != nil && bytes.Equal(a.Bytes, b.Bytes)
+}
@@ -0,0 +1,167 @@
+package rpc
+
+import (
+	"encoding/json"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+const (
+	// ExtensionServiceName is the grpc service serving the RPCs which are not part of the
+	// OtcTrading service of protogo. Its methods are named like the OtcServer methods.
+	ExtensionServiceName = "otc.OtcTradingExtension"
+	// ExtensionContentSubtype is the codec of the extension service, whose messages are the
+	// request and response types of this package sent as JSON. Clients call it with
+	// grpc.CallContentSubtype(ExtensionContentSubtype).
+	ExtensionContentSubtype = "json"
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return ExtensionContentSubtype
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// extensionMethod is a unary method of the extension service
+type extensionMethod struct {
+	name       string
+	newRequest func() interface{}
+	call       func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error)
+}
+
+var extensionMethods = []extensionMethod{
+	{"DoResolveAppeal", func() interface{} { return new(ResolveAppealRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoResolveAppeal(ctx, in.(*ResolveAppealRequest))
+	}},
+	{"DoAmendOrder", func() interface{} { return new(AmendOrderRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoAmendOrder(ctx, in.(*AmendOrderRequest))
+	}},
+	{"DoCreateFeeSchedule", func() interface{} { return new(CreateFeeScheduleRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoCreateFeeSchedule(ctx, in.(*CreateFeeScheduleRequest))
+	}},
+	{"DoGetFeeSchedule", func() interface{} { return new(GetFeeScheduleRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoGetFeeSchedule(ctx, in.(*GetFeeScheduleRequest))
+	}},
+	{"DoUpdateFeeSchedule", func() interface{} { return new(UpdateFeeScheduleRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoUpdateFeeSchedule(ctx, in.(*UpdateFeeScheduleRequest))
+	}},
+	{"DoDeleteFeeSchedule", func() interface{} { return new(DeleteFeeScheduleRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoDeleteFeeSchedule(ctx, in.(*DeleteFeeScheduleRequest))
+	}},
+	{"DoSearchFeeSchedules", func() interface{} { return new(SearchFeeSchedulesRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoSearchFeeSchedules(ctx, in.(*SearchFeeSchedulesRequest))
+	}},
+	{"DoSumFeeRevenue", func() interface{} { return new(FeeRevenueRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoSumFeeRevenue(ctx, in.(*FeeRevenueRequest))
+	}},
+	{"DoPreviewOrder", func() interface{} { return new(PreviewOrderRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoPreviewOrder(ctx, in.(*PreviewOrderRequest))
+	}},
+	{"DoCreateReferral", func() interface{} { return new(CreateReferralRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoCreateReferral(ctx, in.(*CreateReferralRequest))
+	}},
+	{"DoSearchReferrals", func() interface{} { return new(SearchReferralsRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoSearchReferrals(ctx, in.(*SearchReferralsRequest))
+	}},
+	{"DoSearchRebates", func() interface{} { return new(SearchRebatesRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoSearchRebates(ctx, in.(*SearchRebatesRequest))
+	}},
+	{"DoSumRebates", func() interface{} { return new(SumRebatesRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoSumRebates(ctx, in.(*SumRebatesRequest))
+	}},
+	{"DoCreateFloatingQuote", func() interface{} { return new(CreateFloatingQuoteRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoCreateFloatingQuote(ctx, in.(*CreateFloatingQuoteRequest))
+	}},
+	{"DoGetOrderBookDepth", func() interface{} { return new(OrderBookDepthRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoGetOrderBookDepth(ctx, in.(*OrderBookDepthRequest))
+	}},
+	{"DoInstantTrade", func() interface{} { return new(InstantTradeRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoInstantTrade(ctx, in.(*InstantTradeRequest))
+	}},
+	{"DoAmendQuote", func() interface{} { return new(AmendQuoteRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoAmendQuote(ctx, in.(*AmendQuoteRequest))
+	}},
+	{"DoSetQuoteSchedule", func() interface{} { return new(SetQuoteScheduleRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoSetQuoteSchedule(ctx, in.(*SetQuoteScheduleRequest))
+	}},
+	{"DoMarkMakerActive", func() interface{} { return new(MakerActivityRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoMarkMakerActive(ctx, in.(*MakerActivityRequest))
+	}},
+	{"DoSetQuoteEligibility", func() interface{} { return new(SetQuoteEligibilityRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoSetQuoteEligibility(ctx, in.(*SetQuoteEligibilityRequest))
+	}},
+	{"DoSetMemberStanding", func() interface{} { return new(SetMemberStandingRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoSetMemberStanding(ctx, in.(*SetMemberStandingRequest))
+	}},
+	{"DoListEligibleQuotes", func() interface{} { return new(ListEligibleQuotesRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoListEligibleQuotes(ctx, in.(*ListEligibleQuotesRequest))
+	}},
+	{"DoSetPaymentDetails", func() interface{} { return new(SetPaymentDetailsRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoSetPaymentDetails(ctx, in.(*SetPaymentDetailsRequest))
+	}},
+	{"DoPauseQuote", func() interface{} { return new(PauseQuoteRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoPauseQuote(ctx, in.(*PauseQuoteRequest))
+	}},
+	{"DoResumeQuote", func() interface{} { return new(ResumeQuoteRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoResumeQuote(ctx, in.(*ResumeQuoteRequest))
+	}},
+	{"DoSetQuoteExpiry", func() interface{} { return new(SetQuoteExpiryRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoSetQuoteExpiry(ctx, in.(*SetQuoteExpiryRequest))
+	}},
+	{"DoKillSwitch", func() interface{} { return new(KillSwitchRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoKillSwitch(ctx, in.(*KillSwitchRequest))
+	}},
+	{"DoAdminKillSwitch", func() interface{} { return new(AdminKillSwitchRequest) }, func(o OtcServer, ctx context.Context, in interface{}) (interface{}, error) {
+		return o.DoAdminKillSwitch(ctx, in.(*AdminKillSwitchRequest))
+	}},
+}
+
+// RegisterOtcTradingExtensionServer registers the extension service of srv on s
+func RegisterOtcTradingExtensionServer(s *grpc.Server, srv *OtcServer) {
+	desc := &grpc.ServiceDesc{
+		ServiceName: ExtensionServiceName,
+		HandlerType: (*interface{})(nil),
+		Metadata:    "otc/extension",
+	}
+	for _, m := range extensionMethods {
+		desc.Methods = append(desc.Methods, m.desc())
+	}
+	s.RegisterService(desc, srv)
+}
+
+func (m extensionMethod) desc() grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: m.name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := m.newRequest()
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			o := *srv.(*OtcServer)
+			if interceptor == nil {
+				return m.call(o, ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/" + ExtensionServiceName + "/" + m.name,
+			}
+			return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return m.call(o, ctx, req)
+			})
+		},
+	}
+}
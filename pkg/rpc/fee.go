@@ -0,0 +1,249 @@
+package rpc
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// orderFee is the fee of an order by party. The seller gives the base and the buyer the
+// quote currency, so the party paying in the currency they give locks the fee on top of it,
+// while the fee of the other party is deducted from what they receive.
+type orderFee struct {
+	currency      repository.FeeCurrency
+	buyer, seller *big.Int
+}
+
+func newOrderFee(order *pb.OtcOrder, fees *repository.OrderFees) (f orderFee, err error) {
+	if fees == nil {
+		fees = &repository.OrderFees{Currency: repository.FeeCurrencyBase, Maker: order.Fee, Taker: "0"}
+	}
+	maker, ok := new(big.Int).SetString(fees.Maker, 10)
+	if !ok {
+		return f, fmt.Errorf("can not transfer order maker fee to int %s", fees.Maker)
+	}
+	taker, ok := new(big.Int).SetString(fees.Taker, 10)
+	if !ok {
+		return f, fmt.Errorf("can not transfer order taker fee to int %s", fees.Taker)
+	}
+	f.currency = fees.Currency
+	if order.Side == pb.OrderSide_BID {
+		f.buyer, f.seller = taker, maker
+	} else {
+		f.buyer, f.seller = maker, taker
+	}
+	return
+}
+
+func (o OtcServer) loadOrderFee(ctx context.Context, order *pb.OtcOrder) (orderFee, error) {
+	fees, err := o.trades.GetOtcOrderFees(ctx, order.Id)
+	if err != nil {
+		return orderFee{}, err
+	}
+	return newOrderFee(order, fees)
+}
+
+func (f orderFee) only(currency repository.FeeCurrency, amount *big.Int) *big.Int {
+	if f.currency != currency {
+		return new(big.Int)
+	}
+	return amount
+}
+
+// lockedBase is the fee the seller locks on top of the volume
+func (f orderFee) lockedBase() *big.Int {
+	return f.only(repository.FeeCurrencyBase, f.seller)
+}
+
+// lockedQuote is the fee the buyer locks on top of the value
+func (f orderFee) lockedQuote() *big.Int {
+	return f.only(repository.FeeCurrencyQuote, f.buyer)
+}
+
+// deductedBase is the fee taken from the volume the buyer receives
+func (f orderFee) deductedBase() *big.Int {
+	return f.only(repository.FeeCurrencyBase, f.buyer)
+}
+
+// deductedQuote is the fee taken from the value the seller receives
+func (f orderFee) deductedQuote() *big.Int {
+	return f.only(repository.FeeCurrencyQuote, f.seller)
+}
+
+func (f orderFee) maker(order *pb.OtcOrder) *big.Int {
+	if order.Side == pb.OrderSide_BID {
+		return f.seller
+	}
+	return f.buyer
+}
+
+func (f orderFee) taker(order *pb.OtcOrder) *big.Int {
+	if order.Side == pb.OrderSide_BID {
+		return f.buyer
+	}
+	return f.seller
+}
+
+// onQuote is the maker fee taken from the locked fee of the quote
+func (f orderFee) onQuote(order *pb.OtcOrder) *big.Int {
+	if order.Side == pb.OrderSide_BID {
+		return f.lockedBase()
+	}
+	return f.lockedQuote()
+}
+
+// onOrder is the taker fee locked with the order
+func (f orderFee) onOrder(order *pb.OtcOrder) *big.Int {
+	if order.Side == pb.OrderSide_BID {
+		return f.lockedQuote()
+	}
+	return f.lockedBase()
+}
+
+func (f orderFee) total() *big.Int {
+	return new(big.Int).Add(f.buyer, f.seller)
+}
+
+// scale returns the fee of share of the order
+func (f orderFee) scale(share *big.Rat) orderFee {
+	return orderFee{
+		currency: f.currency,
+		buyer:    MoneyFromInt(f.buyer).Mul(share).Round(feeRounding),
+		seller:   MoneyFromInt(f.seller).Mul(share).Round(feeRounding),
+	}
+}
+
+func (f orderFee) sub(g orderFee) orderFee {
+	return orderFee{
+		currency: f.currency,
+		buyer:    new(big.Int).Sub(f.buyer, g.buyer),
+		seller:   new(big.Int).Sub(f.seller, g.seller),
+	}
+}
+
+func (f orderFee) fees(order *pb.OtcOrder) *repository.OrderFees {
+	return &repository.OrderFees{
+		Currency: f.currency,
+		Maker:    f.maker(order).String(),
+		Taker:    f.taker(order).String(),
+	}
+}
+
+func (f orderFee) coin(inst *pb.InstrumentRef) *pb.CurrencyRef {
+	if f.currency == repository.FeeCurrencyQuote {
+		return inst.GetQuote()
+	}
+	return inst.GetBase()
+}
+
+// collectFee charges fee from the locked balance of the buyer or seller account, books it and
+// accrues the rebate of the payer's referrer
+func (o OtcServer) collectFee(ctx context.Context, order *pb.OtcOrder, accountId *pb.UUID, f orderFee, q *pb.Quote) error {
+	buyer, seller := order.MemberId, q.Owner
+	if order.Side == pb.OrderSide_ASK {
+		buyer, seller = q.Owner, order.MemberId
+	}
+	coin := f.coin(order.Instrument)
+	for _, part := range []struct {
+		party  orderstate.Role
+		payer  *pb.UUID
+		amount *big.Int
+	}{{orderstate.RoleBuyer, buyer, f.buyer}, {orderstate.RoleSeller, seller, f.seller}} {
+		if part.amount.Sign() == 0 {
+			continue
+		}
+		eventId := feeEventId(order, part.party)
+		err := o.apis.ReleaselockedBalance(ctx, &pb.ReleaseLockedBalanceRequest{
+			From:   accountId,
+			To:     nil,
+			Amount: part.amount.String(),
+			Order: &pb.OrderRef{
+				Id: order.Id,
+			},
+			Event: &pb.OrderEvent{
+				Id: eventId,
+			},
+		})
+		if err != nil {
+			log.Error("fail to release fee")
+			return err
+		}
+		o.recordFee(ctx, order, part.payer, coin, part.amount.String(), eventId)
+		o.accrueRebate(ctx, order, part.payer, coin, part.amount, eventId)
+	}
+	return nil
+}
+
+// feeEventId is the event of charging party the fee of order as its coin is released from the
+// status order is in. Coin is released once per order, so charging the fee again gets the same
+// event, which the fee ledger and the rebates are unique on.
+func feeEventId(order *pb.OtcOrder, party orderstate.Role) *pb.UUID {
+	h := sha256.New()
+	h.Write(order.Id.Bytes)
+	h.Write([]byte(order.Status.String()))
+	h.Write([]byte(party))
+	return &pb.UUID{Bytes: h.Sum(nil)[:len(order.Id.Bytes)]}
+}
+
+// effectiveFeeSchedule returns the fee schedule of the instrument and quote side in effect,
+// nil if there is none
+func (o OtcServer) effectiveFeeSchedule(ctx context.Context, inst *pb.InstrumentRef, side pb.OrderSide, now time.Time) (*repository.FeeSchedule, error) {
+	return o.feeSchedules.FindEffectiveFeeSchedule(ctx, strings.ToLower(inst.GetCode()), side, now.UnixNano())
+}
+
+// newQuoteFeePolicy returns the fee policy for a quote being created
+func (o OtcServer) newQuoteFeePolicy(ctx context.Context, q *pb.Quote) (policy repository.FeePolicy, err error) {
+	schedule, err := o.effectiveFeeSchedule(ctx, q.Instrument, q.Side, time.Now())
+	if err != nil {
+		return
+	}
+	policy = repository.DefaultFeePolicy
+	if schedule != nil {
+		policy = schedule.Policy
+	}
+	return policy, checkFeePolicy(policy, q.Instrument)
+}
+
+// quoteFeePolicy returns the fee policy of the orders on a quote
+func (o OtcServer) quoteFeePolicy(ctx context.Context, q *pb.Quote) (repository.FeePolicy, error) {
+	policy, err := o.quotes.GetQuoteFeePolicy(ctx, q.Id)
+	if err != nil {
+		return repository.FeePolicy{}, err
+	}
+	if policy == nil {
+		return repository.DefaultFeePolicy, nil
+	}
+	return *policy, checkFeePolicy(*policy, q.Instrument)
+}
+
+// checkFeePolicy rejects fees in a quote currency paid outside the platform, as they cannot be collected
+func checkFeePolicy(policy repository.FeePolicy, inst *pb.InstrumentRef) error {
+	if _, ok := externalCurrency[inst.GetQuote().GetSymbol()]; ok && policy.Currency == repository.FeeCurrencyQuote {
+		return status.Errorf(codes.FailedPrecondition, "fees cannot be charged in %s", inst.GetQuote().GetSymbol())
+	}
+	return nil
+}
+
+func validateFeePolicy(policy repository.FeePolicy) error {
+	switch policy.Payer {
+	case repository.FeePayerMaker, repository.FeePayerTaker, repository.FeePayerBoth:
+	default:
+		return fmt.Errorf("unknown fee payer %q", policy.Payer)
+	}
+	switch policy.Currency {
+	case repository.FeeCurrencyBase, repository.FeeCurrencyQuote:
+	default:
+		return fmt.Errorf("unknown fee currency %q", policy.Currency)
+	}
+	return nil
+}
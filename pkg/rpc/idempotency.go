@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// IdempotencyKeyHeader is the grpc metadata key clients use to make retried calls safe
+	IdempotencyKeyHeader = "idempotency-key"
+
+	idempotencyWaitTime     = 3 * time.Second
+	idempotencyPollInterval = 100 * time.Millisecond
+)
+
+func idempotencyKeyFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	keys := md.Get(IdempotencyKeyHeader)
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[0]
+}
+
+// withIdempotency runs fn at most once per idempotency key sent by the client. A retry
+// returns the id created by the first call. A retry made while the first call is still
+// running waits for it briefly, then fails with Aborted, and so do retries of a call which
+// never finished until its key expires.
+func (o OtcServer) withIdempotency(ctx context.Context, method string, memberId *pb.UUID, fn func() (*pb.UUID, error)) (id *pb.UUID, err error) {
+	key := idempotencyKeyFromContext(ctx)
+	if key == "" {
+		return fn()
+	}
+	rec, reserved, err := o.idempotency.Reserve(ctx, key, method, memberId)
+	if err != nil {
+		log.Errorf("Failed to reserve idempotency key %s for %s: %v", key, method, err)
+		return nil, status.Errorf(codes.Internal, "failed to check idempotency key")
+	}
+	if !reserved {
+		return o.awaitIdempotentResult(ctx, rec, key)
+	}
+
+	id, err = fn()
+	if err != nil {
+		if relErr := o.idempotency.Release(ctx, rec); relErr != nil {
+			log.Errorf("Failed to release idempotency key %s: %v", rec.Key, relErr)
+		}
+		return nil, err
+	}
+	// the call succeeded, so its result is returned even if it cannot be replayed
+	if err := o.idempotency.Complete(ctx, rec, id); err != nil {
+		log.Errorf("Failed to save result %s of idempotency key %s: %v", exutil.UUIDtoA(id), rec.Key, err)
+	}
+	return id, nil
+}
+
+func (o OtcServer) awaitIdempotentResult(ctx context.Context, rec *repository.IdempotencyRecord, key string) (*pb.UUID, error) {
+	deadline := time.Now().Add(idempotencyWaitTime)
+	for rec.Status != repository.IdempotencyDone {
+		if time.Now().After(deadline) {
+			return nil, status.Errorf(codes.Aborted, "request with idempotency key %s is still in progress", key)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(idempotencyPollInterval):
+		}
+		var err error
+		rec, err = o.idempotency.Get(ctx, key, rec.Method, rec.MemberId)
+		if err != nil {
+			// the first request failed and released the key
+			return nil, status.Errorf(codes.Aborted, "request with idempotency key %s failed, please retry", key)
+		}
+	}
+	log.Infof("Replaying %s for idempotency key %s", rec.Method, key)
+	return rec.ResultId, nil
+}
@@ -0,0 +1,206 @@
+package rpc
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+
+	pb "gitlab.com/sdce/protogo"
+)
+
+// RoundingMode says how an exact amount is rounded to a whole number of smallest units
+type RoundingMode int
+
+const (
+	// RoundDown rounds towards zero
+	RoundDown RoundingMode = iota
+	// RoundUp rounds away from zero
+	RoundUp
+	// RoundHalfUp rounds to the nearest unit, halves away from zero
+	RoundHalfUp
+	// RoundHalfEven rounds to the nearest unit, halves to the even unit
+	RoundHalfEven
+)
+
+// feeRounding is used for all fees. It is the rounding big.Float.Text('f', 0) applied
+// when fees were computed in floating point.
+const feeRounding = RoundHalfEven
+
+// Money is an exact amount in the smallest unit of a currency, e.g. satoshi for BTC.
+// Amounts are whole units on the wire but may be fractional in between calculations.
+type Money struct {
+	r *big.Rat
+}
+
+// ParseMoney parses a whole number of smallest units
+func ParseMoney(s string) (Money, error) {
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return Money{}, fmt.Errorf("invalid amount: %q", s)
+	}
+	return MoneyFromInt(i), nil
+}
+
+func MoneyFromInt(i *big.Int) Money {
+	return Money{r: new(big.Rat).SetInt(i)}
+}
+
+func (m Money) Add(n Money) Money {
+	return Money{r: new(big.Rat).Add(m.r, n.r)}
+}
+
+func (m Money) Sub(n Money) Money {
+	return Money{r: new(big.Rat).Sub(m.r, n.r)}
+}
+
+func (m Money) Mul(x *big.Rat) Money {
+	return Money{r: new(big.Rat).Mul(m.r, x)}
+}
+
+func (m Money) Quo(x *big.Rat) Money {
+	return Money{r: new(big.Rat).Quo(m.r, x)}
+}
+
+func (m Money) Sign() int {
+	return m.r.Sign()
+}
+
+func (m Money) Cmp(n Money) int {
+	return m.r.Cmp(n.r)
+}
+
+// Round returns the amount as a whole number of smallest units
+func (m Money) Round(mode RoundingMode) *big.Int {
+	q, r := new(big.Int).QuoRem(m.r.Num(), m.r.Denom(), new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+	away := false
+	switch mode {
+	case RoundUp:
+		away = true
+	case RoundHalfUp, RoundHalfEven:
+		// compare twice the remainder with the denominator
+		c := new(big.Int).Abs(new(big.Int).Lsh(r, 1)).Cmp(m.r.Denom())
+		away = c > 0 || (c == 0 && (mode == RoundHalfUp || q.Bit(0) == 1))
+	}
+	if away {
+		q.Add(q, big.NewInt(int64(m.r.Sign())))
+	}
+	return q
+}
+
+// String returns the exact amount, as a fraction if it is not whole
+func (m Money) String() string {
+	return m.r.RatString()
+}
+
+// ParseRate parses an exact decimal rate, such as a fee rate of "0.002"
+func ParseRate(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid rate: %q", s)
+	}
+	return r, nil
+}
+
+// FeeOnVolume returns the fee charged on volume at rate
+func FeeOnVolume(volume Money, rate *big.Rat) *big.Int {
+	return volume.Mul(rate).Round(feeRounding)
+}
+
+// GrossUpFee returns the fee to lock on top of volume so that the fee is rate of the total
+func GrossUpFee(volume Money, rate *big.Rat) *big.Int {
+	net := new(big.Rat).Sub(big.NewRat(1, 1), rate)
+	return volume.Mul(rate).Quo(net).Round(feeRounding)
+}
+
+// Price is an exact price in whole quote currency per whole base currency
+type Price struct {
+	r *big.Rat
+}
+
+// PriceOf returns the price of trading volume of the instrument base for value of its quote
+func PriceOf(value, volume Money, inst *pb.InstrumentRef) (Price, error) {
+	if volume.Sign() == 0 {
+		return Price{}, fmt.Errorf("price of zero volume")
+	}
+	unit := new(big.Rat).Quo(value.r, volume.r)
+	return Price{r: unit.Mul(unit, decimalShift(inst))}, nil
+}
+
+// ParsePrice parses a decimal price in whole quote currency per whole base currency
+func ParsePrice(s string) (Price, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || r.Sign() <= 0 {
+		return Price{}, fmt.Errorf("invalid price: %q", s)
+	}
+	return Price{r: r}, nil
+}
+
+// QuotePrice returns the price of a quote
+func QuotePrice(q *pb.Quote) Price {
+	unit := decimalOf(q.Price)
+	return Price{r: unit.Mul(unit, decimalShift(q.Instrument))}
+}
+
+// ValueAt returns the value of volume at a price in smallest units, as stored on quotes
+func ValueAt(volume Money, unitPrice float64) Money {
+	return volume.Mul(decimalOf(unitPrice))
+}
+
+// UnitPrice returns the price in smallest quote units per smallest base unit, the way
+// prices are stored on quotes and orders
+func (p Price) UnitPrice(inst *pb.InstrumentRef) float64 {
+	f, _ := new(big.Rat).Quo(p.r, decimalShift(inst)).Float64()
+	return f
+}
+
+// Within reports whether p differs from other by at most tolerance
+func (p Price) Within(other Price, tolerance *big.Rat) bool {
+	diff := new(big.Rat).Sub(p.r, other.r)
+	return diff.Abs(diff).Cmp(tolerance) <= 0
+}
+
+func (p Price) Mul(x *big.Rat) Price {
+	return Price{r: new(big.Rat).Mul(p.r, x)}
+}
+
+func (p Price) Cmp(other Price) int {
+	return p.r.Cmp(other.r)
+}
+
+// Round rounds the price to decimals places of the quote currency
+func (p Price) Round(decimals int32, mode RoundingMode) Price {
+	shift := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil))
+	units := Money{r: new(big.Rat).Mul(p.r, shift)}.Round(mode)
+	return Price{r: new(big.Rat).Quo(new(big.Rat).SetInt(units), shift)}
+}
+
+func (p Price) String() string {
+	return p.r.FloatString(8)
+}
+
+// decimalOf reads a stored float price as the shortest decimal that represents it, which
+// is the price it was created from
+func decimalOf(f float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	return r
+}
+
+// decimalShift converts a price in smallest units to whole units
+func decimalShift(inst *pb.InstrumentRef) *big.Rat {
+	shift := int64(inst.GetBase().GetDecimal()) - int64(inst.GetQuote().GetDecimal())
+	p := new(big.Int).Exp(big.NewInt(10), big.NewInt(absInt64(shift)), nil)
+	if shift < 0 {
+		return new(big.Rat).SetFrac(big.NewInt(1), p)
+	}
+	return new(big.Rat).SetInt(p)
+}
+
+func absInt64(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
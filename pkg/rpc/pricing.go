@@ -0,0 +1,223 @@
+package rpc
+
+import (
+	"fmt"
+	"math/big"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// floatingPrice is the price of a floating quote worked out from the SDCE reference price
+type floatingPrice struct {
+	pricing   *repository.QuotePricing
+	reference Price
+	price     Price
+}
+
+func newFloatingPrice(pricing *repository.QuotePricing, reference Price, inst *pb.InstrumentRef) (*floatingPrice, error) {
+	premium, err := ParseRate(pricing.Premium)
+	if err != nil {
+		return nil, err
+	}
+	factor := new(big.Rat).Add(big.NewRat(1, 1), new(big.Rat).Quo(premium, big.NewRat(100, 1)))
+	price := reference.Mul(factor)
+	if pricing.Floor != "" {
+		floor, err := ParsePrice(pricing.Floor)
+		if err != nil {
+			return nil, err
+		}
+		if price.Cmp(floor) < 0 {
+			price = floor
+		}
+	}
+	if pricing.Ceiling != "" {
+		ceiling, err := ParsePrice(pricing.Ceiling)
+		if err != nil {
+			return nil, err
+		}
+		if price.Cmp(ceiling) > 0 {
+			price = ceiling
+		}
+	}
+	price = price.Round(inst.GetQuote().GetDecimal(), RoundHalfUp)
+	if price.r.Sign() <= 0 {
+		return nil, fmt.Errorf("price %s from reference %s is not positive", price, reference)
+	}
+	return &floatingPrice{pricing: pricing, reference: reference, price: price}, nil
+}
+
+func (f *floatingPrice) snapshot() *repository.OrderPricing {
+	return &repository.OrderPricing{
+		Reference: f.reference.String(),
+		Premium:   f.pricing.Premium,
+		Price:     f.price.String(),
+	}
+}
+
+// float sets the price of q and works out the side the quote does not lock from the one it
+// does: the value of ASK quotes and the volume of BID quotes. It returns the changed fields.
+func (f *floatingPrice) float(q *pb.Quote) (bson.M, error) {
+	q.Price = f.price.UnitPrice(q.Instrument)
+	if q.Side == pb.OrderSide_ASK {
+		volume, err := ParseMoney(q.Volume)
+		if err != nil {
+			return nil, err
+		}
+		q.Value = ValueAt(volume, q.Price).Round(RoundHalfUp).String()
+		return bson.M{"price": q.Price, "value": q.Value}, nil
+	}
+	value, err := ParseMoney(q.Value)
+	if err != nil {
+		return nil, err
+	}
+	q.Volume = value.Quo(decimalOf(q.Price)).Round(RoundDown).String()
+	return bson.M{"price": q.Price, "volume": q.Volume}, nil
+}
+
+// referencePrice returns the SDCE price quotes of a side float with. Buyers would otherwise
+// pay the SDCE buy price, so ASK quotes follow it, and BID quotes follow the SDCE sell price.
+func (o OtcServer) referencePrice(ctx context.Context, inst *pb.InstrumentRef, side pb.OrderSide) (Price, error) {
+	cq, err := o.quotes.SearchSDCEQuote(ctx, inst.GetCode())
+	if err != nil {
+		log.Errorf("search sdce quote %s error: %v", inst.GetCode(), err)
+		return Price{}, status.Errorf(codes.FailedPrecondition, "no reference price for %s", inst.GetCode())
+	}
+	unit := cq.GetBuyUnitPrice()
+	if side == pb.OrderSide_BID {
+		unit = cq.GetSellUnitPrice()
+	}
+	if unit == nil {
+		return Price{}, status.Errorf(codes.FailedPrecondition, "no reference price for %s", inst.GetCode())
+	}
+	price, err := ParsePrice(unit.Price)
+	if err != nil {
+		return Price{}, status.Errorf(codes.FailedPrecondition, "invalid reference price for %s: %v", inst.GetCode(), err)
+	}
+	return price, nil
+}
+
+// quoteFloatingPrice works out the current price of a floating quote
+func (o OtcServer) quoteFloatingPrice(ctx context.Context, q *pb.Quote, pricing *repository.QuotePricing) (*floatingPrice, error) {
+	reference, err := o.referencePrice(ctx, q.Instrument, q.Side)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := newFloatingPrice(pricing, reference, q.Instrument)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot price quote %s: %v", exutil.UUIDtoA(q.Id), err)
+	}
+	return fp, nil
+}
+
+// floatQuote reprices q in memory if it floats, returning nil for quotes with a fixed price
+func (o OtcServer) floatQuote(ctx context.Context, q *pb.Quote) (*floatingPrice, error) {
+	pricing, err := o.quotes.GetQuotePricing(ctx, q.Id)
+	if err != nil || pricing == nil {
+		return nil, err
+	}
+	fp, err := o.quoteFloatingPrice(ctx, q, pricing)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fp.float(q)
+	return fp, err
+}
+
+// floatQuotes reprices the floating quotes among quotes in memory. A quote without a
+// reference price keeps its last price.
+func (o OtcServer) floatQuotes(ctx context.Context, quotes []*pb.Quote) error {
+	ids := make([]*pb.UUID, len(quotes))
+	for i, q := range quotes {
+		ids[i] = q.Id
+	}
+	pricings, err := o.quotes.GetQuotePricings(ctx, ids)
+	if err != nil {
+		log.Errorf("get quote pricings error: %v", err)
+		return status.Errorf(codes.Internal, "Fail to price quotes")
+	}
+	references := map[string]Price{}
+	for _, q := range quotes {
+		pricing, ok := pricings[exutil.UUIDtoA(q.Id)]
+		if !ok {
+			continue
+		}
+		key := q.Instrument.GetCode() + "/" + q.Side.String()
+		reference, ok := references[key]
+		if !ok {
+			if reference, err = o.referencePrice(ctx, q.Instrument, q.Side); err != nil {
+				log.Warnf("quote %s listed at its last price: %v", exutil.UUIDtoA(q.Id), err)
+				continue
+			}
+			references[key] = reference
+		}
+		fp, err := newFloatingPrice(pricing, reference, q.Instrument)
+		if err != nil {
+			log.Warnf("quote %s listed at its last price: %v", exutil.UUIDtoA(q.Id), err)
+			continue
+		}
+		if _, err := fp.float(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refloatQuote reprices q if it floats and stores the price, so orders are placed and the
+// quote updated against it. It returns the quote as stored.
+func (o OtcServer) refloatQuote(ctx context.Context, q *pb.Quote) (*pb.Quote, *floatingPrice, error) {
+	quoteId := q.Id
+	for i := 0; i < maxQuoteUpdateRetries; i++ {
+		pricing, err := o.quotes.GetQuotePricing(ctx, quoteId)
+		if err != nil || pricing == nil {
+			return q, nil, err
+		}
+		fp, err := o.quoteFloatingPrice(ctx, q, pricing)
+		if err != nil {
+			return q, nil, err
+		}
+		expected := bson.M{"value": q.Value, "volume": q.Volume, "processingVolume": q.ProcessingVolume, "lockedFee": q.LockedFee}
+		fields, err := fp.float(q)
+		if err != nil {
+			return q, nil, err
+		}
+		err = o.quotes.CompareAndUpdateQuote(ctx, q.Id, expected, fields)
+		if err != repository.ErrQuoteModified {
+			return q, fp, err
+		}
+		log.Infof("quote %s modified concurrently on repricing, retrying", exutil.UUIDtoA(quoteId))
+		q, err = o.quotes.GetQuote(ctx, quoteId)
+		if err != nil {
+			return nil, nil, status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(quoteId))
+		}
+	}
+	return nil, nil, status.Errorf(codes.Aborted, "quote %s is busy, please try again", exutil.UUIDtoA(quoteId))
+}
+
+func validateQuotePricing(pricing *repository.QuotePricing) error {
+	if _, err := ParseRate(pricing.Premium); err != nil {
+		return fmt.Errorf("invalid premium %q", pricing.Premium)
+	}
+	var floor, ceiling Price
+	var err error
+	if pricing.Floor != "" {
+		if floor, err = ParsePrice(pricing.Floor); err != nil {
+			return err
+		}
+	}
+	if pricing.Ceiling != "" {
+		if ceiling, err = ParsePrice(pricing.Ceiling); err != nil {
+			return err
+		}
+	}
+	if pricing.Floor != "" && pricing.Ceiling != "" && floor.Cmp(ceiling) > 0 {
+		return fmt.Errorf("floor %s is above ceiling %s", pricing.Floor, pricing.Ceiling)
+	}
+	return nil
+}
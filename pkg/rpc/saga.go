@@ -0,0 +1,53 @@
+package rpc
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	pb "gitlab.com/sdce/protogo"
+	"golang.org/x/net/context"
+)
+
+const (
+	compensationTimeout = 30 * time.Second
+)
+
+type compensation struct {
+	name string
+	undo func(ctx context.Context) error
+}
+
+// saga records an undo action for every completed step of a multi-step order flow,
+// so that a failure in a later step can roll back the earlier ones.
+type saga struct {
+	eventId *pb.UUID
+	steps   []compensation
+}
+
+func newSaga(eventId *pb.UUID) *saga {
+	return &saga{eventId: eventId}
+}
+
+// onFailure registers the undo action of a step which has just succeeded
+func (s *saga) onFailure(name string, undo func(ctx context.Context) error) {
+	s.steps = append(s.steps, compensation{name: name, undo: undo})
+}
+
+// compensate runs the registered undo actions in reverse order. A failed undo is
+// logged and does not stop the remaining ones from running. The undo actions do not
+// share the request context, which may already be cancelled when a step fails.
+func (s *saga) compensate() {
+	ctx, cancel := context.WithTimeout(context.Background(), compensationTimeout)
+	defer cancel()
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		step := s.steps[i]
+		log.Warnf("compensating step %s for event: %s", step.name, exutil.UUIDtoA(s.eventId))
+		if err := step.undo(ctx); err != nil {
+			log.Errorf("compensation of step %s failed for event: %s, err: %v", step.name, exutil.UUIDtoA(s.eventId), err)
+			continue
+		}
+		log.Infof("compensated step %s for event: %s", step.name, exutil.UUIDtoA(s.eventId))
+	}
+	s.steps = nil
+}
@@ -1,7 +1,14 @@
 package rpc
 
 import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
 	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
 	"gitlab.com/sdce/service/otc/pkg/api"
 	"gitlab.com/sdce/service/otc/pkg/repository"
 )
@@ -9,8 +16,69 @@ import (
 const (
 	// TopicsNewOrderPrefix is the prefix of Kafka "new-order" topics.
 	TopicsNewOrderPrefix = "new-otc-"
+
+	defaultReleaseTimeout = 24 * time.Hour
 )
 
+// defaultPriceTolerance is how far an order price may be from its quote price unless
+// configured for the instrument, in whole quote currency
+var defaultPriceTolerance = big.NewRat(1, 100)
+
+// Config holds the trading settings in the "otc" section of the service config
+type Config struct {
+	// ReleaseTimeout is how long the seller has to release coin once an order is paid
+	ReleaseTimeout time.Duration
+	// PriceTolerance is how far an order price may be from its quote price, in whole quote
+	// currency, by lower case instrument code. Zero only accepts the exact quote price.
+	PriceTolerance map[string]*big.Rat
+	// RebateShare is the share of the fees a member pays credited to their referrer, unless
+	// set on the referral
+	RebateShare *big.Rat
+	// RebateCaps is the most a single fee earns in rebate, in smallest units by lower case
+	// currency symbol
+	RebateCaps map[string]*big.Int
+}
+
+// GetConfig reads the trading settings, using defaults for the ones not set
+func GetConfig(v *viper.Viper) (Config, error) {
+	v.SetDefault("otc.releaseTimeout", defaultReleaseTimeout)
+	conf := Config{
+		ReleaseTimeout: v.GetDuration("otc.releaseTimeout"),
+		PriceTolerance: map[string]*big.Rat{},
+		RebateShare:    new(big.Rat),
+		RebateCaps:     map[string]*big.Int{},
+	}
+	for code, s := range v.GetStringMapString("otc.priceTolerance") {
+		t, err := ParseRate(s)
+		if err != nil || t.Sign() < 0 {
+			return conf, fmt.Errorf("invalid price tolerance %q for %s", s, code)
+		}
+		conf.PriceTolerance[code] = t
+	}
+	if s := v.GetString("otc.rebate.share"); s != "" {
+		share, err := parseRebateShare(s)
+		if err != nil {
+			return conf, err
+		}
+		conf.RebateShare = share
+	}
+	for symbol, s := range v.GetStringMapString("otc.rebate.caps") {
+		c, ok := new(big.Int).SetString(s, 10)
+		if !ok || c.Sign() < 0 {
+			return conf, fmt.Errorf("invalid rebate cap %q for %s", s, symbol)
+		}
+		conf.RebateCaps[symbol] = c
+	}
+	return conf, nil
+}
+
+func (c Config) priceTolerance(inst *pb.InstrumentRef) *big.Rat {
+	if t, ok := c.PriceTolerance[strings.ToLower(inst.GetCode())]; ok {
+		return t
+	}
+	return defaultPriceTolerance
+}
+
 // OtcServer instance
 type OtcServer struct {
 	quotes          repository.QuoteRepository
@@ -18,8 +86,17 @@ type OtcServer struct {
 	currencyorders  repository.CurrencyOrderRepository
 	merchants       repository.MerchantRepository
 	merchantMargins repository.MerchantMarginRepository
+	tx              repository.Transactor
+	idempotency     repository.IdempotencyRepository
+	feeSchedules    repository.FeeScheduleRepository
+	feeLedger       repository.FeeLedgerRepository
+	referrals       repository.ReferralRepository
+	rebates         repository.RebateLedgerRepository
+	standings       repository.MemberStandingRepository
+	payments        repository.PaymentDetailsRepository
 
 	apis api.Api
+	conf Config
 }
 
 const (
@@ -36,5 +113,22 @@ func NewOtcTradingServer(api api.Api, db *exmongo.Database) *OtcServer {
 		currencyorders:  repository.NewCurrencyOrderRepo(db),
 		merchants:       repository.NewMerchantRepo(db),
 		merchantMargins: repository.NewMerchantMarginRepo(db),
+		tx:              repository.NewTransactor(db),
+		idempotency:     repository.NewIdempotencyRepo(db),
+		feeSchedules:    repository.NewFeeScheduleRepo(db),
+		feeLedger:       repository.NewFeeLedgerRepo(db),
+		referrals:       repository.NewReferralRepo(db),
+		rebates:         repository.NewRebateLedgerRepo(db),
+		standings:       repository.NewMemberStandingRepo(db),
+		payments:        repository.NewPaymentDetailsRepo(db),
+		conf: Config{
+			ReleaseTimeout: defaultReleaseTimeout,
+			RebateShare:    new(big.Rat),
+		},
 	}
 }
+
+// SetConfig replaces the default trading settings
+func (o *OtcServer) SetConfig(conf Config) {
+	o.conf = conf
+}
@@ -0,0 +1,187 @@
+package rpc
+
+import (
+	"math/big"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type AmendOrderRequest struct {
+	OrderId *pb.UUID
+	// Volume and Value are the reduced order amounts
+	Volume string
+	Value  string
+}
+
+type AmendOrderResponse struct {
+	Message string
+	// Applied is false while the amendment waits for the counterparty
+	Applied bool
+}
+
+// DoAmendOrder reduces the volume of an unpaid order. Either side proposes the new volume and
+// value, and the order changes once the other side sends the same amounts.
+func (o OtcServer) DoAmendOrder(ctx context.Context, in *AmendOrderRequest) (out *AmendOrderResponse, err error) {
+	actor, err := actorFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := o.trades.GetOtcOrder(ctx, in.OrderId)
+	if err != nil {
+		log.Errorf("cannot find order: %s", exutil.UUIDtoA(in.OrderId))
+		return nil, status.Errorf(codes.NotFound, "cannot find order: %s", exutil.UUIDtoA(in.OrderId))
+	}
+	if order.Status != pb.OtcOrder_UNPAID {
+		return nil, status.Errorf(codes.FailedPrecondition, "only unpaid orders can be amended")
+	}
+	isParty := false
+	for _, r := range actor.rolesIn(order) {
+		if r == orderstate.RoleBuyer || r == orderstate.RoleSeller {
+			isParty = true
+		}
+	}
+	if !isParty {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is not a party of order %s", actor.String(), exutil.UUIDtoA(order.Id))
+	}
+
+	volume, ok := new(big.Int).SetString(in.Volume, 10)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume detected")
+	}
+	value, ok := new(big.Int).SetString(in.Value, 10)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid value detected")
+	}
+	orderVolume, _ := new(big.Int).SetString(order.Volume, 10)
+	orderValue, _ := new(big.Int).SetString(order.Value, 10)
+	if volume.Sign() <= 0 || value.Sign() <= 0 || volume.Cmp(orderVolume) >= 0 || value.Cmp(orderValue) > 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "amendment must reduce the order volume %s and value %s", order.Volume, order.Value)
+	}
+	q, err := o.quotes.GetQuote(ctx, order.QuoteId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(order.QuoteId))
+	}
+	_, err = o.validateOtcPrice(in.Value, in.Volume, q)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := o.trades.GetOtcOrderAmendment(ctx, order.Id)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil || pending.Volume != in.Volume || pending.Value != in.Value || sameUUID(pending.ProposedBy, actor.memberId) {
+		err = o.trades.ProposeOtcOrderAmendment(ctx, order.Id, &repository.OrderAmendment{
+			Volume:     in.Volume,
+			Value:      in.Value,
+			ProposedBy: actor.memberId,
+			Time:       time.Now().UnixNano(),
+		})
+		if err != nil {
+			log.Errorf("Fail to propose amendment of order %s: %v", exutil.UUIDtoA(order.Id), err)
+			return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+		}
+		return &AmendOrderResponse{Message: "amendment proposed"}, nil
+	}
+
+	err = o.amendOrder(ctx, order, pending, volume, value)
+	if err != nil {
+		log.Errorf("Fail to amend order %s: %v", exutil.UUIDtoA(order.Id), err)
+		return nil, err
+	}
+	out = &AmendOrderResponse{
+		Message: "success",
+		Applied: true,
+	}
+	return
+}
+
+// amendOrder gives the difference to the reduced volume and value back: the lock and pending
+// amount of the order are released and the quote gets its volume, value and fee back
+func (o OtcServer) amendOrder(ctx context.Context, order *pb.OtcOrder, amendment *repository.OrderAmendment, volume, value *big.Int) (err error) {
+	orderVolume, _ := new(big.Int).SetString(order.Volume, 10)
+	orderValue, _ := new(big.Int).SetString(order.Value, 10)
+	orderFee, err := o.loadOrderFee(ctx, order)
+	if err != nil {
+		return status.Errorf(codes.Internal, "%v", err)
+	}
+	fee := orderFee.scale(new(big.Rat).SetFrac(volume, orderVolume))
+	delta := orderFee.sub(fee)
+	volumeDelta := new(big.Int).Sub(orderVolume, volume).String()
+	valueDelta := new(big.Int).Sub(orderValue, value).String()
+	feeDelta := delta.onQuote(order).String()
+
+	eventId := exutil.NewUUID()
+	sg := newSaga(eventId)
+	defer func() {
+		if err != nil {
+			sg.compensate()
+		}
+	}()
+	//release the locked difference
+	if _, ok := externalCurrency[order.Instrument.Quote.Symbol]; !(ok && order.Side == pb.OrderSide_BID) {
+		coinId, locked := order.GetInstrument().GetQuote().GetId(), new(big.Int).Sub(orderValue, value)
+		if order.Side == pb.OrderSide_ASK {
+			coinId, locked = order.GetInstrument().GetBase().GetId(), new(big.Int).Sub(orderVolume, volume)
+		}
+		amount := locked.Add(locked, delta.onOrder(order))
+		err = o.releaseOrderLock(ctx, order, coinId, amount.String(), eventId)
+		if err != nil {
+			return
+		}
+		sg.onFailure("release lock", func(ctx context.Context) error {
+			return o.lockOrderBalance(ctx, order, coinId, amount, eventId)
+		})
+	}
+	//release the pending difference
+	account, err := o.findPendingAccount(ctx, order)
+	if err != nil {
+		return
+	}
+	err = o.releasePending(ctx, account.GetId(), eventId, volumeDelta)
+	if err != nil {
+		log.Errorf("Release pending error: %v", err)
+		return
+	}
+	sg.onFailure("release pending", func(ctx context.Context) error {
+		return o.addPending(ctx, account.GetId(), eventId, volumeDelta)
+	})
+
+	//update quote volume and value, order
+	return o.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		err := o.trades.RemoveOtcOrderAmendment(ctx, order.Id, amendment)
+		if err != nil {
+			return status.Errorf(codes.Aborted, "%v", err)
+		}
+		err = o.restoreQuote(ctx, order.QuoteId, volumeDelta, valueDelta, feeDelta)
+		if err != nil {
+			return err
+		}
+		if !repository.InTransaction(ctx) {
+			sg.onFailure("update quote", func(ctx context.Context) error {
+				q, err := o.quotes.GetQuote(ctx, order.QuoteId)
+				if err != nil {
+					return err
+				}
+				return o.updateQuoteVolumeValueandFee(ctx, volumeDelta, valueDelta, feeDelta, q, "CREATE")
+			})
+		}
+		// the order may have been paid or cancelled since it was read
+		err = o.trades.AmendOtcOrder(ctx, order.Id, pb.OtcOrder_UNPAID, volume.String(), value.String(), fee.total().String())
+		if err == repository.ErrOrderStatusChanged {
+			return status.Errorf(codes.Aborted, "order %s has been updated concurrently", exutil.UUIDtoA(order.Id))
+		}
+		if err != nil {
+			return err
+		}
+		return o.trades.SetOtcOrderFees(ctx, order.Id, fee.fees(order))
+	})
+}
@@ -0,0 +1,240 @@
+package rpc
+
+import (
+	"math/big"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AppealOutcome is the decision of an arbitrator on an appealed order
+type AppealOutcome int
+
+const (
+	// AppealReleaseToBuyer completes the trade: the buyer gets the coin and the seller the value
+	AppealReleaseToBuyer AppealOutcome = iota + 1
+	// AppealRefundSeller unwinds the trade: the coin goes back to the seller and the value to the buyer
+	AppealRefundSeller
+	// AppealSplit releases part of the coin to the buyer, who pays for that part only
+	AppealSplit
+)
+
+type ResolveAppealRequest struct {
+	OrderId *pb.UUID
+	Outcome AppealOutcome
+	// BuyerVolume is the coin volume released to the buyer on AppealSplit
+	BuyerVolume string
+	Reason      string
+}
+
+type ResolveAppealResponse struct {
+	Message string
+	Status  pb.OtcOrder_OrderStatus
+}
+
+// DoResolveAppeal settles an appealed order as decided by the admin acting on the request,
+// who is recorded as its arbitrator. A refund cancels the order, any other outcome resolves it.
+func (o OtcServer) DoResolveAppeal(ctx context.Context, in *ResolveAppealRequest) (out *ResolveAppealResponse, err error) {
+	arbitrator, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if arbitrator.memberId == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "arbitrator is required")
+	}
+	if in.Reason == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "reason is required")
+	}
+	order, err := o.trades.GetOtcOrder(ctx, in.OrderId)
+	if err != nil {
+		log.Errorf("cannot find order: %s", exutil.UUIDtoA(in.OrderId))
+		return nil, status.Errorf(codes.NotFound, "cannot find order: %s", exutil.UUIDtoA(in.OrderId))
+	}
+	volume, ok := new(big.Int).SetString(order.Volume, 10)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "can not transfer order volume to int %s", order.Volume)
+	}
+
+	var buyerVolume *big.Int
+	to := pb.OtcOrder_RESOLVED
+	switch in.Outcome {
+	case AppealReleaseToBuyer:
+		buyerVolume = volume
+	case AppealRefundSeller:
+		buyerVolume = big.NewInt(0)
+		to = pb.OtcOrder_CANCELLED
+	case AppealSplit:
+		buyerVolume, ok = new(big.Int).SetString(in.BuyerVolume, 10)
+		if !ok || buyerVolume.Sign() <= 0 || buyerVolume.Cmp(volume) >= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "split volume %s must be between 0 and the order volume %s", in.BuyerVolume, order.Volume)
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown appeal outcome %d", in.Outcome)
+	}
+
+	t, err := orderstate.Lookup(order.Status, to)
+	if err != nil {
+		log.Error(err)
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	if _, err := arbitrator.authorize(t, order); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	appealFrom, err := o.trades.GetAppealFrom(ctx, order.Id)
+	if err != nil {
+		log.Errorf("Fail to find appeal of order %s: %v", exutil.UUIDtoA(order.Id), err)
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+
+	eventId := exutil.NewUUID()
+	sg := newSaga(eventId)
+	// once coin has been released, the order stays settled
+	released := false
+	defer func() {
+		if err != nil && !released {
+			sg.compensate()
+		}
+	}()
+	// claim the order first, so it cannot be settled twice
+	err = o.trades.UpdateOtcOrderStatus(ctx, order.Id, eventId, order.Status, to, &repository.EventActor{
+		MemberId: arbitrator.memberId,
+		Role:     orderstate.RoleAdmin,
+		Reason:   in.Reason,
+	})
+	if err != nil {
+		log.Errorf("Failed to update order status %s: %v", exutil.UUIDtoA(order.Id), err)
+		if err == repository.ErrOrderStatusChanged {
+			return nil, status.Errorf(codes.Aborted, "order %s has been updated concurrently", exutil.UUIDtoA(order.Id))
+		}
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	sg.onFailure("update status", func(ctx context.Context) error {
+		return o.trades.RevertOtcOrderStatus(ctx, order.Id, eventId, order.Status, to)
+	})
+
+	log.Infof("Settling appeal of order %s by %s, buyer volume %s of %s: %s", exutil.UUIDtoA(order.Id),
+		exutil.UUIDtoA(arbitrator.memberId), buyerVolume.String(), order.Volume, in.Reason)
+	released, err = o.settleAppeal(ctx, sg, order, appealFrom, buyerVolume, eventId)
+	if err != nil {
+		log.Errorf("Fail to settle appeal of order %s: %v", exutil.UUIDtoA(order.Id), err)
+		if released {
+			log.Errorf("Order %s moved to %s but its appeal was only partly settled", exutil.UUIDtoA(order.Id), to.String())
+		}
+		return nil, err
+	}
+	o.completePendingClose(ctx, order.QuoteId)
+	out = &ResolveAppealResponse{
+		Message: "success",
+		Status:  to,
+	}
+	return
+}
+
+// settleAppeal gives buyerVolume of the order coin to the buyer, who pays the matching share
+// of the order value and fee. Everything else goes back to where it came from: the order
+// member's own account or the quote. The steps which can be undone are recorded on sg, the
+// coin is released last as it cannot be.
+func (o OtcServer) settleAppeal(ctx context.Context, sg *saga, order *pb.OtcOrder, appealFrom pb.OtcOrder_OrderStatus,
+	buyerVolume *big.Int, eventId *pb.UUID) (released bool, err error) {
+	volume, _ := new(big.Int).SetString(order.Volume, 10)
+	value, ok := new(big.Int).SetString(order.Value, 10)
+	if !ok {
+		return false, status.Errorf(codes.Internal, "can not transfer order value to int %s", order.Value)
+	}
+	fee, err := o.loadOrderFee(ctx, order)
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "%v", err)
+	}
+	share := new(big.Rat).SetFrac(buyerVolume, volume)
+	paidValue := MoneyFromInt(value).Mul(share).Round(RoundDown)
+	buyerFee := fee.scale(share)
+	restVolume := new(big.Int).Sub(volume, buyerVolume)
+	restValue := new(big.Int).Sub(value, paidValue)
+	restFee := fee.sub(buyerFee)
+
+	//value: the quote currency is only escrowed when it is not paid outside
+	if _, ok := externalCurrency[order.Instrument.Quote.Symbol]; !ok {
+		// the seller fee in the quote currency stays with the buyer until it is collected
+		if toSeller := new(big.Int).Sub(paidValue, buyerFee.deductedQuote()); appealFrom == pb.OtcOrder_UNPAID && toSeller.Sign() > 0 {
+			if err = o.payValue(ctx, order, toSeller.String(), eventId); err != nil {
+				return
+			}
+			sg.onFailure("pay", func(ctx context.Context) error {
+				return o.refundValue(ctx, order, toSeller.String(), eventId)
+			})
+		}
+		if toBuyer := new(big.Int).Sub(restValue, restFee.deductedQuote()); appealFrom == pb.OtcOrder_PAID && toBuyer.Sign() > 0 {
+			if err = o.refundValue(ctx, order, toBuyer.String(), eventId); err != nil {
+				return
+			}
+			sg.onFailure("refund", func(ctx context.Context) error {
+				return o.payValue(ctx, order, toBuyer.String(), eventId)
+			})
+		}
+		// a BID order member locked the value, on ASK orders it stays with the quote
+		if unlock := new(big.Int).Add(restValue, restFee.onOrder(order)); order.Side == pb.OrderSide_BID && unlock.Sign() > 0 {
+			if err = o.releaseOrderLock(ctx, order, order.Instrument.Quote.Id, unlock.String(), eventId); err != nil {
+				return
+			}
+			sg.onFailure("release value lock", func(ctx context.Context) error {
+				return o.lockOrderBalance(ctx, order, order.Instrument.Quote.Id, unlock, eventId)
+			})
+		}
+	}
+
+	// an ASK order member locked the coin, on BID orders it stays with the quote
+	if unlock := new(big.Int).Add(restVolume, restFee.onOrder(order)); order.Side == pb.OrderSide_ASK && unlock.Sign() > 0 {
+		if err = o.releaseOrderLock(ctx, order, order.Instrument.Base.Id, unlock.String(), eventId); err != nil {
+			return
+		}
+		sg.onFailure("release coin lock", func(ctx context.Context) error {
+			return o.lockOrderBalance(ctx, order, order.Instrument.Base.Id, unlock, eventId)
+		})
+	}
+	account, err := o.findPendingAccount(ctx, order)
+	if err != nil {
+		return
+	}
+	if err = o.releasePending(ctx, account.GetId(), eventId, order.Volume); err != nil {
+		log.Errorf("release pending error: %v", err)
+		return
+	}
+	sg.onFailure("release pending", func(ctx context.Context) error {
+		return o.addPending(ctx, account.GetId(), eventId, order.Volume)
+	})
+
+	//coin
+	if buyerVolume.Sign() > 0 {
+		if err = o.transferCoin(ctx, order, buyerVolume.String(), buyerFee, eventId); err != nil {
+			return
+		}
+		released = true
+	}
+
+	//update quote volume and value
+	err = o.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		if restVolume.Sign() > 0 {
+			err := o.restoreQuote(ctx, order.QuoteId, restVolume.String(), restValue.String(), restFee.onQuote(order).String())
+			if err != nil {
+				return err
+			}
+		}
+		if buyerVolume.Sign() > 0 {
+			q, err := o.quotes.GetQuote(ctx, order.QuoteId)
+			if err != nil {
+				return status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(order.QuoteId))
+			}
+			return o.updateQuoteVolumeValueandFee(ctx, buyerVolume.String(), paidValue.String(), "0", q, "COMPLETE")
+		}
+		return nil
+	})
+	return
+}
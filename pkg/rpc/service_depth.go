@@ -0,0 +1,69 @@
+package rpc
+
+import (
+	log "github.com/sirupsen/logrus"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultBookDepth = 20
+	maxBookDepth     = 200
+)
+
+type OrderBookDepthRequest struct {
+	Instrument string
+	// Side limits the depth to ASK or BID quotes, both when not set
+	Side pb.OrderSide
+	// PaymentMethod limits the depth to quotes accepting it, any when not set
+	PaymentMethod pb.PaymentMethod
+	// MaxDepth is the number of price levels per side, 20 when not set
+	MaxDepth int64
+}
+
+type OrderBookDepthResponse struct {
+	// Asks are ordered by ascending and Bids by descending price
+	Asks []*repository.DepthLevel
+	Bids []*repository.DepthLevel
+}
+
+// DoGetOrderBookDepth returns the quotes on the shelf of an instrument summed by price level.
+// Floating quotes count at the price they were last traded at.
+func (o OtcServer) DoGetOrderBookDepth(ctx context.Context, in *OrderBookDepthRequest) (out *OrderBookDepthResponse, err error) {
+	if in.Instrument == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "instrument is required")
+	}
+	depth := in.MaxDepth
+	if depth == 0 {
+		depth = defaultBookDepth
+	}
+	if depth < 0 || depth > maxBookDepth {
+		return nil, status.Errorf(codes.InvalidArgument, "depth must be between 1 and %d", maxBookDepth)
+	}
+	out = &OrderBookDepthResponse{}
+	for _, side := range []pb.OrderSide{pb.OrderSide_ASK, pb.OrderSide_BID} {
+		if in.Side != pb.OrderSide_ORDER_SIDE_INVALID && in.Side != side {
+			continue
+		}
+		levels, err := o.quotes.QuoteDepth(ctx, &repository.DepthFilter{
+			Instrument:    in.Instrument,
+			Side:          side,
+			PaymentMethod: in.PaymentMethod,
+			MaxDepth:      depth,
+		})
+		if err != nil {
+			log.Errorf("quote depth of %s error: %v", in.Instrument, err)
+			return nil, exmongo.ErrorToRpcError(err)
+		}
+		if side == pb.OrderSide_ASK {
+			out.Asks = levels
+		} else {
+			out.Bids = levels
+		}
+	}
+	return
+}
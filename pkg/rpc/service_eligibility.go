@@ -0,0 +1,208 @@
+package rpc
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Eligibility rules a taker can fail, the type of the violations in a rejection
+const (
+	RuleKycLevel        = "KYC_LEVEL"
+	RuleCompletedTrades = "COMPLETED_TRADES"
+	RuleAccountAge      = "ACCOUNT_AGE"
+	RuleBlocked         = "BLOCKED"
+)
+
+type SetQuoteEligibilityRequest struct {
+	QuoteId  *pb.UUID
+	MemberId *pb.UUID
+	// Eligibility of the quote, nil lets anyone take it
+	Eligibility *repository.QuoteEligibility
+}
+
+type SetQuoteEligibilityResponse struct {
+	Message string
+}
+
+type SetMemberStandingRequest struct {
+	MemberId *pb.UUID
+	KycLevel int32
+	// RegisteredAt is when the member signed up, in unix nanoseconds
+	RegisteredAt int64
+}
+
+type SetMemberStandingResponse struct {
+	Message string
+}
+
+type ListEligibleQuotesRequest struct {
+	List *pb.ListQuoteRequest
+	// TakerId leaves out the quotes the member cannot take
+	TakerId *pb.UUID
+}
+
+// DoSetQuoteEligibility sets the rules a member has to meet to take a quote
+func (o OtcServer) DoSetQuoteEligibility(ctx context.Context, in *SetQuoteEligibilityRequest) (out *SetQuoteEligibilityResponse, err error) {
+	if in.QuoteId == nil || in.MemberId == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "quote and member are required")
+	}
+	if e := in.Eligibility; e != nil && (e.MinKycLevel < 0 || e.MinCompletedTrades < 0 || e.MinAccountAgeDays < 0) {
+		return nil, status.Errorf(codes.InvalidArgument, "eligibility rules cannot be negative")
+	}
+	q, err := o.quotes.GetQuote(ctx, in.QuoteId)
+	if err != nil {
+		log.Errorf("Failed to find quote %s: %v", exutil.UUIDtoA(in.QuoteId), err)
+		return nil, status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(in.QuoteId))
+	}
+	if !sameUUID(q.Owner, in.MemberId) {
+		return nil, status.Errorf(codes.PermissionDenied, "quote %s is not owned by member %s",
+			exutil.UUIDtoA(in.QuoteId), exutil.UUIDtoA(in.MemberId))
+	}
+	if q.Status == pb.Quote_CLOSED {
+		return nil, status.Errorf(codes.FailedPrecondition, "quote %s has been closed", exutil.UUIDtoA(q.Id))
+	}
+	err = o.quotes.SetQuoteEligibility(ctx, q.Id, in.Eligibility)
+	if err != nil {
+		log.Errorf("set quote eligibility error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &SetQuoteEligibilityResponse{
+		Message: "success",
+	}
+	return
+}
+
+// DoSetMemberStanding records the KYC level and sign up time of a member, as reported by the
+// member service acting as the system, or set by an admin
+func (o OtcServer) DoSetMemberStanding(ctx context.Context, in *SetMemberStandingRequest) (out *SetMemberStandingResponse, err error) {
+	if _, err = requireRole(ctx, orderstate.RoleSystem, orderstate.RoleAdmin); err != nil {
+		return nil, err
+	}
+	if in.MemberId == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "member is required")
+	}
+	if in.KycLevel < 0 || in.RegisteredAt < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid member standing")
+	}
+	err = o.standings.SetMemberStanding(ctx, &repository.MemberStanding{
+		MemberId:     in.MemberId,
+		KycLevel:     in.KycLevel,
+		RegisteredAt: in.RegisteredAt,
+		UpdatedAt:    time.Now().UnixNano(),
+	})
+	if err != nil {
+		log.Errorf("set member standing error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &SetMemberStandingResponse{
+		Message: "success",
+	}
+	return
+}
+
+// DoListEligibleQuotes lists quotes like DoListQuote, leaving out the ones the taker cannot take
+func (o OtcServer) DoListEligibleQuotes(ctx context.Context, in *ListEligibleQuotesRequest) (out *pb.ListQuoteResponse, err error) {
+	if in.List == nil || in.TakerId == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "list request and taker are required")
+	}
+	taker, err := o.findTaker(ctx, in.TakerId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return o.listQuotes(ctx, in.List, taker)
+}
+
+// findTaker gathers what eligibility rules are checked against. A member whose standing was
+// never reported has KYC level 0 and an unknown account age, failing rules on either.
+func (o OtcServer) findTaker(ctx context.Context, memberId *pb.UUID, now time.Time) (*repository.Taker, error) {
+	if _, err := o.apis.FindMember(ctx, memberId); err != nil {
+		log.Errorf("find member %s error: %v", exutil.UUIDtoA(memberId), err)
+		return nil, status.Errorf(codes.NotFound, "failed to find member: %v", exutil.UUIDtoA(memberId))
+	}
+	standing, err := o.standings.GetMemberStanding(ctx, memberId)
+	if err != nil {
+		log.Errorf("get member standing error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	completed, err := o.trades.CountCompletedOrders(ctx, memberId)
+	if err != nil {
+		log.Errorf("count completed orders error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	taker := &repository.Taker{
+		MemberId:        memberId,
+		CompletedTrades: completed,
+	}
+	if standing != nil {
+		taker.KycLevel = standing.KycLevel
+		if standing.RegisteredAt > 0 {
+			taker.AccountAgeDays = int64(now.Sub(time.Unix(0, standing.RegisteredAt)) / (24 * time.Hour))
+		}
+	}
+	return taker, nil
+}
+
+// checkEligibility rejects a member who does not meet the eligibility rules of q, with a
+// violation for each rule failed
+func (o OtcServer) checkEligibility(ctx context.Context, q *pb.Quote, memberId *pb.UUID, now time.Time) error {
+	rules, err := o.quotes.GetQuoteEligibility(ctx, q.Id)
+	if err != nil {
+		log.Errorf("get quote eligibility error: %v", err)
+		return exmongo.ErrorToRpcError(err)
+	}
+	if rules == nil {
+		return nil
+	}
+	taker, err := o.findTaker(ctx, memberId, now)
+	if err != nil {
+		return err
+	}
+	violations := eligibilityViolations(rules, taker)
+	if len(violations) == 0 {
+		return nil
+	}
+	st, err := status.New(codes.FailedPrecondition, fmt.Sprintf("member %s cannot take quote %s",
+		exutil.UUIDtoA(memberId), exutil.UUIDtoA(q.Id))).WithDetails(&errdetails.PreconditionFailure{Violations: violations})
+	if err != nil {
+		return status.Errorf(codes.Internal, "%v", err)
+	}
+	return st.Err()
+}
+
+func eligibilityViolations(rules *repository.QuoteEligibility, taker *repository.Taker) []*errdetails.PreconditionFailure_Violation {
+	var violations []*errdetails.PreconditionFailure_Violation
+	add := func(rule, description string) {
+		violations = append(violations, &errdetails.PreconditionFailure_Violation{
+			Type:        rule,
+			Subject:     exutil.UUIDtoA(taker.MemberId),
+			Description: description,
+		})
+	}
+	for _, id := range rules.Blocked {
+		if sameUUID(id, taker.MemberId) {
+			add(RuleBlocked, "the quote owner does not trade with this member")
+			break
+		}
+	}
+	if taker.KycLevel < rules.MinKycLevel {
+		add(RuleKycLevel, fmt.Sprintf("KYC level %d is required, the member has %d", rules.MinKycLevel, taker.KycLevel))
+	}
+	if taker.CompletedTrades < rules.MinCompletedTrades {
+		add(RuleCompletedTrades, fmt.Sprintf("%d completed trades are required, the member has %d", rules.MinCompletedTrades, taker.CompletedTrades))
+	}
+	if taker.AccountAgeDays < rules.MinAccountAgeDays {
+		add(RuleAccountAge, fmt.Sprintf("an account of %d days is required, the member's is %d days old", rules.MinAccountAgeDays, taker.AccountAgeDays))
+	}
+	return violations
+}
@@ -0,0 +1,63 @@
+package rpc
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type SetQuoteExpiryRequest struct {
+	QuoteId  *pb.UUID
+	MemberId *pb.UUID
+	// ExpiresAt is when the quote stops being listed in unix nanoseconds, 0 lists it until it
+	// is closed
+	ExpiresAt int64
+}
+
+type SetQuoteExpiryResponse struct {
+	Message string
+}
+
+// DoSetQuoteExpiry sets when a quote stops being listed. The expire worker closes it then,
+// once the orders placed on it have finished.
+func (o OtcServer) DoSetQuoteExpiry(ctx context.Context, in *SetQuoteExpiryRequest) (out *SetQuoteExpiryResponse, err error) {
+	if in.ExpiresAt < 0 || (in.ExpiresAt > 0 && in.ExpiresAt <= time.Now().UnixNano()) {
+		return nil, status.Errorf(codes.InvalidArgument, "the expiry has to be in the future")
+	}
+	q, pause, err := o.getOwnedQuote(ctx, in.QuoteId, in.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	if pause != nil && pause.ClosePending {
+		return nil, status.Errorf(codes.FailedPrecondition, "quote %s is being closed", exutil.UUIDtoA(q.Id))
+	}
+	err = o.quotes.SetQuoteExpiry(ctx, q.Id, in.ExpiresAt)
+	if err != nil {
+		log.Errorf("set quote expiry error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &SetQuoteExpiryResponse{
+		Message: "success",
+	}
+	return
+}
+
+// checkListingExpiry rejects orders on a quote past its expiry, which the expire worker has
+// not closed yet
+func (o OtcServer) checkListingExpiry(ctx context.Context, q *pb.Quote, now time.Time) error {
+	expiresAt, err := o.quotes.GetQuoteExpiry(ctx, q.Id)
+	if err != nil {
+		log.Errorf("get quote expiry error: %v", err)
+		return exmongo.ErrorToRpcError(err)
+	}
+	if expiresAt != 0 && expiresAt <= now.UnixNano() {
+		return status.Errorf(codes.FailedPrecondition, "quote %s has expired", exutil.UUIDtoA(q.Id))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package rpc
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type FeeRevenueRequest struct {
+	GroupBy repository.FeeRevenueGroup
+	// From and To limit the fee time in unix nanoseconds, To excluded. Zero means no limit.
+	From       int64
+	To         int64
+	Instrument string
+	MemberId   *pb.UUID
+}
+
+type FeeRevenueResponse struct {
+	Revenue []*repository.FeeRevenue
+}
+
+// DoSumFeeRevenue sums the collected fees by day, instrument or paying member, per currency
+func (o OtcServer) DoSumFeeRevenue(ctx context.Context, in *FeeRevenueRequest) (out *FeeRevenueResponse, err error) {
+	if in.To != 0 && in.From >= in.To {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid time range")
+	}
+	filter := &repository.FeeLedgerFilter{
+		From:       in.From,
+		To:         in.To,
+		Instrument: strings.ToLower(in.Instrument),
+		Payer:      in.MemberId,
+	}
+	revenue, err := o.feeLedger.SumFees(ctx, filter, in.GroupBy)
+	if err != nil {
+		log.Errorf("sum fee revenue error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &FeeRevenueResponse{
+		Revenue: revenue,
+	}
+	return
+}
+
+// recordFee books a fee collected on an order. The fee has already left the payer account,
+// so failing to record it is logged with everything needed to book it by hand.
+func (o OtcServer) recordFee(ctx context.Context, order *pb.OtcOrder, payer *pb.UUID, coin *pb.CurrencyRef, amount string, eventId *pb.UUID) {
+	now := time.Now().UTC()
+	err := o.feeLedger.RecordFee(ctx, &repository.FeeLedgerEntry{
+		OrderId:    order.Id,
+		QuoteId:    order.QuoteId,
+		EventId:    eventId,
+		Payer:      payer,
+		CoinId:     coin.GetId(),
+		Currency:   coin.GetSymbol(),
+		Instrument: strings.ToLower(order.Instrument.GetCode()),
+		Amount:     amount,
+		Time:       now.UnixNano(),
+		Day:        now.Format(repository.FeeLedgerDayFormat),
+	})
+	if err != nil {
+		log.Errorf("Fail to record fee %s %s of order %s paid by %s, event %s: %v", amount, coin.GetSymbol(),
+			exutil.UUIDtoA(order.Id), exutil.UUIDtoA(payer), exutil.UUIDtoA(eventId), err)
+	}
+}
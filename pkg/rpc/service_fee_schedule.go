@@ -0,0 +1,234 @@
+package rpc
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// feeVolumeWindow is the period of completed volume which decides the fee tier of a member
+const feeVolumeWindow = 30 * 24 * time.Hour
+
+type CreateFeeScheduleRequest struct {
+	Schedule *repository.FeeSchedule
+}
+
+type CreateFeeScheduleResponse struct {
+	Id *pb.UUID
+}
+
+type GetFeeScheduleRequest struct {
+	Id *pb.UUID
+}
+
+type GetFeeScheduleResponse struct {
+	Schedule *repository.FeeSchedule
+}
+
+type UpdateFeeScheduleRequest struct {
+	Schedule *repository.FeeSchedule
+}
+
+type UpdateFeeScheduleResponse struct {
+	Message string
+}
+
+type DeleteFeeScheduleRequest struct {
+	Id *pb.UUID
+}
+
+type DeleteFeeScheduleResponse struct {
+	Message string
+}
+
+type SearchFeeSchedulesRequest struct {
+	Instrument string
+	Side       pb.OrderSide
+	PageIdx    int64
+	PageSize   int64
+}
+
+type SearchFeeSchedulesResponse struct {
+	Schedules   []*repository.FeeSchedule
+	ResultCount int64
+}
+
+// DoCreateFeeSchedule adds a fee schedule which takes effect at its EffectiveFrom time. Fee
+// schedules are changed by admins only.
+func (o OtcServer) DoCreateFeeSchedule(ctx context.Context, in *CreateFeeScheduleRequest) (out *CreateFeeScheduleResponse, err error) {
+	if _, err = requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err = validateFeeSchedule(in.Schedule, time.Now().UnixNano()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	id, err := o.feeSchedules.CreateFeeSchedule(ctx, in.Schedule)
+	if err != nil {
+		log.Errorf("create fee schedule error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &CreateFeeScheduleResponse{
+		Id: id,
+	}
+	return
+}
+
+func (o OtcServer) DoGetFeeSchedule(ctx context.Context, in *GetFeeScheduleRequest) (out *GetFeeScheduleResponse, err error) {
+	schedule, err := o.feeSchedules.GetFeeSchedule(ctx, in.Id)
+	if err != nil {
+		log.Errorf("Failed to get fee schedule %s: %v", exutil.UUIDtoA(in.Id), err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &GetFeeScheduleResponse{
+		Schedule: schedule,
+	}
+	return
+}
+
+// DoUpdateFeeSchedule replaces a schedule before it takes effect. Rates in effect are changed
+// by creating a new schedule.
+func (o OtcServer) DoUpdateFeeSchedule(ctx context.Context, in *UpdateFeeScheduleRequest) (out *UpdateFeeScheduleResponse, err error) {
+	if _, err = requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixNano()
+	if in.Schedule == nil || in.Schedule.Id == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "fee schedule id is required")
+	}
+	if err = validateFeeSchedule(in.Schedule, now); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	err = o.feeSchedules.UpdateFeeSchedule(ctx, in.Schedule, now)
+	if err == repository.ErrFeeScheduleInEffect {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	if err != nil {
+		log.Errorf("update fee schedule error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &UpdateFeeScheduleResponse{
+		Message: "success",
+	}
+	return
+}
+
+// DoDeleteFeeSchedule removes a schedule before it takes effect
+func (o OtcServer) DoDeleteFeeSchedule(ctx context.Context, in *DeleteFeeScheduleRequest) (out *DeleteFeeScheduleResponse, err error) {
+	if _, err = requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	err = o.feeSchedules.DeleteFeeSchedule(ctx, in.Id, time.Now().UnixNano())
+	if err == repository.ErrFeeScheduleInEffect {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	if err != nil {
+		log.Errorf("delete fee schedule error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &DeleteFeeScheduleResponse{
+		Message: "success",
+	}
+	return
+}
+
+func (o OtcServer) DoSearchFeeSchedules(ctx context.Context, in *SearchFeeSchedulesRequest) (out *SearchFeeSchedulesResponse, err error) {
+	filter := &repository.FeeScheduleFilter{
+		Instrument: strings.ToLower(in.Instrument),
+		Side:       in.Side,
+		PageIdx:    in.PageIdx,
+		PageSize:   in.PageSize,
+	}
+	schedules, count, err := o.feeSchedules.SearchFeeSchedules(ctx, filter)
+	if err != nil {
+		log.Errorf("search fee schedules error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &SearchFeeSchedulesResponse{
+		Schedules:   schedules,
+		ResultCount: count,
+	}
+	return
+}
+
+// validateFeeSchedule checks a schedule taking effect after now and sorts its tiers
+func validateFeeSchedule(s *repository.FeeSchedule, now int64) error {
+	if s == nil || s.Instrument == "" {
+		return fmt.Errorf("fee schedule instrument is required")
+	}
+	s.Instrument = strings.ToLower(s.Instrument)
+	if s.EffectiveFrom <= now {
+		return fmt.Errorf("fee schedule must take effect in the future")
+	}
+	if s.Policy == (repository.FeePolicy{}) {
+		s.Policy = repository.DefaultFeePolicy
+	}
+	if err := validateFeePolicy(s.Policy); err != nil {
+		return err
+	}
+	if len(s.Tiers) == 0 {
+		return fmt.Errorf("fee schedule needs at least one tier")
+	}
+	minVolumes := make(map[*repository.FeeTier]*big.Int, len(s.Tiers))
+	for _, tier := range s.Tiers {
+		v, ok := new(big.Int).SetString(tier.MinVolume, 10)
+		if !ok || v.Sign() < 0 {
+			return fmt.Errorf("invalid tier volume %q", tier.MinVolume)
+		}
+		minVolumes[tier] = v
+		if _, err := parseFeeRate(tier.Rate); err != nil {
+			return err
+		}
+	}
+	sort.Slice(s.Tiers, func(i, j int) bool {
+		return minVolumes[s.Tiers[i]].Cmp(minVolumes[s.Tiers[j]]) < 0
+	})
+	if minVolumes[s.Tiers[0]].Sign() != 0 {
+		return fmt.Errorf("the first fee tier must start at volume 0")
+	}
+	for i := 1; i < len(s.Tiers); i++ {
+		if minVolumes[s.Tiers[i]].Cmp(minVolumes[s.Tiers[i-1]]) == 0 {
+			return fmt.Errorf("duplicate tier volume %s", s.Tiers[i].MinVolume)
+		}
+	}
+	return nil
+}
+
+// tierRate returns the rate of the highest tier volume reaches
+func tierRate(s *repository.FeeSchedule, volume *big.Int) (*big.Rat, error) {
+	rate := ""
+	for _, tier := range s.Tiers {
+		v, ok := new(big.Int).SetString(tier.MinVolume, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid tier volume %q", tier.MinVolume)
+		}
+		if v.Cmp(volume) <= 0 {
+			rate = tier.Rate
+		}
+	}
+	if rate == "" {
+		return nil, fmt.Errorf("no fee tier for volume %s", volume.String())
+	}
+	return parseFeeRate(rate)
+}
+
+func parseFeeRate(s string) (*big.Rat, error) {
+	rate, err := ParseRate(s)
+	if err != nil {
+		return nil, err
+	}
+	if rate.Sign() < 0 || rate.Cmp(big.NewRat(1, 1)) >= 0 {
+		return nil, fmt.Errorf("fee rate %s must be at least 0 and below 1", s)
+	}
+	return rate, nil
+}
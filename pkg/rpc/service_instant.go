@@ -0,0 +1,235 @@
+package rpc
+
+import (
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type InstantTradeRequest struct {
+	MemberId   *pb.UUID
+	Instrument string
+	// Side of the member, BID buys from ASK quotes and ASK sells to BID quotes
+	Side pb.OrderSide
+	// Volume or Value to trade, the other one is left empty
+	Volume string
+	Value  string
+	// Method the orders are paid by, only quotes accepting it are traded on. Not set, each
+	// order is paid by the only method its quote accepts.
+	Method pb.PaymentMethod
+}
+
+type InstantTradeResponse struct {
+	OrderIds []*pb.UUID
+	Volume   string
+	Value    string
+	// Price is the blended price of the orders as stored on orders, AveragePrice the same
+	// in whole quote currency per whole base
+	Price        float64
+	AveragePrice string
+}
+
+// InstantLeg is the order of an instant trade on one quote
+type InstantLeg struct {
+	Quote         *pb.Quote
+	Volume, Value *big.Int
+}
+
+// DoInstantTrade buys or sells a volume or value of an instrument across the quotes on the
+// shelf, best price first, placing one order per quote the way DoBuyQuote and DoSellQuote
+// do. Either all orders are placed or none: when an order fails the ones placed are canceled,
+// and the error lists those which could not be.
+func (o OtcServer) DoInstantTrade(ctx context.Context, in *InstantTradeRequest) (out *InstantTradeResponse, err error) {
+	if in.MemberId == nil || in.Instrument == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "member and instrument are required")
+	}
+	if (in.Volume == "") == (in.Value == "") {
+		return nil, status.Errorf(codes.InvalidArgument, "either volume or value is required")
+	}
+	quoteSide := pb.OrderSide_ASK
+	switch in.Side {
+	case pb.OrderSide_BID:
+	case pb.OrderSide_ASK:
+		quoteSide = pb.OrderSide_BID
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid side")
+	}
+	byVolume := in.Volume != ""
+	amount, err := ParseMoney(in.Volume + in.Value)
+	if err != nil || amount.Sign() <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid amount %s", in.Volume+in.Value)
+	}
+
+	// quotes the member cannot take are routed around
+	taker, err := o.findTaker(ctx, in.MemberId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// every quote on the shelf is a candidate, as floating quotes are only ranked once priced
+	quotes, _, err := o.quotes.SearchQuotes(ctx, &repository.QuoteFilter{
+		Status:        pb.Quote_ON,
+		Side:          quoteSide,
+		Instrument:    in.Instrument,
+		Taker:         taker,
+		PaymentMethod: in.Method,
+	})
+	if err != nil {
+		log.Errorf("Search quotes: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	// floating quotes may have moved since they were stored, so they are priced before the
+	// quotes are ranked
+	err = o.floatQuotes(ctx, quotes)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(quotes, func(i, j int) bool {
+		if quoteSide == pb.OrderSide_ASK {
+			return quotes[i].Price < quotes[j].Price
+		}
+		return quotes[i].Price > quotes[j].Price
+	})
+	legs, err := PlanInstantTrade(quotes, in.MemberId, amount.Round(RoundDown), byVolume)
+	if err != nil {
+		return nil, err
+	}
+
+	out = &InstantTradeResponse{}
+	volume, value := new(big.Int), new(big.Int)
+	for _, leg := range legs {
+		var id *pb.UUID
+		if in.Side == pb.OrderSide_BID {
+			var res *pb.BuyQuoteResponse
+			res, err = o.buyQuote(ctx, &pb.BuyQuoteRequest{
+				QuoteId:  leg.Quote.Id,
+				MemberId: in.MemberId,
+				Method:   in.Method,
+				Volume:   leg.Volume.String(),
+				Value:    leg.Value.String(),
+			})
+			id = res.GetOrderId()
+		} else {
+			var methods []pb.PaymentMethod
+			if in.Method != pb.PaymentMethod_INVALID_METHOD {
+				methods = []pb.PaymentMethod{in.Method}
+			}
+			var res *pb.SellQuoteResponse
+			res, err = o.sellQuote(ctx, &pb.SellQuoteRequest{
+				QuoteId:         leg.Quote.Id,
+				MemberId:        in.MemberId,
+				AcceptedMethods: methods,
+				Volume:          leg.Volume.String(),
+				Value:           leg.Value.String(),
+			})
+			id = res.GetOrderId()
+		}
+		if err != nil {
+			log.Errorf("Instant trade order on quote %s failed: %v", exutil.UUIDtoA(leg.Quote.Id), err)
+			if placed := o.cancelInstantOrders(out.OrderIds); len(placed) > 0 {
+				return nil, status.Errorf(codes.Internal, "instant trade failed: %s, orders %s could not be canceled",
+					status.Convert(err).Message(), strings.Join(placed, ", "))
+			}
+			return nil, err
+		}
+		out.OrderIds = append(out.OrderIds, id)
+		volume.Add(volume, leg.Volume)
+		value.Add(value, leg.Value)
+	}
+	inst := legs[0].Quote.Instrument
+	price, err := PriceOf(MoneyFromInt(value), MoneyFromInt(volume), inst)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	out.Volume, out.Value = volume.String(), value.String()
+	out.Price, out.AveragePrice = price.UnitPrice(inst), price.String()
+	return
+}
+
+// PlanInstantTrade splits amount, a volume or a value, across quotes in the order given,
+// keeping each order within the limits and remains of its quote. Quotes of memberId are
+// skipped.
+func PlanInstantTrade(quotes []*pb.Quote, memberId *pb.UUID, amount *big.Int, byVolume bool) ([]*InstantLeg, error) {
+	var legs []*InstantLeg
+	remaining := new(big.Int).Set(amount)
+	for _, q := range quotes {
+		if remaining.Sign() == 0 {
+			break
+		}
+		if sameUUID(q.Owner, memberId) || q.Price <= 0 {
+			continue
+		}
+		qVolume, err1 := exutil.DecodeBigInt(q.Volume)
+		qValue, err2 := exutil.DecodeBigInt(q.Value)
+		minValue, err3 := exutil.DecodeBigInt(q.MinValue)
+		maxValue, err4 := exutil.DecodeBigInt(q.MaxValue)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			log.Warnf("quote %s skipped by instant trade: invalid amounts", exutil.UUIDtoA(q.Id))
+			continue
+		}
+		price := decimalOf(q.Price)
+		var volume *big.Int
+		if byVolume {
+			volume = minInt(remaining, qVolume)
+		} else {
+			volume = MoneyFromInt(minInt(remaining, qValue)).Quo(price).Round(RoundDown)
+		}
+		volume = minInt(volume, qVolume)
+		value := ValueAt(MoneyFromInt(volume), q.Price).Round(RoundHalfUp)
+		if value.Cmp(maxValue) > 0 {
+			volume = MoneyFromInt(maxValue).Quo(price).Round(RoundDown)
+			value = ValueAt(MoneyFromInt(volume), q.Price).Round(RoundHalfUp)
+		}
+		if volume.Sign() == 0 || value.Cmp(minValue) < 0 || value.Cmp(maxValue) > 0 || value.Cmp(qValue) > 0 {
+			continue
+		}
+		legs = append(legs, &InstantLeg{Quote: q, Volume: volume, Value: value})
+		if byVolume {
+			remaining.Sub(remaining, volume)
+		} else {
+			remaining.Sub(remaining, value)
+		}
+	}
+	if len(legs) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "no quotes can fill the trade")
+	}
+	// by value, what is left after rounding to whole base units does not buy another unit
+	last := legs[len(legs)-1].Quote
+	if remaining.Sign() > 0 && (byVolume || MoneyFromInt(remaining).Quo(decimalOf(last.Price)).Round(RoundDown).Sign() > 0) {
+		return nil, status.Errorf(codes.FailedPrecondition, "not enough quotes to fill the trade, %s short", remaining)
+	}
+	return legs, nil
+}
+
+// cancelInstantOrders cancels the orders already placed by an instant trade which failed,
+// returning the ids of those still placed. Like saga compensation it runs on its own context,
+// so the orders are cancelled even when the request was.
+func (o OtcServer) cancelInstantOrders(orderIds []*pb.UUID) (placed []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), compensationTimeout)
+	defer cancel()
+	for _, id := range orderIds {
+		// a member selling may not cancel their own orders, so the system undoes them
+		err := o.cancelOrder(ctx, systemActor, id)
+		if err != nil {
+			log.Errorf("Fail to cancel order %s of a failed instant trade, it has to be canceled by hand: %v", exutil.UUIDtoA(id), err)
+			placed = append(placed, exutil.UUIDtoA(id))
+		}
+	}
+	return
+}
+
+func minInt(a, b *big.Int) *big.Int {
+	if a.Cmp(b) < 0 {
+		return new(big.Int).Set(a)
+	}
+	return new(big.Int).Set(b)
+}
@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Where a kill switch left a quote or order
+const (
+	KillClosed       = "CLOSED"
+	KillClosePending = "CLOSE_PENDING"
+	KillCancelled    = "CANCELLED"
+	KillFailed       = "FAILED"
+)
+
+type KillSwitchRequest struct {
+	MemberId *pb.UUID
+}
+
+type AdminKillSwitchRequest struct {
+	MemberId *pb.UUID
+	Reason   string
+}
+
+// KillSwitchItem is what a kill switch did to one quote or order
+type KillSwitchItem struct {
+	// QuoteId or OrderId is set
+	QuoteId *pb.UUID
+	OrderId *pb.UUID
+	// Status is KillClosed or KillClosePending for quotes, KillCancelled for orders and
+	// KillFailed for either
+	Status string
+	// Error is why the item failed
+	Error string
+}
+
+type KillSwitchResponse struct {
+	Items []*KillSwitchItem
+	// Failed is the number of failed items, running the kill switch again retries them
+	Failed int32
+}
+
+// DoKillSwitch pulls every quote of a member off the shelf and cancels their unpaid orders,
+// for when they cannot trade any more
+func (o OtcServer) DoKillSwitch(ctx context.Context, in *KillSwitchRequest) (out *KillSwitchResponse, err error) {
+	if in.MemberId == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "member is required")
+	}
+	return o.killSwitch(ctx, in.MemberId, nil)
+}
+
+// DoAdminKillSwitch is DoKillSwitch made by the admin acting on the request, who is recorded
+// on the quotes closed and the orders cancelled
+func (o OtcServer) DoAdminKillSwitch(ctx context.Context, in *AdminKillSwitchRequest) (out *KillSwitchResponse, err error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if in.MemberId == nil || admin.memberId == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "member and admin are required")
+	}
+	if in.Reason == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "a reason is required")
+	}
+	log.Warnf("Kill switch of member %s pulled by admin %s: %s", exutil.UUIDtoA(in.MemberId), exutil.UUIDtoA(admin.memberId), in.Reason)
+	return o.killSwitch(ctx, in.MemberId, &repository.EventActor{
+		MemberId: admin.memberId,
+		Role:     orderstate.RoleAdmin,
+		Reason:   in.Reason,
+	})
+}
+
+// killSwitch closes the quotes first, so no order is placed on them meanwhile, then cancels
+// the unpaid orders, which completes the closes pending on them. Quotes and orders dealt with
+// by an earlier run are left as they are.
+func (o OtcServer) killSwitch(ctx context.Context, memberId *pb.UUID, actor *repository.EventActor) (*KillSwitchResponse, error) {
+	out := &KillSwitchResponse{}
+	fail := func(item *KillSwitchItem, err error) {
+		item.Status = KillFailed
+		item.Error = status.Convert(err).Message()
+		out.Failed++
+	}
+
+	var pending []*KillSwitchItem
+	for _, st := range []pb.Quote_QuoteStatus{pb.Quote_ON, pb.Quote_OFF} {
+		quotes, _, err := o.quotes.SearchQuotes(ctx, &repository.QuoteFilter{MemberId: memberId, Status: st})
+		if err != nil {
+			log.Errorf("search quotes of %s error: %v", exutil.UUIDtoA(memberId), err)
+			return nil, exmongo.ErrorToRpcError(err)
+		}
+		for _, q := range quotes {
+			item := &KillSwitchItem{QuoteId: q.Id, Status: KillClosed}
+			out.Items = append(out.Items, item)
+			isPending, err := o.deleteQuote(ctx, q, actor)
+			if err != nil {
+				log.Errorf("Kill switch failed to close quote %s: %v", exutil.UUIDtoA(q.Id), err)
+				fail(item, err)
+				continue
+			}
+			if isPending {
+				item.Status = KillClosePending
+				pending = append(pending, item)
+			}
+		}
+	}
+
+	// the orders may be on either side of the member, so they are cancelled by an admin or
+	// the system rather than by their buyer
+	canceller := systemActor
+	if actor != nil {
+		canceller = &orderActor{memberId: actor.MemberId, role: actor.Role, reason: actor.Reason}
+	}
+	orders, _, err := o.trades.SearchOtcOrders(ctx, &repository.OrderFilter{
+		MemberId: memberId,
+		Status:   []pb.OtcOrder_OrderStatus{pb.OtcOrder_UNPAID},
+	})
+	if err != nil {
+		log.Errorf("search unpaid orders of %s error: %v", exutil.UUIDtoA(memberId), err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	for _, order := range orders {
+		item := &KillSwitchItem{OrderId: order.Id, Status: KillCancelled}
+		out.Items = append(out.Items, item)
+		err := o.cancelOrder(ctx, canceller, order.Id)
+		if err != nil {
+			log.Errorf("Kill switch failed to cancel order %s: %v", exutil.UUIDtoA(order.Id), err)
+			fail(item, err)
+		}
+	}
+
+	// quotes whose open orders were all unpaid are closed by now
+	for _, item := range pending {
+		q, err := o.quotes.GetQuote(ctx, item.QuoteId)
+		if err == nil && q.Status == pb.Quote_CLOSED {
+			item.Status = KillClosed
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,282 @@
+package rpc
+
+import (
+	"math/big"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type PauseQuoteRequest struct {
+	QuoteId  *pb.UUID
+	MemberId *pb.UUID
+	// ReleaseCollateral gives the unused part of the quote's lock back to the owner until the
+	// quote is resumed
+	ReleaseCollateral bool
+}
+
+type PauseQuoteResponse struct {
+	// Released is the amount given back to the owner
+	Released string
+}
+
+type ResumeQuoteRequest struct {
+	QuoteId  *pb.UUID
+	MemberId *pb.UUID
+}
+
+type ResumeQuoteResponse struct {
+	// Relocked is the amount locked again for the quote
+	Relocked string
+}
+
+// DoPauseQuote takes a quote off the shelf until its owner resumes it. Orders already placed
+// on it go on as usual.
+func (o OtcServer) DoPauseQuote(ctx context.Context, in *PauseQuoteRequest) (out *PauseQuoteResponse, err error) {
+	q, pause, err := o.getOwnedQuote(ctx, in.QuoteId, in.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	if pause != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "quote %s is paused already", exutil.UUIDtoA(q.Id))
+	}
+	released, err := o.pauseQuote(ctx, q, nil, in.ReleaseCollateral, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	out = &PauseQuoteResponse{
+		Released: released.String(),
+	}
+	return
+}
+
+// DoResumeQuote puts a paused quote back on the shelf, locking again what was released when
+// it was paused
+func (o OtcServer) DoResumeQuote(ctx context.Context, in *ResumeQuoteRequest) (out *ResumeQuoteResponse, err error) {
+	q, pause, err := o.getOwnedQuote(ctx, in.QuoteId, in.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	if pause == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "quote %s is not paused", exutil.UUIDtoA(q.Id))
+	}
+	if pause.ClosePending {
+		return nil, status.Errorf(codes.FailedPrecondition, "quote %s is being closed", exutil.UUIDtoA(q.Id))
+	}
+	if q.Volume == "0" {
+		return nil, status.Errorf(codes.FailedPrecondition, "quote %s has nothing left to trade", exutil.UUIDtoA(q.Id))
+	}
+	released, err := exutil.DecodeBigInt(pause.Released)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid released amount %s of quote %s", pause.Released, exutil.UUIDtoA(q.Id))
+	}
+
+	eventId := exutil.NewUUID()
+	sg := newSaga(eventId)
+	if released.Sign() > 0 && locksQuoteBalance(q) {
+		locked, err := quoteLockedAmount(q)
+		if err != nil {
+			return nil, err
+		}
+		err = o.adjustQuoteLock(ctx, sg, q, eventId, new(big.Int).Sub(locked, released), locked)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = o.quotes.ResumeQuote(ctx, q.Id, pause.Released, eventId)
+	if err != nil {
+		sg.compensate()
+		if err == repository.ErrQuoteModified {
+			return nil, status.Errorf(codes.Aborted, "quote %s is busy, please try again", exutil.UUIDtoA(q.Id))
+		}
+		log.Errorf("Failed to resume quote %s: %v", exutil.UUIDtoA(q.Id), err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &ResumeQuoteResponse{
+		Relocked: released.String(),
+	}
+	return
+}
+
+func (o OtcServer) getOwnedQuote(ctx context.Context, quoteId, memberId *pb.UUID) (*pb.Quote, *repository.QuotePause, error) {
+	if quoteId == nil || memberId == nil {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "quote and member are required")
+	}
+	q, err := o.quotes.GetQuote(ctx, quoteId)
+	if err != nil {
+		log.Errorf("Failed to find quote %s: %v", exutil.UUIDtoA(quoteId), err)
+		return nil, nil, status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(quoteId))
+	}
+	if !sameUUID(q.Owner, memberId) {
+		return nil, nil, status.Errorf(codes.PermissionDenied, "quote %s is not owned by member %s",
+			exutil.UUIDtoA(quoteId), exutil.UUIDtoA(memberId))
+	}
+	if q.Status == pb.Quote_CLOSED {
+		return nil, nil, status.Errorf(codes.FailedPrecondition, "quote %s has been closed", exutil.UUIDtoA(q.Id))
+	}
+	pause, err := o.quotes.GetQuotePause(ctx, q.Id)
+	if err != nil {
+		log.Errorf("get quote pause error: %v", err)
+		return nil, nil, exmongo.ErrorToRpcError(err)
+	}
+	return q, pause, nil
+}
+
+// pauseQuote turns q off, replacing its pause old. With release, what q still locks beyond
+// its open orders is released, and the amount released by this call returned. closedBy is
+// who closes q once closePending, nil for its owner.
+func (o OtcServer) pauseQuote(ctx context.Context, q *pb.Quote, old *repository.QuotePause, release, closePending bool, closedBy *repository.EventActor) (*big.Int, error) {
+	released := new(big.Int)
+	expected := bson.M{"status": q.Status, "value": q.Value, "volume": q.Volume, "lockedFee": q.LockedFee}
+	if old == nil {
+		expected["pause"] = bson.M{"$exists": false}
+	} else {
+		var err error
+		if released, err = exutil.DecodeBigInt(old.Released); err != nil {
+			return nil, status.Errorf(codes.Internal, "invalid released amount %s of quote %s", old.Released, exutil.UUIDtoA(q.Id))
+		}
+		expected["pause.released"] = old.Released
+	}
+	pause := &repository.QuotePause{
+		Released:     released.String(),
+		ClosePending: closePending,
+		ClosedBy:     closedBy,
+		PausedAt:     time.Now().UnixNano(),
+	}
+
+	eventId := exutil.NewUUID()
+	sg := newSaga(eventId)
+	rest := new(big.Int)
+	if release && locksQuoteBalance(q) {
+		locked, err := quoteLockedAmount(q)
+		if err != nil {
+			return nil, err
+		}
+		if rest.Sub(locked, released); rest.Sign() > 0 {
+			err = o.adjustQuoteLock(ctx, sg, q, eventId, rest, new(big.Int))
+			if err != nil {
+				return nil, err
+			}
+			pause.Released = locked.String()
+		}
+	}
+	err := o.quotes.PauseQuote(ctx, q.Id, expected, pause, eventId)
+	if err != nil {
+		sg.compensate()
+		if err == repository.ErrQuoteModified {
+			return nil, status.Errorf(codes.Aborted, "quote %s is busy, please try again", exutil.UUIDtoA(q.Id))
+		}
+		log.Errorf("Failed to pause quote %s: %v", exutil.UUIDtoA(q.Id), err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	if rest.Sign() < 0 {
+		rest.SetInt64(0)
+	}
+	return rest, nil
+}
+
+// closeQuote releases what q still locks, less what its pause released already, and closes
+// it on behalf of actor, nil for its owner. q must have no open orders.
+func (o OtcServer) closeQuote(ctx context.Context, q *pb.Quote, pause *repository.QuotePause, actor *repository.EventActor) error {
+	eventId := exutil.NewUUID()
+	sg := newSaga(eventId)
+	if locksQuoteBalance(q) {
+		locked, err := quoteLockedAmount(q)
+		if err != nil {
+			return err
+		}
+		if pause != nil {
+			released, err := exutil.DecodeBigInt(pause.Released)
+			if err != nil {
+				return status.Errorf(codes.Internal, "invalid released amount %s of quote %s", pause.Released, exutil.UUIDtoA(q.Id))
+			}
+			locked.Sub(locked, released)
+		}
+		if locked.Sign() > 0 {
+			err = o.adjustQuoteLock(ctx, sg, q, eventId, locked, new(big.Int))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	expected := bson.M{"status": q.Status, "value": q.Value, "volume": q.Volume, "processingVolume": "0", "lockedFee": q.LockedFee}
+	if actor == nil && pause != nil {
+		actor = pause.ClosedBy
+	}
+	err := o.quotes.CloseQuote(ctx, q.Id, expected, eventId, actor)
+	if err != nil {
+		sg.compensate()
+		if err == repository.ErrQuoteModified {
+			return status.Errorf(codes.Aborted, "quote %s is busy, please try again", exutil.UUIDtoA(q.Id))
+		}
+		log.Errorf("Failed to close quote %s: %v", exutil.UUIDtoA(q.Id), err)
+		return exmongo.ErrorToRpcError(err)
+	}
+	return nil
+}
+
+// completePendingClose closes the quote if its owner closed it while it had open orders and
+// the last of them has finished
+func (o OtcServer) completePendingClose(ctx context.Context, quoteId *pb.UUID) {
+	pause, err := o.quotes.GetQuotePause(ctx, quoteId)
+	if err != nil || pause == nil || !pause.ClosePending {
+		return
+	}
+	q, err := o.quotes.GetQuote(ctx, quoteId)
+	if err != nil || q.Status == pb.Quote_CLOSED || q.ProcessingVolume != "0" {
+		return
+	}
+	err = o.closeQuote(ctx, q, pause, nil)
+	if err != nil {
+		// closing the quote again retries it
+		log.Errorf("Failed to complete pending close of quote %s: %v", exutil.UUIDtoA(quoteId), err)
+		return
+	}
+	log.Infof("Pending close of quote %s completed", exutil.UUIDtoA(quoteId))
+}
+
+// locksQuoteBalance reports whether q locks its owner's balance, which buying with a currency
+// paid outside the platform does not
+func locksQuoteBalance(q *pb.Quote) bool {
+	_, ok := externalCurrency[q.Instrument.Quote.Symbol]
+	return !(ok && q.Side == pb.OrderSide_BID)
+}
+
+// quoteLockedAmount is what the remainder of q locks: its volume on ASK and its value on BID,
+// with the locked fee on top
+func quoteLockedAmount(q *pb.Quote) (*big.Int, error) {
+	amount := q.Volume
+	if q.Side == pb.OrderSide_BID {
+		amount = q.Value
+	}
+	locked, err := exutil.DecodeBigInt(amount)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid %s %s of quote %s", lockedAmountName(q.Side), amount, exutil.UUIDtoA(q.Id))
+	}
+	fee, err := exutil.DecodeBigInt(q.LockedFee)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid locked fee %s of quote %s", q.LockedFee, exutil.UUIDtoA(q.Id))
+	}
+	return locked.Add(locked, fee), nil
+}
+
+// closingActor is who closes a quote: an admin or internal job acting through the request
+// metadata, nil for the owner
+func closingActor(ctx context.Context) *repository.EventActor {
+	a, err := actorFromContext(ctx)
+	if err != nil || a.role == "" {
+		return nil
+	}
+	return &repository.EventActor{
+		MemberId: a.memberId,
+		Role:     a.role,
+	}
+}
@@ -0,0 +1,121 @@
+package rpc
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type SetPaymentDetailsRequest struct {
+	MemberId *pb.UUID
+	Method   pb.PaymentMethod
+	// Details of the method, empty removes the method
+	Details map[string]string
+}
+
+type SetPaymentDetailsResponse struct {
+	Message string
+}
+
+// DoSetPaymentDetails sets up where a member is paid by a payment method
+func (o OtcServer) DoSetPaymentDetails(ctx context.Context, in *SetPaymentDetailsRequest) (out *SetPaymentDetailsResponse, err error) {
+	if in.MemberId == nil || in.Method == pb.PaymentMethod_INVALID_METHOD {
+		return nil, status.Errorf(codes.InvalidArgument, "member and payment method are required")
+	}
+	if len(in.Details) == 0 {
+		err = o.payments.RemovePaymentDetails(ctx, in.MemberId, in.Method)
+	} else {
+		err = o.payments.SetPaymentDetails(ctx, &repository.PaymentDetails{
+			MemberId:  in.MemberId,
+			Method:    in.Method,
+			Details:   in.Details,
+			UpdatedAt: time.Now().UnixNano(),
+		})
+	}
+	if err != nil {
+		log.Errorf("set payment details of %s error: %v", exutil.UUIDtoA(in.MemberId), err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &SetPaymentDetailsResponse{
+		Message: "success",
+	}
+	return
+}
+
+// checkAcceptedPaymentMethods makes sure a new quote can be paid. The owner of an ASK quote
+// is paid, so they have to have set up one of the methods the quote accepts.
+func (o OtcServer) checkAcceptedPaymentMethods(ctx context.Context, q *pb.Quote) error {
+	if len(q.AcceptedPaymentMethods) == 0 {
+		return status.Errorf(codes.InvalidArgument, "at least one accepted payment method is required")
+	}
+	for _, m := range q.AcceptedPaymentMethods {
+		if m == pb.PaymentMethod_INVALID_METHOD {
+			return status.Errorf(codes.InvalidArgument, "invalid payment method")
+		}
+	}
+	if q.Side != pb.OrderSide_ASK {
+		return nil
+	}
+	methods, err := o.payments.ListPaymentMethods(ctx, q.Owner)
+	if err != nil {
+		log.Errorf("list payment methods error: %v", err)
+		return exmongo.ErrorToRpcError(err)
+	}
+	for _, m := range methods {
+		if acceptsMethod(q, m) {
+			return nil
+		}
+	}
+	return status.Errorf(codes.FailedPrecondition, "none of the accepted payment methods is set up by member %s", exutil.UUIDtoA(q.Owner))
+}
+
+// orderPayment picks the first of the methods chosen by the taker which q accepts, or the
+// only method q accepts when the taker chose none, with the details of the payee for it
+func (o OtcServer) orderPayment(ctx context.Context, q *pb.Quote, payee *pb.UUID, chosen []pb.PaymentMethod) (*repository.OrderPayment, error) {
+	method := pb.PaymentMethod_INVALID_METHOD
+	for _, m := range chosen {
+		if m != pb.PaymentMethod_INVALID_METHOD && acceptsMethod(q, m) {
+			method = m
+			break
+		}
+	}
+	if method == pb.PaymentMethod_INVALID_METHOD {
+		switch {
+		case len(chosen) > 0:
+			return nil, status.Errorf(codes.FailedPrecondition, "quote %s does not accept the payment method", exutil.UUIDtoA(q.Id))
+		case len(q.AcceptedPaymentMethods) == 1:
+			method = q.AcceptedPaymentMethods[0]
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "a payment method is required")
+		}
+	}
+	details, err := o.payments.GetPaymentDetails(ctx, payee, method)
+	if err != nil {
+		log.Errorf("get payment details error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	if details == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "payment method %s is not set up by member %s", method, exutil.UUIDtoA(payee))
+	}
+	return &repository.OrderPayment{
+		Method:  method,
+		Payee:   payee,
+		Details: details.Details,
+	}, nil
+}
+
+func acceptsMethod(q *pb.Quote, method pb.PaymentMethod) bool {
+	for _, m := range q.AcceptedPaymentMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
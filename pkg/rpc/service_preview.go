@@ -0,0 +1,94 @@
+package rpc
+
+import (
+	"time"
+
+	"gitlab.com/sdce/exlib/exutil"
+	pb "gitlab.com/sdce/protogo"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type PreviewOrderRequest struct {
+	QuoteId  *pb.UUID
+	MemberId *pb.UUID
+	// Volume or Value, the other one is worked out from the quote price when empty
+	Volume string
+	Value  string
+}
+
+type PreviewOrderResponse struct {
+	// Side of the order, BID when buying from an ASK quote
+	Side   pb.OrderSide
+	Price  float64
+	Volume string
+	Value  string
+	// Fee of the order, MakerFee and TakerFee added up, in the base or quote currency of the
+	// instrument as the fee policy of the quote says
+	Fee             string
+	MakerFee        string
+	TakerFee        string
+	FeeCurrency     string
+	LockCurrency    string
+	LockAmount      string
+	ReceiveCurrency string
+	ReceiveAmount   string
+	ExpiredTime     int64
+}
+
+// DoPreviewOrder returns the order DoBuyQuote or DoSellQuote would place for the same
+// quote, member and amounts, without placing it
+func (o OtcServer) DoPreviewOrder(ctx context.Context, in *PreviewOrderRequest) (out *PreviewOrderResponse, err error) {
+	q, err := o.quotes.GetQuote(ctx, in.QuoteId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(in.QuoteId))
+	}
+	if _, err := o.floatQuote(ctx, q); err != nil {
+		return nil, err
+	}
+	volume, value := in.Volume, in.Value
+	switch {
+	case volume != "" && value != "":
+	case volume != "":
+		v, err := ParseMoney(volume)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid volume detected")
+		}
+		value = ValueAt(v, q.Price).Round(RoundHalfUp).String()
+	case value != "":
+		v, err := ParseMoney(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid value detected")
+		}
+		if q.Price <= 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "quote has no price")
+		}
+		volume = v.Quo(decimalOf(q.Price)).Round(RoundDown).String()
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "volume or value is required")
+	}
+
+	po, err := o.priceOrder(ctx, q, in.MemberId, volume, value, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	out = &PreviewOrderResponse{
+		Side:            po.order.Side,
+		Price:           po.order.Price,
+		Volume:          po.order.Volume,
+		Value:           po.order.Value,
+		Fee:             po.order.Fee,
+		MakerFee:        po.fee.maker(po.order).String(),
+		TakerFee:        po.fee.taker(po.order).String(),
+		FeeCurrency:     po.fee.coin(q.Instrument).GetSymbol(),
+		LockAmount:      "0",
+		ReceiveCurrency: po.receiveCoin.GetSymbol(),
+		ReceiveAmount:   po.receiveAmount,
+		ExpiredTime:     po.order.ExpiredTime,
+	}
+	if po.lockCoin != nil {
+		out.LockCurrency, out.LockAmount = po.lockCoin.GetSymbol(), po.lockAmount
+	}
+	return
+}
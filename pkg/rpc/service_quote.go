@@ -8,6 +8,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
 	pb "gitlab.com/sdce/protogo"
 	"gitlab.com/sdce/service/otc/pkg/api"
 	"gitlab.com/sdce/service/otc/pkg/repository"
@@ -31,10 +32,6 @@ func (o OtcServer) validateQuote(ctx context.Context, q *pb.Quote) (err error) {
 
 	log.Infof("validating quote for coin %s", exutil.UUIDtoA(coin.GetId()))
 
-	// if q.Side == pb.OrderSide_ASK && len(q.AcceptedPaymentMethods) == 0 {
-	// 	err = errors.New("Accepted payment methods are needed when submitting sell quotes")
-	// }
-
 	if err != nil {
 		log.Errorln("Precondition failed, quote cannot be created: " + err.Error())
 		return
@@ -43,12 +40,62 @@ func (o OtcServer) validateQuote(ctx context.Context, q *pb.Quote) (err error) {
 }
 
 func (o OtcServer) DoCreateQuote(ctx context.Context, in *pb.CreateQuoteRequest) (*pb.CreateQuoteResponse, error) {
+	id, err := o.withIdempotency(ctx, "DoCreateQuote", in.GetQuote().GetOwner(), func() (*pb.UUID, error) {
+		out, err := o.createQuote(ctx, in, nil)
+		return out.GetId(), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CreateQuoteResponse{Id: id}, nil
+}
+
+type CreateFloatingQuoteRequest struct {
+	// Quote is created as by DoCreateQuote, its price is ignored
+	Quote   *pb.Quote
+	Pricing *repository.QuotePricing
+}
+
+// DoCreateFloatingQuote creates a quote priced at a premium or discount to the SDCE reference
+// price. The price is worked out again whenever the quote is listed or traded.
+func (o OtcServer) DoCreateFloatingQuote(ctx context.Context, in *CreateFloatingQuoteRequest) (*pb.CreateQuoteResponse, error) {
+	if in.Quote == nil || in.Pricing == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "quote and pricing are required")
+	}
+	if err := validateQuotePricing(in.Pricing); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if in.Quote.Type == pb.Quote_WHOLESALE {
+		return nil, status.Errorf(codes.InvalidArgument, "wholesale quotes have a fixed price")
+	}
+	id, err := o.withIdempotency(ctx, "DoCreateFloatingQuote", in.Quote.Owner, func() (*pb.UUID, error) {
+		q := in.Quote
+		reference, err := o.referencePrice(ctx, q.Instrument, q.Side)
+		if err != nil {
+			return nil, err
+		}
+		fp, err := newFloatingPrice(in.Pricing, reference, q.Instrument)
+		if err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+		}
+		q.Price = fp.price.UnitPrice(q.Instrument)
+		out, err := o.createQuote(ctx, &pb.CreateQuoteRequest{Quote: q}, in.Pricing)
+		return out.GetId(), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CreateQuoteResponse{Id: id}, nil
+}
+
+// createQuote creates the quote of in, floating with pricing unless it is nil
+func (o OtcServer) createQuote(ctx context.Context, in *pb.CreateQuoteRequest, pricing *repository.QuotePricing) (out *pb.CreateQuoteResponse, err error) {
 	// 1. rpc to member service to check member is valid and balance
 	// 2. if buy side, check if relevant payment details is set up
 	// 3. check transact password if used
 	// 4. for sell side, rpc to member service to check balance is sufficient; for buy side, make sure it can meet the min volume
 	// 5. call repository and write quote to db
-	err := o.validateQuote(ctx, in.GetQuote())
+	err = o.validateQuote(ctx, in.GetQuote())
 	if err != nil {
 		return nil, err
 	}
@@ -69,39 +116,53 @@ func (o OtcServer) DoCreateQuote(ctx context.Context, in *pb.CreateQuoteRequest)
 
 	} else {
 		//calculate value
-		pricef := new(big.Float).SetFloat64(q.Price)
-		volf, ok := new(big.Float).SetString(q.Volume)
-		if !ok {
-			status.Errorf(codes.InvalidArgument, "The volume of the quote is not correct")
+		vol, err := ParseMoney(q.Volume)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "The volume of the quote is not correct")
 		}
-		calcValf := exutil.MulFloat(pricef, volf)
-		//round
-		calcValf = exutil.AddFloat(calcValf, new(big.Float).SetFloat64(0.5))
-		ival, _ := calcValf.Int(new(big.Int))
-		q.Value = ival.String()
+		q.Value = ValueAt(vol, q.Price).Round(RoundHalfUp).String()
+	}
+
+	err = o.checkAcceptedPaymentMethods(ctx, q)
+	if err != nil {
+		return nil, err
 	}
 
 	//status
 	q.Status = pb.Quote_ON
 	//fee
-	rate, err := o.getOtcFeeRate(ctx, q.Owner)
+	policy, err := o.newQuoteFeePolicy(ctx, q)
 	if err != nil {
 		return nil, err
 	}
-	volFloat, err := exutil.Float(q.Volume)
+	volume, err := exutil.DecodeBigInt(q.Volume)
 	if err != nil {
 		return nil, err
 	}
+	value, err := exutil.DecodeBigInt(q.Value)
+	if err != nil {
+		return nil, err
+	}
+	// the maker fee is locked with the quote when it is paid in the locked currency
+	in.Quote.LockedFee = "0"
+	if makerLocksFee(q.Side, policy) {
+		rate, err := o.getOtcFeeRate(ctx, q.Owner, q.Instrument, q.Side)
+		if err != nil {
+			return nil, err
+		}
+		amount := volume
+		if q.Side == pb.OrderSide_BID {
+			amount = value
+		}
+		in.Quote.LockedFee = partyFee(MoneyFromInt(amount), rate, policy, q.Side == pb.OrderSide_ASK).String()
+	}
+	lockedFee, _ := new(big.Int).SetString(in.Quote.LockedFee, 10)
 	// lock neededVolume
-	var neededVolume string
+	neededVolume, neededValue := q.Volume, q.Value
 	if q.Side == pb.OrderSide_ASK {
-		totalVolume := quo(volFloat, new(big.Float).Sub(big.NewFloat(1), rate))
-		feeFloat := new(big.Float).Sub(totalVolume, volFloat)
-		in.Quote.LockedFee = feeFloat.Text('f', 0)
-		neededVolume = totalVolume.Text('f', 0)
+		neededVolume = new(big.Int).Add(volume, lockedFee).String()
 	} else {
-		neededVolume = q.Volume
-		in.Quote.LockedFee = "0"
+		neededValue = new(big.Int).Add(value, lockedFee).String()
 	}
 
 	//MemberOtcDetail
@@ -112,12 +173,13 @@ func (o OtcServer) DoCreateQuote(ctx context.Context, in *pb.CreateQuoteRequest)
 	in.Quote.OwnerOtcDetail = member.OtcDetails
 	//event
 	q.Events = []*pb.OrderEvent{&pb.OrderEvent{
+		Id:               exutil.NewUUID(),
 		Type:             pb.OrderEventType_CREATE_ORDER,
 		Price:            q.Price,
 		UpdateFromVolume: "0",
 		UpdateFromValue:  "0",
 		UpdateToVolume:   neededVolume,
-		UpdateToValue:    q.Value,
+		UpdateToValue:    neededValue,
 		Time:             time.Now().UnixNano(),
 	}}
 
@@ -130,6 +192,7 @@ func (o OtcServer) DoCreateQuote(ctx context.Context, in *pb.CreateQuoteRequest)
 	}
 
 	//Except buying coins with rmb, account balance needs to be locked
+	sg := newSaga(q.Events[0].Id)
 	if _, ok := externalCurrency[q.Instrument.Quote.Symbol]; !(ok && q.Side == pb.OrderSide_BID) {
 		events := q.GetEvents()
 		lr, err := api.MapQuoteToRequest(q, events[0])
@@ -142,28 +205,64 @@ func (o OtcServer) DoCreateQuote(ctx context.Context, in *pb.CreateQuoteRequest)
 			log.Errorf("Failed to lock account for quote: %s", exutil.UUIDtoA(q.GetId()))
 			return nil, err
 		}
+		// the lock lives in the member service and cannot join a db transaction
+		sg.onFailure("lock balance", func(ctx context.Context) error {
+			acc, err := o.findQuoteAccount(ctx, q, lr.CoinId)
+			if err != nil {
+				return err
+			}
+			return o.apis.ReleaselockedBalance(ctx, &pb.ReleaseLockedBalanceRequest{
+				From:   acc.Id,
+				To:     acc.Id,
+				Amount: new(big.Int).Sub(lr.ToAmount, lr.FromAmount).String(),
+				Order: &pb.OrderRef{
+					Id: q.Id,
+				},
+				Event: &pb.OrderEvent{
+					Id: q.Events[0].Id,
+				},
+			})
+		})
 	}
 
-	//TODO: createquote and lockbalance should be put in a transaction
-	qID, err := o.quotes.CreateQuote(ctx, in.Quote)
+	var qID *pb.UUID
+	err = o.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		qID, err = o.quotes.CreateQuote(ctx, in.Quote)
+		if err != nil {
+			return err
+		}
+		err = o.quotes.SetQuoteFeePolicy(ctx, qID, policy)
+		if err != nil || pricing == nil {
+			return err
+		}
+		return o.quotes.SetQuotePricing(ctx, qID, pricing)
+	})
 	if err != nil {
 		log.Errorf("Failed to create quote: %v", err)
+		sg.compensate()
 		return nil, err
 	}
 
-	res := &pb.CreateQuoteResponse{
+	out = &pb.CreateQuoteResponse{
 		Id: qID,
 	}
-	return res, err
+	return
 }
 
 func (o OtcServer) DoListQuote(ctx context.Context, in *pb.ListQuoteRequest) (out *pb.ListQuoteResponse, err error) {
+	return o.listQuotes(ctx, in, nil)
+}
+
+// listQuotes lists quotes, only the ones taker can take when taker is given
+func (o OtcServer) listQuotes(ctx context.Context, in *pb.ListQuoteRequest, taker *repository.Taker) (out *pb.ListQuoteResponse, err error) {
 	filter := &repository.QuoteFilter{
 		MemberId:      in.GetUserId(),
 		Side:          in.GetSide(),
 		Status:        in.GetStatus(),
 		BaseCurrency:  in.GetBaseCurrency(),
 		QuoteCurrency: in.GetQuoteCurrency(),
+		Taker:         taker,
 	}
 
 	if in.GetPaging() != nil {
@@ -175,6 +274,10 @@ func (o OtcServer) DoListQuote(ctx context.Context, in *pb.ListQuoteRequest) (ou
 		log.Errorf("Search quotes: %v", err)
 		return nil, status.Errorf(codes.NotFound, "Fail to search quotes")
 	}
+	err = o.floatQuotes(ctx, quotes)
+	if err != nil {
+		return nil, err
+	}
 	out = &pb.ListQuoteResponse{
 		Quotes:      quotes,
 		ResultCount: count,
@@ -211,10 +314,51 @@ func (o OtcServer) DoUpdateQuote(ctx context.Context, in *pb.UpdateQuoteRequest)
 	if err != nil {
 		return
 	}
-
-	err = o.quotes.UpdateQuote(ctx, in.NewQuote.Id, uobj)
-	if err != nil {
-		return
+	if _, ok := uobj["status"]; ok {
+		pause, err := o.quotes.GetQuotePause(ctx, q.Id)
+		if err != nil {
+			log.Errorf("get quote pause error: %v", err)
+			return nil, exmongo.ErrorToRpcError(err)
+		}
+		if pause != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "quote %s is paused, it is put back on the shelf by resuming it", exutil.UUIDtoA(q.Id))
+		}
+	}
+	if _, ok := uobj["acceptedPaymentMethods"]; ok {
+		updated := *q
+		updated.AcceptedPaymentMethods = in.NewQuote.AcceptedPaymentMethods
+		if err = o.checkAcceptedPaymentMethods(ctx, &updated); err != nil {
+			return nil, err
+		}
+	}
+	// amounts and price change the balance the quote locks, so they are amended
+	amend := &AmendQuoteRequest{QuoteId: q.Id, MemberId: q.Owner}
+	_, volume := uobj["volume"]
+	_, value := uobj["value"]
+	_, price := uobj["price"]
+	if volume && q.Side == pb.OrderSide_ASK {
+		amend.Volume = in.NewQuote.Volume
+	}
+	if value && q.Side == pb.OrderSide_BID {
+		amend.Value = in.NewQuote.Value
+	}
+	if price {
+		amend.Price = in.NewQuote.Price
+	}
+	// the rest of the amounts are kept by the quote itself
+	for _, field := range []string{"volume", "value", "price", "volumeToFill", "lockedFee", "processingVolume", "processedVolume"} {
+		delete(uobj, field)
+	}
+	// the other fields are updated with the amended amounts, so the update is all or nothing
+	if volume || value || price {
+		if _, err = o.amendQuote(ctx, q, amend, uobj); err != nil {
+			return nil, err
+		}
+	} else if len(uobj) > 0 {
+		err = o.quotes.UpdateQuote(ctx, in.NewQuote.Id, uobj)
+		if err != nil {
+			return
+		}
 	}
 	out = &pb.UpdateQuoteResponse{
 		Message: "Success",
@@ -268,86 +412,37 @@ func (o OtcServer) DoDeleteQuote(ctx context.Context, in *pb.DeleteQuoteRequest)
 		log.Error("Quote has been closed already:" + exutil.UUIDtoA(in.Id))
 		return nil, fmt.Errorf("Quote has been closed already:%s", exutil.UUIDtoA(in.Id))
 	}
-	if q.ProcessingVolume != "0" {
-		log.Error("Can not cancel the quote with open otcorders")
-		return nil, errors.New("Can not cancel the quote with open otcorders")
+	pending, err := o.deleteQuote(ctx, q, closingActor(ctx))
+	if err != nil {
+		return nil, err
 	}
-	eventId := exutil.NewUUID()
-
-	//TODO: should put release balance and deletequote in a transaction
-
-	if q.Side == pb.OrderSide_ASK {
-		acc, err := o.findQuoteAccount(ctx, q, q.Instrument.Base.Id)
-		if err != nil {
-			log.Errorf("Failed to find quote account for currency: %s", exutil.UUIDtoA(q.Instrument.Base.Id))
-			return nil, err
-		}
-		//calculate fee+volume return
-		qVolume, ok := new(big.Int).SetString(q.Volume, 10)
-		if !ok {
-			return nil, fmt.Errorf("can not transfer quoteVolume to int %s", q.Volume)
-		}
-		qLockedFee, ok := new(big.Int).SetString(q.LockedFee, 10)
-		if !ok {
-			return nil, fmt.Errorf("can not transfer quote LockedFee to int %s", q.LockedFee)
-		}
-		amount := new(big.Int).Add(qVolume, qLockedFee).String()
-
-		if acc != nil {
-			req := &pb.ReleaseLockedBalanceRequest{
-				From:   acc.Id,
-				To:     acc.Id,
-				Amount: amount,
-				Order: &pb.OrderRef{
-					Id: in.Id,
-				},
-				Event: &pb.OrderEvent{
-					Id: eventId,
-				},
-			}
-			err = o.apis.ReleaselockedBalance(ctx, req)
-
-			if err != nil {
-				log.Error("failed to release locked balance: from " + exutil.UUIDtoA(acc.Id) + " to " + exutil.UUIDtoA(acc.Id))
-				return nil, err
-			}
-		}
+	out = &pb.DeleteQuoteResponse{
+		Message: "Success",
 	}
+	if pending {
+		out.Message = "Close pending: the quote is closed once its open orders finish"
+	}
+	return
+}
 
-	if _, ok := externalCurrency[q.Instrument.Quote.Symbol]; !ok && q.Side == pb.OrderSide_BID {
-		acc, err := o.findQuoteAccount(ctx, q, q.Instrument.Quote.Id)
-		if err != nil {
-			log.Errorf("Failed to find quote account for currency: %s", exutil.UUIDtoA(q.Instrument.Quote.Id))
-			return nil, err
-		}
-		if acc != nil {
-			req := &pb.ReleaseLockedBalanceRequest{
-				From:   acc.Id,
-				To:     acc.Id,
-				Amount: q.Value,
-				Order: &pb.OrderRef{
-					Id: q.Id,
-				},
-				Event: &pb.OrderEvent{
-					Id: eventId,
-				},
-			}
-			err = o.apis.ReleaselockedBalance(ctx, req)
-
+// deleteQuote closes q on behalf of actor, nil for its owner. A quote with open orders is
+// taken off the shelf and closed once they finish, which pending reports.
+func (o OtcServer) deleteQuote(ctx context.Context, q *pb.Quote, actor *repository.EventActor) (pending bool, err error) {
+	pause, err := o.quotes.GetQuotePause(ctx, q.Id)
+	if err != nil {
+		log.Errorf("get quote pause error: %v", err)
+		return false, exmongo.ErrorToRpcError(err)
+	}
+	if q.ProcessingVolume != "0" {
+		if pause == nil || !pause.ClosePending {
+			_, err = o.pauseQuote(ctx, q, pause, true, true, actor)
 			if err != nil {
-				log.Error("failed to release locked balance: from " + exutil.UUIDtoA(acc.Id) + " to " + exutil.UUIDtoA(acc.Id))
-				return nil, err
+				return false, err
 			}
 		}
+		return true, nil
 	}
-
-	err = o.quotes.DeleteQuote(ctx, in.Id, eventId)
-	if err == nil {
-		out = &pb.DeleteQuoteResponse{
-			Message: "Success",
-		}
-	}
-	return
+	return false, o.closeQuote(ctx, q, pause, actor)
 }
 
 /*
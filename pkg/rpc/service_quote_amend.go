@@ -0,0 +1,262 @@
+package rpc
+
+import (
+	"math/big"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/api"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type AmendQuoteRequest struct {
+	QuoteId  *pb.UUID
+	MemberId *pb.UUID
+	// Volume is the new remaining volume of an ASK quote, Value the new remaining value of a
+	// BID quote. Empty keeps the amount, the other side is worked out at the price.
+	Volume string
+	Value  string
+	// Price is the new price of a fixed price quote, 0 keeps the price
+	Price float64
+}
+
+type AmendQuoteResponse struct {
+	Quote *pb.Quote
+}
+
+// DoAmendQuote changes the remaining amount or price of a quote on or off the shelf, locking
+// more of the owner's balance or releasing part of it so the quote stays collateralised
+func (o OtcServer) DoAmendQuote(ctx context.Context, in *AmendQuoteRequest) (out *AmendQuoteResponse, err error) {
+	if in.QuoteId == nil || in.MemberId == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "quote and member are required")
+	}
+	q, err := o.quotes.GetQuote(ctx, in.QuoteId)
+	if err != nil {
+		log.Errorf("Failed to find quote %s: %v", exutil.UUIDtoA(in.QuoteId), err)
+		return nil, status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(in.QuoteId))
+	}
+	if !sameUUID(q.Owner, in.MemberId) {
+		return nil, status.Errorf(codes.PermissionDenied, "quote %s is not owned by member %s",
+			exutil.UUIDtoA(in.QuoteId), exutil.UUIDtoA(in.MemberId))
+	}
+	q, err = o.amendQuote(ctx, q, in, nil)
+	if err != nil {
+		return nil, err
+	}
+	out = &AmendQuoteResponse{
+		Quote: q,
+	}
+	return
+}
+
+// amendQuote works out the amounts of q amended by in and moves the difference in the
+// required lock, the locked amount plus the locked fee, between the owner's free and
+// locked balance before the quote is updated. The fields of others, which must not be
+// amounts, are updated along with the amounts.
+func (o OtcServer) amendQuote(ctx context.Context, q *pb.Quote, in *AmendQuoteRequest, others bson.M) (*pb.Quote, error) {
+	if q.Status == pb.Quote_CLOSED {
+		return nil, status.Errorf(codes.FailedPrecondition, "quote %s has been closed", exutil.UUIDtoA(q.Id))
+	}
+	if q.Type == pb.Quote_WHOLESALE {
+		return nil, status.Errorf(codes.FailedPrecondition, "wholesale quotes are traded whole and cannot be amended")
+	}
+	pause, err := o.quotes.GetQuotePause(ctx, q.Id)
+	if err != nil {
+		log.Errorf("get quote pause error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	if pause != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "quote %s is paused, resume it before amending", exutil.UUIDtoA(q.Id))
+	}
+	if (q.Side == pb.OrderSide_ASK && in.Value != "") || (q.Side == pb.OrderSide_BID && in.Volume != "") {
+		return nil, status.Errorf(codes.InvalidArgument, "%s quotes are amended by %s", q.Side, lockedAmountName(q.Side))
+	}
+	if in.Price < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid price %v", in.Price)
+	}
+	// floating quotes are amended at their current price
+	q, fp, err := o.refloatQuote(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if fp != nil && in.Price != 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "the price of floating quote %s follows the reference price", exutil.UUIDtoA(q.Id))
+	}
+	price := q.Price
+	if in.Price != 0 {
+		price = in.Price
+	}
+
+	// volume and value of the amended quote
+	volume, err := ParseMoney(q.Volume)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid volume %s of quote %s", q.Volume, exutil.UUIDtoA(q.Id))
+	}
+	value, err := ParseMoney(q.Value)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid value %s of quote %s", q.Value, exutil.UUIDtoA(q.Id))
+	}
+	if in.Volume != "" {
+		if volume, err = ParseMoney(in.Volume); err != nil || volume.Sign() <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid volume %s", in.Volume)
+		}
+	}
+	if in.Value != "" {
+		if value, err = ParseMoney(in.Value); err != nil || value.Sign() <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid value %s", in.Value)
+		}
+	}
+	newVolume, newValue := volume.Round(RoundDown), value.Round(RoundDown)
+	if q.Side == pb.OrderSide_ASK {
+		newValue = ValueAt(MoneyFromInt(newVolume), price).Round(RoundHalfUp)
+	} else {
+		newVolume = MoneyFromInt(newValue).Quo(decimalOf(price)).Round(RoundDown)
+	}
+	if newVolume.Sign() <= 0 || newValue.Sign() <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "amended quote %s would be empty", exutil.UUIDtoA(q.Id))
+	}
+
+	// the quote locks its volume on ASK and its value on BID, with the maker fee on top
+	locked, newLocked := q.Volume, newVolume
+	if q.Side == pb.OrderSide_BID {
+		locked, newLocked = q.Value, newValue
+	}
+	oldLocked, err := exutil.DecodeBigInt(locked)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid amount %s of quote %s", locked, exutil.UUIDtoA(q.Id))
+	}
+	oldFee, err := exutil.DecodeBigInt(q.LockedFee)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid locked fee %s of quote %s", q.LockedFee, exutil.UUIDtoA(q.Id))
+	}
+	toFill, err := exutil.DecodeBigInt(q.VolumeToFill)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid volume to fill %s of quote %s", q.VolumeToFill, exutil.UUIDtoA(q.Id))
+	}
+	policy, err := o.quoteFeePolicy(ctx, q)
+	if err != nil {
+		log.Errorf("Failed to get fee policy of quote %s: %v", exutil.UUIDtoA(q.Id), err)
+		return nil, err
+	}
+	newFee := new(big.Int)
+	if makerLocksFee(q.Side, policy) {
+		rate, err := o.getOtcFeeRate(ctx, q.Owner, q.Instrument, q.Side)
+		if err != nil {
+			return nil, err
+		}
+		newFee = partyFee(MoneyFromInt(newLocked), rate, policy, q.Side == pb.OrderSide_ASK)
+	}
+	from := new(big.Int).Add(oldLocked, oldFee)
+	to := new(big.Int).Add(newLocked, newFee)
+
+	eventId := exutil.NewUUID()
+	sg := newSaga(eventId)
+	// nothing is locked for buying with a currency paid outside the platform
+	if _, ok := externalCurrency[q.Instrument.Quote.Symbol]; !(ok && q.Side == pb.OrderSide_BID) && from.Cmp(to) != 0 {
+		err = o.adjustQuoteLock(ctx, sg, q, eventId, from, to)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// VolumeToFill moves with the locked amount
+	toFill.Add(toFill, new(big.Int).Sub(newLocked, oldLocked))
+	fields := bson.M{}
+	for k, v := range others {
+		fields[k] = v
+	}
+	fields["volume"] = newVolume.String()
+	fields["value"] = newValue.String()
+	fields["volumeToFill"] = toFill.String()
+	fields["lockedFee"] = newFee.String()
+	if price != q.Price {
+		fields["price"] = price
+	}
+	expected := bson.M{"value": q.Value, "volume": q.Volume, "processingVolume": q.ProcessingVolume, "lockedFee": q.LockedFee}
+	err = o.quotes.CompareAndUpdateQuote(ctx, q.Id, expected, fields)
+	if err != nil {
+		sg.compensate()
+		if err == repository.ErrQuoteModified {
+			return nil, status.Errorf(codes.Aborted, "quote %s is busy, please try again", exutil.UUIDtoA(q.Id))
+		}
+		log.Errorf("Failed to amend quote %s: %v", exutil.UUIDtoA(q.Id), err)
+		return nil, err
+	}
+	q.Volume, q.Value, q.VolumeToFill, q.LockedFee, q.Price = newVolume.String(), newValue.String(), toFill.String(), newFee.String(), price
+	return q, nil
+}
+
+// adjustQuoteLock locks the increase from the required lock from to to, or releases the decrease
+func (o OtcServer) adjustQuoteLock(ctx context.Context, sg *saga, q *pb.Quote, eventId *pb.UUID, from, to *big.Int) error {
+	coinId := q.Instrument.Base.Id
+	if q.Side == pb.OrderSide_BID {
+		coinId = q.Instrument.Quote.Id
+	}
+	acc, err := o.findQuoteAccount(ctx, q, coinId)
+	if err != nil {
+		log.Errorf("Failed to find quote account for currency: %s", exutil.UUIDtoA(coinId))
+		return err
+	}
+	release := func(ctx context.Context, amount *big.Int) error {
+		return o.apis.ReleaselockedBalance(ctx, &pb.ReleaseLockedBalanceRequest{
+			From:   acc.Id,
+			To:     acc.Id,
+			Amount: amount.String(),
+			Order: &pb.OrderRef{
+				Id: q.Id,
+			},
+			Event: &pb.OrderEvent{
+				Id: eventId,
+			},
+		})
+	}
+	diff := new(big.Int).Sub(to, from)
+	if diff.Sign() > 0 {
+		err = o.apis.LockAccountBalance(ctx, &api.LockBalance{
+			FromAmount: from,
+			ToAmount:   to,
+			CoinId:     coinId,
+			MemberId:   q.Owner,
+			ActivityId: q.Id,
+			Source:     pb.ActivitySource_ORDER,
+		})
+		if err != nil {
+			log.Errorf("Failed to lock %s more for quote %s: %v", diff, exutil.UUIDtoA(q.Id), err)
+			return err
+		}
+		sg.onFailure("lock balance", func(ctx context.Context) error {
+			return release(ctx, diff)
+		})
+		return nil
+	}
+	diff.Neg(diff)
+	err = release(ctx, diff)
+	if err != nil {
+		log.Errorf("Failed to release %s of quote %s: %v", diff, exutil.UUIDtoA(q.Id), err)
+		return err
+	}
+	sg.onFailure("release balance", func(ctx context.Context) error {
+		return o.apis.LockAccountBalance(ctx, &api.LockBalance{
+			FromAmount: to,
+			ToAmount:   from,
+			CoinId:     coinId,
+			MemberId:   q.Owner,
+			ActivityId: q.Id,
+			Source:     pb.ActivitySource_ORDER,
+		})
+	})
+	return nil
+}
+
+func lockedAmountName(side pb.OrderSide) string {
+	if side == pb.OrderSide_BID {
+		return "value"
+	}
+	return "volume"
+}
@@ -0,0 +1,238 @@
+package rpc
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type CreateReferralRequest struct {
+	Referee  *pb.UUID
+	Referrer *pb.UUID
+	// Share of the referee fees credited to the referrer, empty for the configured share
+	Share string
+}
+
+type CreateReferralResponse struct {
+	Id *pb.UUID
+}
+
+type SearchReferralsRequest struct {
+	Referrer *pb.UUID
+	PageIdx  int64
+	PageSize int64
+}
+
+type SearchReferralsResponse struct {
+	Referrals []*repository.Referral
+	Count     int64
+}
+
+type SearchRebatesRequest struct {
+	Referrer *pb.UUID
+	// Status limits the rebates to accrued or paid ones, empty for both
+	Status   repository.RebateStatus
+	PageIdx  int64
+	PageSize int64
+}
+
+type SearchRebatesResponse struct {
+	Rebates []*repository.RebateEntry
+	Count   int64
+}
+
+type SumRebatesRequest struct {
+	Referrer *pb.UUID
+}
+
+// RebateBalance is the rebate of a referrer in a currency, in smallest units
+type RebateBalance struct {
+	Currency string
+	Accrued  string
+	Paid     string
+}
+
+type SumRebatesResponse struct {
+	Rebates []*RebateBalance
+}
+
+// DoCreateReferral links a member to the member who referred them. A member has one referrer.
+func (o OtcServer) DoCreateReferral(ctx context.Context, in *CreateReferralRequest) (out *CreateReferralResponse, err error) {
+	if in.Referee == nil || in.Referrer == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "referee and referrer are required")
+	}
+	if sameUUID(in.Referee, in.Referrer) {
+		return nil, status.Errorf(codes.InvalidArgument, "a member cannot refer themselves")
+	}
+	if in.Share != "" {
+		if _, err := parseRebateShare(in.Share); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	if _, err := o.apis.FindMember(ctx, in.Referrer); err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed to find referrer: %v", exutil.UUIDtoA(in.Referrer))
+	}
+	// two members referring each other would rebate each other's fees
+	back, err := o.referrals.GetReferral(ctx, in.Referrer)
+	if err != nil {
+		log.Errorf("get referral error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	if back != nil && sameUUID(back.Referrer, in.Referee) {
+		return nil, status.Errorf(codes.FailedPrecondition, "member %s was referred by %s",
+			exutil.UUIDtoA(in.Referrer), exutil.UUIDtoA(in.Referee))
+	}
+	id, err := o.referrals.CreateReferral(ctx, &repository.Referral{
+		Referee:  in.Referee,
+		Referrer: in.Referrer,
+		Share:    in.Share,
+		Time:     time.Now().UnixNano(),
+	})
+	if err == repository.ErrReferralExists {
+		return nil, status.Errorf(codes.AlreadyExists, "member %s already has a referrer", exutil.UUIDtoA(in.Referee))
+	}
+	if err != nil {
+		log.Errorf("create referral error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &CreateReferralResponse{
+		Id: id,
+	}
+	return
+}
+
+// DoSearchReferrals lists the members a member referred, newest first
+func (o OtcServer) DoSearchReferrals(ctx context.Context, in *SearchReferralsRequest) (out *SearchReferralsResponse, err error) {
+	if in.Referrer == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "referrer is required")
+	}
+	referrals, count, err := o.referrals.SearchReferrals(ctx, in.Referrer, in.PageIdx, in.PageSize)
+	if err != nil {
+		log.Errorf("search referrals error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &SearchReferralsResponse{
+		Referrals: referrals,
+		Count:     count,
+	}
+	return
+}
+
+// DoSearchRebates lists the rebates of a referrer, newest first
+func (o OtcServer) DoSearchRebates(ctx context.Context, in *SearchRebatesRequest) (out *SearchRebatesResponse, err error) {
+	if in.Referrer == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "referrer is required")
+	}
+	switch in.Status {
+	case "", repository.RebateAccrued, repository.RebatePaid:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown rebate status %q", in.Status)
+	}
+	rebates, count, err := o.rebates.SearchRebates(ctx, &repository.RebateFilter{
+		Referrer: in.Referrer,
+		Status:   in.Status,
+		PageIdx:  in.PageIdx,
+		PageSize: in.PageSize,
+	})
+	if err != nil {
+		log.Errorf("search rebates error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &SearchRebatesResponse{
+		Rebates: rebates,
+		Count:   count,
+	}
+	return
+}
+
+// DoSumRebates returns the accrued and paid rebate of a referrer per currency
+func (o OtcServer) DoSumRebates(ctx context.Context, in *SumRebatesRequest) (out *SumRebatesResponse, err error) {
+	if in.Referrer == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "referrer is required")
+	}
+	sums, err := o.rebates.SumRebates(ctx, in.Referrer)
+	if err != nil {
+		log.Errorf("sum rebates error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &SumRebatesResponse{}
+	byCurrency := map[string]*RebateBalance{}
+	for _, s := range sums {
+		b, ok := byCurrency[s.Currency]
+		if !ok {
+			b = &RebateBalance{Currency: s.Currency, Accrued: "0", Paid: "0"}
+			byCurrency[s.Currency] = b
+			out.Rebates = append(out.Rebates, b)
+		}
+		if s.Status == repository.RebatePaid {
+			b.Paid = s.Amount
+		} else {
+			b.Accrued = s.Amount
+		}
+	}
+	return
+}
+
+// accrueRebate credits the referrer of the payer of a fee with their share of it. Like
+// recordFee it runs once the fee is collected, so failures are logged only.
+func (o OtcServer) accrueRebate(ctx context.Context, order *pb.OtcOrder, payer *pb.UUID, coin *pb.CurrencyRef, fee *big.Int, feeEventId *pb.UUID) {
+	referral, err := o.referrals.GetReferral(ctx, payer)
+	if err != nil {
+		log.Errorf("Fail to find referrer of %s for fee event %s: %v", exutil.UUIDtoA(payer), exutil.UUIDtoA(feeEventId), err)
+		return
+	}
+	if referral == nil {
+		return
+	}
+	share := o.conf.RebateShare
+	if referral.Share != "" {
+		if share, err = parseRebateShare(referral.Share); err != nil {
+			log.Errorf("Invalid rebate share of referral %s: %v", exutil.UUIDtoA(referral.Id), err)
+			return
+		}
+	}
+	if share == nil {
+		return
+	}
+	amount := MoneyFromInt(fee).Mul(share).Round(RoundDown)
+	if c, ok := o.conf.RebateCaps[strings.ToLower(coin.GetSymbol())]; ok && amount.Cmp(c) > 0 {
+		amount = c
+	}
+	if amount.Sign() <= 0 {
+		return
+	}
+	err = o.rebates.AccrueRebate(ctx, &repository.RebateEntry{
+		FeeEventId: feeEventId,
+		OrderId:    order.Id,
+		Referrer:   referral.Referrer,
+		Referee:    payer,
+		CoinId:     coin.GetId(),
+		Currency:   coin.GetSymbol(),
+		Instrument: strings.ToLower(order.Instrument.GetCode()),
+		Fee:        fee.String(),
+		Amount:     amount.String(),
+		Time:       time.Now().UnixNano(),
+	})
+	if err != nil {
+		log.Errorf("Fail to accrue rebate %s %s for %s on fee event %s: %v", amount.String(), coin.GetSymbol(),
+			exutil.UUIDtoA(referral.Referrer), exutil.UUIDtoA(feeEventId), err)
+	}
+}
+
+func parseRebateShare(s string) (*big.Rat, error) {
+	share, err := ParseRate(s)
+	if err != nil || share.Sign() < 0 || share.Cmp(big.NewRat(1, 1)) > 0 {
+		return nil, fmt.Errorf("invalid rebate share %q", s)
+	}
+	return share, nil
+}
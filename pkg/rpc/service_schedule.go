@@ -0,0 +1,132 @@
+package rpc
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type SetQuoteScheduleRequest struct {
+	QuoteId  *pb.UUID
+	MemberId *pb.UUID
+	// Schedule of the quote, nil takes the quote off its schedule
+	Schedule *repository.QuoteSchedule
+}
+
+type SetQuoteScheduleResponse struct {
+	// Open is whether the quote trades now
+	Open bool
+}
+
+type MakerActivityRequest struct {
+	MemberId *pb.UUID
+}
+
+type MakerActivityResponse struct {
+	Message string
+}
+
+// DoSetQuoteSchedule sets the weekly trading hours and inactivity timeout of a quote. The
+// expire worker turns the quote on and off accordingly.
+func (o OtcServer) DoSetQuoteSchedule(ctx context.Context, in *SetQuoteScheduleRequest) (out *SetQuoteScheduleResponse, err error) {
+	if in.QuoteId == nil || in.MemberId == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "quote and member are required")
+	}
+	q, err := o.quotes.GetQuote(ctx, in.QuoteId)
+	if err != nil {
+		log.Errorf("Failed to find quote %s: %v", exutil.UUIDtoA(in.QuoteId), err)
+		return nil, status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(in.QuoteId))
+	}
+	if !sameUUID(q.Owner, in.MemberId) {
+		return nil, status.Errorf(codes.PermissionDenied, "quote %s is not owned by member %s",
+			exutil.UUIDtoA(in.QuoteId), exutil.UUIDtoA(in.MemberId))
+	}
+	if q.Status == pb.Quote_CLOSED {
+		return nil, status.Errorf(codes.FailedPrecondition, "quote %s has been closed", exutil.UUIDtoA(q.Id))
+	}
+	old, err := o.quotes.GetQuoteSchedule(ctx, q.Id)
+	if err != nil {
+		log.Errorf("get quote schedule error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	now := time.Now()
+	schedule := in.Schedule
+	if schedule != nil {
+		if err := schedule.Validate(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		schedule.LastActive = now.UnixNano()
+		// a quote the schedule turned off is turned on again by the worker if it opens
+		schedule.Off = old != nil && old.Off
+	}
+	if schedule == nil && old != nil && old.Off {
+		// taken off its schedule, a quote the schedule turned off goes back on the shelf
+		err = o.quotes.SetScheduledQuoteStatus(ctx, q.Id, pb.Quote_OFF, pb.Quote_ON, exutil.NewUUID())
+		if err != nil && err != repository.ErrQuoteModified {
+			log.Errorf("turn on quote %s error: %v", exutil.UUIDtoA(q.Id), err)
+			return nil, exmongo.ErrorToRpcError(err)
+		}
+	}
+	err = o.quotes.SetQuoteSchedule(ctx, q.Id, schedule)
+	if err != nil {
+		log.Errorf("set quote schedule error: %v", err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &SetQuoteScheduleResponse{Open: true}
+	if schedule != nil {
+		out.Open, _ = schedule.Open(now)
+	}
+	return
+}
+
+// DoMarkMakerActive records a maker as online, keeping their quotes with an inactivity
+// timeout on the shelf
+func (o OtcServer) DoMarkMakerActive(ctx context.Context, in *MakerActivityRequest) (out *MakerActivityResponse, err error) {
+	if in.MemberId == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "member is required")
+	}
+	err = o.quotes.TouchQuoteSchedules(ctx, in.MemberId, time.Now().UnixNano())
+	if err != nil {
+		log.Errorf("touch quote schedules of %s error: %v", exutil.UUIDtoA(in.MemberId), err)
+		return nil, exmongo.ErrorToRpcError(err)
+	}
+	out = &MakerActivityResponse{
+		Message: "success",
+	}
+	return
+}
+
+// checkTradingHours rejects orders on a scheduled quote outside its trading hours
+func (o OtcServer) checkTradingHours(ctx context.Context, q *pb.Quote, now time.Time) error {
+	schedule, err := o.quotes.GetQuoteSchedule(ctx, q.Id)
+	if err != nil {
+		log.Errorf("get quote schedule error: %v", err)
+		return exmongo.ErrorToRpcError(err)
+	}
+	if schedule == nil {
+		return nil
+	}
+	in, err := schedule.InWindow(now)
+	if err != nil {
+		log.Errorf("invalid schedule of quote %s: %v", exutil.UUIDtoA(q.Id), err)
+		return status.Errorf(codes.Internal, "invalid schedule of quote %s", exutil.UUIDtoA(q.Id))
+	}
+	if !in {
+		return status.Errorf(codes.FailedPrecondition, "quote %s is outside its trading hours (%s time)", exutil.UUIDtoA(q.Id), timezoneName(schedule.Timezone))
+	}
+	return nil
+}
+
+func timezoneName(tz string) string {
+	if tz == "" {
+		return "UTC"
+	}
+	return tz
+}
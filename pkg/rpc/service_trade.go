@@ -3,7 +3,6 @@ package rpc
 import (
 	"fmt"
 	"math/big"
-	"strconv"
 	"time"
 
 	"google.golang.org/grpc/codes"
@@ -12,15 +11,21 @@ import (
 	"gitlab.com/sdce/service/otc/pkg/repository"
 
 	"gitlab.com/sdce/service/otc/pkg/api"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
 
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
 	pb "gitlab.com/sdce/protogo"
 	"go.mongodb.org/mongo-driver/bson"
 	"golang.org/x/net/context"
 )
 
-const feeRate = 0.002
+const (
+	defaultFeeRate = "0.002"
+	// maxQuoteUpdateRetries bounds how often a quote update is recomputed when other orders keep changing the quote
+	maxQuoteUpdateRetries = 10
+)
 
 func (o OtcServer) DoGetOtcOrder(ctx context.Context, in *pb.GetOtcOrderRequest) (out *pb.GetOtcOrderResponse, err error) {
 	order, err := o.trades.GetOtcOrder(ctx, in.OrderId)
@@ -61,80 +66,32 @@ func (o OtcServer) DoListOrder(ctx context.Context, in *pb.ListOtcOrderRequest)
 	return
 }
 
+// DoCancelOrder cancels an unpaid order for its buyer or an admin
 func (o OtcServer) DoCancelOrder(ctx context.Context, in *pb.CancelOtcOrderRequest) (out *pb.CancelOtcOrderResponse, err error) {
-	//Check unpaid status
-	order, err := o.trades.GetOtcOrder(ctx, in.OrderId)
+	actor, err := actorFromContext(ctx)
 	if err != nil {
-		log.Errorf("Invalid order ID")
-		return
-	}
-	if order.Status != pb.OtcOrder_UNPAID {
-		err := fmt.Errorf("The order can only be canceled when the order is in unpaid status.")
-		log.Errorf(err.Error())
 		return nil, err
 	}
-	eventId := exutil.NewUUID()
-	//Release locked account of the order
-	if _, ok := externalCurrency[order.Instrument.Quote.Symbol]; !(ok && order.Side == pb.OrderSide_BID) {
-		var coinId *pb.UUID
-		var amount string
-		if order.Side == pb.OrderSide_ASK {
-			coinId = order.GetInstrument().GetBase().Id
-			amount = order.Volume
-		} else {
-			coinId = order.GetInstrument().GetQuote().Id
-			amount = order.Value
-		}
-
-		orderAccount, err := o.findOrderAccount(ctx, order, coinId)
-		if err != nil {
-			log.Errorf(err.Error())
-			return nil, err
-		}
-		req := &pb.ReleaseLockedBalanceRequest{
-			From:   orderAccount.Id,
-			To:     orderAccount.Id,
-			Amount: amount,
-			Order: &pb.OrderRef{
-				Id: order.Id,
-			},
-			Event: &pb.OrderEvent{
-				Id: eventId,
-			},
-		}
-		err = o.apis.ReleaselockedBalance(ctx, req)
-		if err != nil {
-			log.Error("fail to release locked balance")
-			return nil, err
-		}
-	}
-	//release pending
-	err = o.releasePendingPro(ctx, order)
-	if err != nil {
-		log.Errorf("release pending error: %v", err)
+	if err = o.cancelOrder(ctx, actor, in.OrderId); err != nil {
 		return nil, err
 	}
-
-	//update quote volume and value
-	q, err := o.quotes.GetQuote(ctx, order.QuoteId)
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(order.QuoteId))
-	}
-	err = o.updateQuoteVolumeValueandFee(ctx, order.Volume, order.Value, order.Fee, q, "CANCEL")
-	if err != nil {
-		log.Errorf("Fail to update quote volume and value when cancel order")
-		return nil, err
+	out = &pb.CancelOtcOrderResponse{
+		Message: "Success",
 	}
+	return
+}
 
-	err = o.trades.DeleteOtcOrder(ctx, in.OrderId)
+// cancelOrder moves an unpaid order to CANCELLED on behalf of actor
+func (o OtcServer) cancelOrder(ctx context.Context, actor *orderActor, orderId *pb.UUID) error {
+	order, err := o.trades.GetOtcOrder(ctx, orderId)
 	if err != nil {
-		log.Errorln("Failed to update order:" + in.OrderId.String())
-		return
+		log.Errorf("cannot find order: %s", exutil.UUIDtoA(orderId))
+		return exmongo.ErrorToRpcError(err)
 	}
-	out = &pb.CancelOtcOrderResponse{
-		Message: "Success",
+	if order.Status != pb.OtcOrder_UNPAID {
+		return status.Errorf(codes.FailedPrecondition, "order %s can only be cancelled while unpaid", exutil.UUIDtoA(orderId))
 	}
-	return
+	return o.updateOrder(ctx, actor, order, pb.OtcOrder_CANCELLED)
 }
 
 func (o OtcServer) DoUpdateOrder(ctx context.Context, in *pb.UpdateOtcOrderStatusRequest) (out *pb.UpdateOtcOrderStatusResponse, err error) {
@@ -150,118 +107,109 @@ func (o OtcServer) DoUpdateOrder(ctx context.Context, in *pb.UpdateOtcOrderStatu
 		}
 		return out, nil
 	}
-	switch order.Status {
-	case pb.OtcOrder_CANCELLED:
-		err = fmt.Errorf("status of Cancelled order cannot be changed ")
+	actor, err := actorFromContext(ctx)
+	if err != nil {
 		return nil, err
-	case pb.OtcOrder_RESOLVED:
-		err = fmt.Errorf("status of Resolved order cannot be changed ")
+	}
+	if err = o.updateOrder(ctx, actor, order, in.Status); err != nil {
 		return nil, err
-	case pb.OtcOrder_APPEAL:
-		if in.Status != pb.OtcOrder_RESOLVED && in.Status != pb.OtcOrder_CANCELLED {
-			err = fmt.Errorf("appealed order can only be resolved or cancelled")
-			return nil, err
-		}
-	case pb.OtcOrder_UNPAID:
-		if in.Status != pb.OtcOrder_PAID && in.Status != pb.OtcOrder_APPEAL && in.Status != pb.OtcOrder_CANCELLED && in.Status != pb.OtcOrder_EXPIRED {
-			err = fmt.Errorf("appealed order can only be resolved or cancelled")
-			return nil, err
-		}
-	case pb.OtcOrder_PAID:
-		if in.Status != pb.OtcOrder_COMPLETED && in.Status != pb.OtcOrder_APPEAL && in.Status != pb.OtcOrder_CANCELLED && in.Status != pb.OtcOrder_UNPAID {
-			err = fmt.Errorf("appealed order can only be resolved or cancelled")
-			return nil, err
-		}
+	}
+	log.Info("update order status success")
+	out = &pb.UpdateOtcOrderStatusResponse{
+		Message: "success",
+	}
+	return
+}
 
-	case pb.OtcOrder_COMPLETED:
-		if in.Status != pb.OtcOrder_COMPLETED && in.Status != pb.OtcOrder_APPEAL && in.Status != pb.OtcOrder_CANCELLED {
-			err = fmt.Errorf("appealed order can only be resolved or cancelled")
-			return nil, err
-		}
+// updateOrder makes the transition of order to status to on behalf of actor and runs its hooks
+func (o OtcServer) updateOrder(ctx context.Context, actor *orderActor, order *pb.OtcOrder, to pb.OtcOrder_OrderStatus) (err error) {
+	t, err := orderstate.Lookup(order.Status, to)
+	if err != nil {
+		log.Error(err)
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	role, err := actor.authorize(t, order)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if err := t.CheckPreconditions(order); err != nil {
+		log.Error(err)
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
 	}
 	eventId := exutil.NewUUID()
-
-	//Pay and Release
-	if order.Status == pb.OtcOrder_UNPAID && in.Status == pb.OtcOrder_PAID {
-		err := o.payOrder(ctx, order, eventId)
-		if err != nil {
-			log.Errorf("Fail to pay Order %s", err.Error())
-			return nil, err
+	sg := newSaga(eventId)
+	// once a hook which cannot be undone has run, the order stays in its new status
+	irreversible := false
+	defer func() {
+		if err != nil && !irreversible {
+			sg.compensate()
 		}
-
-	}
-
-	if order.Status == pb.OtcOrder_PAID && in.Status == pb.OtcOrder_UNPAID {
-		err := o.refundOrder(ctx, order, eventId)
-		if err != nil {
-			log.Errorf("Fail to refund Order %s", err.Error())
-			return nil, err
+	}()
+
+	// claim the transition before moving funds, so a concurrent call making the same
+	// transition fails here instead of running the hooks again
+	err = o.trades.UpdateOtcOrderStatus(ctx, order.Id, eventId, order.Status, to, &repository.EventActor{
+		MemberId: actor.memberId,
+		Role:     role,
+		Reason:   actor.reason,
+	})
+	if err != nil {
+		log.Errorf("Failed to update order status %s: %v", exutil.UUIDtoA(order.Id), err)
+		if err == repository.ErrOrderStatusChanged {
+			return status.Errorf(codes.Aborted, "order %s has been updated concurrently", exutil.UUIDtoA(order.Id))
 		}
+		return exmongo.ErrorToRpcError(err)
 	}
+	sg.onFailure("update status", func(ctx context.Context) error {
+		return o.trades.RevertOtcOrderStatus(ctx, order.Id, eventId, order.Status, to)
+	})
 
-	if order.Status == pb.OtcOrder_PAID && in.Status == pb.OtcOrder_COMPLETED {
-		err := o.releaseCoin(ctx, order, eventId)
-		if err != nil {
-			log.Errorf("Fail to release coin %s", err.Error())
-			return nil, err
+	for _, hook := range t.Hooks {
+		if hook.IsQuoteUpdate() {
+			continue
 		}
-		//release pending
-		err = o.releasePendingPro(ctx, order)
-		if err != nil {
-			log.Errorf("release pending error: %v", err)
-			return nil, err
-		}
-		//update quote
-		q, err := o.quotes.GetQuote(ctx, order.QuoteId)
-		if err != nil {
-			log.Errorf("Can not find quote by the quete ID from order")
-			return nil, err
+		if err = o.runOrderHook(ctx, hook, order, eventId); err != nil {
+			log.Errorf("Fail to %s for order %s: %v", hook, exutil.UUIDtoA(order.Id), err)
+			return err
 		}
-		err = o.updateQuoteVolumeValueandFee(ctx, order.Volume, order.Value, order.Fee, q, "COMPLETE")
-		if err != nil {
-			log.Errorf("Can not updateQuoteVolumeandValue ")
-			return nil, err
+		undo := o.undoOrderHook(hook, order, eventId)
+		if undo == nil {
+			irreversible = true
+			continue
 		}
-
+		sg.onFailure(hook.String(), undo)
 	}
 
-	//Expired
-	if in.Status == pb.OtcOrder_EXPIRED {
-		if order.Status != pb.OtcOrder_UNPAID {
-			err := status.Errorf(codes.PermissionDenied, "Status of %v cannot be expired.", order.Status)
-			log.Error(err)
-			return nil, err
-		}
-		err = o.expireOrder(ctx, order, eventId)
-		if err != nil {
-			log.Error(err)
-			return nil, err
-		}
-
-		//update quote volume and value
-		q, err := o.quotes.GetQuote(ctx, order.QuoteId)
-		if err != nil {
-			log.Errorf("Can not find quote by the quete ID from order")
-			return nil, err
+	//update quote volume and value
+	err = o.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		for _, hook := range t.Hooks {
+			if !hook.IsQuoteUpdate() {
+				continue
+			}
+			if err := o.runOrderHook(ctx, hook, order, eventId); err != nil {
+				log.Errorf("Fail to %s for order %s: %v", hook, exutil.UUIDtoA(order.Id), err)
+				return err
+			}
 		}
-		err = o.updateQuoteVolumeValueandFee(ctx, order.Volume, order.Value, order.Fee, q, "EXPIRE")
-		if err != nil {
-			log.Errorf("Fail to update quote volume and value when expire order: %s", err.Error())
-			return nil, err
+		if to == pb.OtcOrder_PAID {
+			return o.trades.SetReleaseDeadline(ctx, order.Id, time.Now().Add(o.conf.ReleaseTimeout).UnixNano())
 		}
-	}
-
-	err = o.trades.UpdateOtcOrderStatus(ctx, in.OrderId, eventId, in.Status)
+		return nil
+	})
 	if err != nil {
-		log.Println("Failed to update order status:" + in.OrderId.String())
-		return nil, err
+		if irreversible {
+			log.Errorf("Order %s moved to %s but its quote was not updated: %v", exutil.UUIDtoA(order.Id), to.String(), err)
+		}
+		return err
 	}
-
-	log.Info("update order status success")
-	out = &pb.UpdateOtcOrderStatusResponse{
-		Message: "success",
+	for _, hook := range t.Hooks {
+		if hook.IsQuoteUpdate() {
+			o.completePendingClose(ctx, order.QuoteId)
+			break
+		}
 	}
-	return
+	return nil
 }
 
 func (o OtcServer) DoUpdateOtcOrderRoomId(ctx context.Context, in *pb.UpdateOtcOrderRoomIdRequest) (out *pb.UpdateOtcOrderRoomIdResponse, err error) {
@@ -278,6 +226,17 @@ func (o OtcServer) DoUpdateOtcOrderRoomId(ctx context.Context, in *pb.UpdateOtcO
 
 //Bid from a ASK Quote
 func (o OtcServer) DoBuyQuote(ctx context.Context, in *pb.BuyQuoteRequest) (*pb.BuyQuoteResponse, error) {
+	id, err := o.withIdempotency(ctx, "DoBuyQuote", in.MemberId, func() (*pb.UUID, error) {
+		out, err := o.buyQuote(ctx, in)
+		return out.GetOrderId(), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.BuyQuoteResponse{OrderId: id}, nil
+}
+
+func (o OtcServer) buyQuote(ctx context.Context, in *pb.BuyQuoteRequest) (out *pb.BuyQuoteResponse, err error) {
 	//Volume Value QuoteId MemberId
 	//Price validate
 	//if aud/usd lock balance
@@ -291,95 +250,40 @@ func (o OtcServer) DoBuyQuote(ctx context.Context, in *pb.BuyQuoteRequest) (*pb.
 		return nil, err
 	}
 
-	if q.Status != pb.Quote_ON {
-		err = fmt.Errorf("Quote is not on shelf now :%s", in.QuoteId.String())
-		return nil, err
-	}
-	//validate value
-	value, err := fl(in.Value)
+	q, fp, err := o.refloatQuote(ctx, q)
 	if err != nil {
-		err = fmt.Errorf("invalid value detected")
 		return nil, err
 	}
-	ret, err := o.validateOtcValue(value, q)
-	if !ret {
-		return nil, status.Errorf(codes.FailedPrecondition, "Invalid otc value: %v", err)
-	}
-	//validate volume
-	volume, err := fl(in.Volume)
+	po, err := o.priceOrder(ctx, q, in.MemberId, in.Volume, in.Value, time.Now())
 	if err != nil {
-		err = fmt.Errorf("invalid volume detected")
-		return nil, err
-	}
-	retVo, err := o.validateOtcVolume(volume, q)
-	if !retVo {
-		return nil, status.Errorf(codes.FailedPrecondition, "Invalid otc volume %v", err)
-	}
-
-	//price
-	price := quo(value, volume)
-	price64f, _ := price.Float64()
-
-	//validate price
-	imf := new(exutil.ImprFloat)
-	baseDec, quoteDec := int(q.Instrument.Base.Decimal), int(q.Instrument.Quote.Decimal)
-	qPrice := imf.FromFloat(q.Price).Shift(baseDec - quoteDec).ToFloat()
-	oPrice := imf.FromFloat(price64f).Shift(baseDec - quoteDec).ToFloat()
-
-	if qPrice-oPrice > 0.01 || qPrice-oPrice < -0.01 {
-		err = status.Errorf(codes.FailedPrecondition, "Invalid price: Quote Price: %f, Order Price: %f", qPrice, oPrice)
-		return nil, err
-	}
-
-	//expire time
-	liveTime := q.ExpireBy
-	if q.ExpireBy == 0 {
-		err = status.Errorf(codes.Internal, "Quote's expire time should not be 0, Quote Id : %s", exutil.UUIDtoA(q.Id))
 		return nil, err
 	}
-	createdTime := time.Now()
-	createdTimeUnixNano := createdTime.UnixNano()
-	expiredTime := createdTime.Add(time.Duration(liveTime) * time.Second).UnixNano()
-
-	//fee
-	rate, err := o.getOtcFeeRate(ctx, q.Owner)
-	if err != nil {
-		return nil, err
+	otcO := po.order
+	fee := po.fee.onQuote(otcO).String()
+	// the maker of an ASK quote is paid
+	var chosen []pb.PaymentMethod
+	if in.Method != pb.PaymentMethod_INVALID_METHOD {
+		chosen = []pb.PaymentMethod{in.Method}
 	}
-	totalVolume := quo(volume, new(big.Float).Sub(big.NewFloat(1), rate))
-	feeFloat := new(big.Float).Sub(totalVolume, volume)
-	fee := feeFloat.Text('f', 0)
-
-	//if buy all remained volume, fee = q lockedfee
-	qvolume, err := fl(q.Volume)
+	payment, err := o.orderPayment(ctx, q, q.Owner, chosen)
 	if err != nil {
-		err = fmt.Errorf("invalid quote volume detected")
 		return nil, err
 	}
-	if qvolume.Cmp(volume) == 0 {
-		fee = q.LockedFee
-	}
-
-	otcO := &pb.OtcOrder{
-		OrderNumber: "",
-		Side:        pb.OrderSide_BID,
-		MemberId:    in.MemberId,
-		QuoteOwner:  q.Owner,
-		QuoteId:     in.QuoteId,
-		Price:       price64f,
-		Volume:      in.Volume,
-		Value:       in.Value,
-		Status:      pb.OtcOrder_UNPAID,
-		Time:        createdTimeUnixNano,
-		Instrument:  q.Instrument,
-		Fee:         fee,
-		ExpiredTime: expiredTime,
-	}
+	otcO.Method = payment.Method
 
 	//lock balance
 	eventId := exutil.NewUUID()
-	if _, ok := externalCurrency[q.Instrument.Quote.Symbol]; !ok {
-		val, err := exutil.DecodeBigInt(in.Value)
+	sg := newSaga(eventId)
+	defer func() {
+		if err != nil {
+			sg.compensate()
+		}
+	}()
+	if po.lockCoin != nil {
+		val, err := exutil.DecodeBigInt(po.lockAmount)
+		if err != nil {
+			return nil, err
+		}
 		lr := &api.LockBalance{
 			FromAmount: big.NewInt(0),
 			ToAmount:   val,
@@ -394,6 +298,9 @@ func (o OtcServer) DoBuyQuote(ctx context.Context, in *pb.BuyQuoteRequest) (*pb.
 			log.Errorf("failed to lock account balance %v", err)
 			return nil, err
 		}
+		sg.onFailure("lock balance", func(ctx context.Context) error {
+			return o.releaseOrderLock(ctx, otcO, q.GetInstrument().GetQuote().GetId(), po.lockAmount, eventId)
+		})
 	}
 	//add pending
 	account, err := o.findOrderAccount(ctx, otcO, q.Instrument.GetBase().GetId())
@@ -405,24 +312,58 @@ func (o OtcServer) DoBuyQuote(ctx context.Context, in *pb.BuyQuoteRequest) (*pb.
 		log.Errorf("Buy quote add pending error: %v", err)
 		return nil, err
 	}
+	sg.onFailure("add pending", func(ctx context.Context) error {
+		return o.releasePending(ctx, account.GetId(), eventId, in.Volume)
+	})
 
-	//Update Quote volume and value
-	err = o.updateQuoteVolumeValueandFee(ctx, in.Volume, in.Value, fee, q, "CREATE")
-	if err != nil {
-		return nil, err
-	}
-	//TODO: using transaction
-	id, err := o.trades.CreateOtcOrder(ctx, otcO, eventId)
+	//Update Quote volume and value, create order
+	var id *pb.UUID
+	err = o.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		err := o.updateQuoteVolumeValueandFee(ctx, in.Volume, in.Value, fee, q, "CREATE")
+		if err != nil {
+			return err
+		}
+		if !repository.InTransaction(ctx) {
+			sg.onFailure("update quote", func(ctx context.Context) error {
+				return o.restoreQuote(ctx, q.Id, in.Volume, in.Value, fee)
+			})
+		}
+		id, err = o.trades.CreateOtcOrder(ctx, otcO, eventId)
+		if err != nil {
+			log.Errorf("Failed to create otc order for quote: %s, event: %s", exutil.UUIDtoA(in.QuoteId), exutil.UUIDtoA(eventId))
+			return err
+		}
+		err = o.trades.SetOtcOrderFees(ctx, id, po.fee.fees(otcO))
+		if err != nil {
+			return err
+		}
+		err = o.trades.SetOtcOrderPayment(ctx, id, payment)
+		if err != nil || fp == nil {
+			return err
+		}
+		return o.trades.SetOtcOrderPricing(ctx, id, fp.snapshot())
+	})
 	if err != nil {
 		return nil, err
 	}
-	out := &pb.BuyQuoteResponse{
+	out = &pb.BuyQuoteResponse{
 		OrderId: id,
 	}
 	return out, err
 }
 
-func (o OtcServer) DoSellQuote(ctx context.Context, in *pb.SellQuoteRequest) (out *pb.SellQuoteResponse, err error) {
+func (o OtcServer) DoSellQuote(ctx context.Context, in *pb.SellQuoteRequest) (*pb.SellQuoteResponse, error) {
+	id, err := o.withIdempotency(ctx, "DoSellQuote", in.MemberId, func() (*pb.UUID, error) {
+		out, err := o.sellQuote(ctx, in)
+		return out.GetOrderId(), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SellQuoteResponse{OrderId: id}, nil
+}
+
+func (o OtcServer) sellQuote(ctx context.Context, in *pb.SellQuoteRequest) (out *pb.SellQuoteResponse, err error) {
 	q, err := o.quotes.GetQuote(ctx, in.QuoteId)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(in.QuoteId))
@@ -432,86 +373,34 @@ func (o OtcServer) DoSellQuote(ctx context.Context, in *pb.SellQuoteRequest) (ou
 		return nil, err
 	}
 
-	if q.Status != pb.Quote_ON {
-		err = fmt.Errorf("Quote is not on shelf now :%s", in.QuoteId.String())
-		return
-	}
-	value, err := fl(in.Value)
+	q, fp, err := o.refloatQuote(ctx, q)
 	if err != nil {
-		err = fmt.Errorf("invalid value detected")
-		return
-	}
-	ret, err := o.validateOtcValue(value, q)
-	if !ret {
-		return nil, status.Errorf(codes.FailedPrecondition, "Invalid otc value: %v", err)
-	}
-
-	//validate volume
-	volume, err := fl(in.Volume)
-	if err != nil {
-		err = fmt.Errorf("invalid volume detected")
-		return nil, err
-	}
-	retVo, err := o.validateOtcVolume(volume, q)
-	if !retVo {
-		return nil, status.Errorf(codes.FailedPrecondition, "Invalid otc volume %v", err)
-	}
-
-	price := quo(value, volume)
-	price64f, _ := price.Float64()
-	//validate Price
-	imf := new(exutil.ImprFloat)
-	baseDec, quoteDec := int(q.Instrument.Base.Decimal), int(q.Instrument.Quote.Decimal)
-	qPrice := imf.FromFloat(q.Price).Shift(baseDec - quoteDec).ToFloat()
-	oPrice := imf.FromFloat(price64f).Shift(baseDec - quoteDec).ToFloat()
-
-	if qPrice-oPrice > 0.01 || qPrice-oPrice < -0.01 {
-		err = status.Errorf(codes.FailedPrecondition, "Invalid price: %f", price64f)
 		return nil, err
 	}
-	//fee
-	rate, err := o.getOtcFeeRate(ctx, q.Owner)
+	po, err := o.priceOrder(ctx, q, in.MemberId, in.Volume, in.Value, time.Now())
 	if err != nil {
 		return nil, err
 	}
-	volFloat, err := exutil.Float(in.Volume)
+	otcO := po.order
+	fee := po.fee.onQuote(otcO).String()
+	// the taker selling on a BID quote is paid
+	payment, err := o.orderPayment(ctx, q, in.MemberId, in.AcceptedMethods)
 	if err != nil {
 		return nil, err
 	}
-	feeFloat := mul(rate, volFloat)
-	fee := feeFloat.Text('f', 0)
-	vol, err := exutil.DecodeBigInt(in.Volume)
+	otcO.Method = payment.Method
+	vol, err := exutil.DecodeBigInt(po.lockAmount)
 	if err != nil {
 		return nil, err
 	}
 
-	//expire time
-	liveTime := q.ExpireBy
-	if q.ExpireBy == 0 {
-		err = status.Errorf(codes.Internal, "Quote's expire time should not be 0, Quote Id : %s", exutil.UUIDtoA(q.Id))
-		return nil, err
-	}
-	createdTime := time.Now()
-	createdTimeUnixNano := createdTime.UnixNano()
-	expiredTime := createdTime.Add(time.Duration(liveTime) * time.Second).UnixNano()
-
-	otcO := &pb.OtcOrder{
-		OrderNumber: "",
-		Side:        pb.OrderSide_ASK,
-		MemberId:    in.MemberId,
-		QuoteId:     in.QuoteId,
-		QuoteOwner:  q.Owner,
-		Price:       price64f,
-		Volume:      in.Volume,
-		Value:       in.Value,
-		Status:      pb.OtcOrder_UNPAID,
-		Time:        createdTimeUnixNano,
-		Instrument:  q.Instrument,
-		Fee:         fee,
-		ExpiredTime: expiredTime,
-	}
-
 	eventId := exutil.NewUUID()
+	sg := newSaga(eventId)
+	defer func() {
+		if err != nil {
+			sg.compensate()
+		}
+	}()
 	lr := &api.LockBalance{
 		FromAmount: big.NewInt(0),
 		ToAmount:   vol,
@@ -526,6 +415,9 @@ func (o OtcServer) DoSellQuote(ctx context.Context, in *pb.SellQuoteRequest) (ou
 		log.Errorf("failed to lock account balance %v", err)
 		return
 	}
+	sg.onFailure("lock balance", func(ctx context.Context) error {
+		return o.releaseOrderLock(ctx, otcO, q.GetInstrument().GetBase().GetId(), po.lockAmount, eventId)
+	})
 	//add pending
 	account, err := o.findQuoteAccount(ctx, q, q.Instrument.GetBase().GetId())
 	if err != nil {
@@ -536,16 +428,38 @@ func (o OtcServer) DoSellQuote(ctx context.Context, in *pb.SellQuoteRequest) (ou
 		log.Errorf("Sell quote add pending error: %v", err)
 		return nil, err
 	}
+	sg.onFailure("add pending", func(ctx context.Context) error {
+		return o.releasePending(ctx, account.GetId(), eventId, in.Volume)
+	})
 
-	//Update Quote volume and value
-	err = o.updateQuoteVolumeValueandFee(ctx, in.Volume, in.Value, "0", q, "CREATE")
-	if err != nil {
-		return
-	}
-	//create order
-	id, err := o.trades.CreateOtcOrder(ctx, otcO, eventId)
+	//Update Quote volume and value, create order
+	var id *pb.UUID
+	err = o.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		err := o.updateQuoteVolumeValueandFee(ctx, in.Volume, in.Value, fee, q, "CREATE")
+		if err != nil {
+			return err
+		}
+		if !repository.InTransaction(ctx) {
+			sg.onFailure("update quote", func(ctx context.Context) error {
+				return o.restoreQuote(ctx, q.Id, in.Volume, in.Value, fee)
+			})
+		}
+		id, err = o.trades.CreateOtcOrder(ctx, otcO, eventId)
+		if err != nil {
+			log.Errorf("Failed to create otc order for quote: %s, event: %s", exutil.UUIDtoA(in.QuoteId), exutil.UUIDtoA(eventId))
+			return err
+		}
+		err = o.trades.SetOtcOrderFees(ctx, id, po.fee.fees(otcO))
+		if err != nil {
+			return err
+		}
+		err = o.trades.SetOtcOrderPayment(ctx, id, payment)
+		if err != nil || fp == nil {
+			return err
+		}
+		return o.trades.SetOtcOrderPricing(ctx, id, fp.snapshot())
+	})
 	if err != nil {
-		log.Error("Failed to create otc order for quote: " + in.QuoteId.String())
 		return
 	}
 
@@ -557,24 +471,201 @@ func (o OtcServer) DoSellQuote(ctx context.Context, in *pb.SellQuoteRequest) (ou
 
 //Internal functions to support RPC functions
 
-func (o OtcServer) getOtcFeeRate(ctx context.Context, memberId *pb.UUID) (otcFeeRate *big.Float, err error) {
-	member, err := o.apis.FindMember(ctx, memberId)
+// pricedOrder is an order priced against a quote, with what the order member locks and receives
+type pricedOrder struct {
+	order *pb.OtcOrder
+	fee   orderFee
+	// lockCoin is nil when the member pays outside the platform and nothing is locked
+	lockCoin      *pb.CurrencyRef
+	lockAmount    string
+	receiveCoin   *pb.CurrencyRef
+	receiveAmount string
+}
+
+// priceOrder validates trading volume for value against a quote and builds the order the
+// member would place. The member takes the other side of the quote. Orders are placed and
+// previewed through here, so a preview is always what an order would be.
+func (o OtcServer) priceOrder(ctx context.Context, q *pb.Quote, memberId *pb.UUID, volume, value string, now time.Time) (po *pricedOrder, err error) {
+	if q.Status != pb.Quote_ON {
+		return nil, fmt.Errorf("Quote is not on shelf now :%s", q.Id.String())
+	}
+	err = o.checkTradingHours(ctx, q, now)
+	if err != nil {
+		return nil, err
+	}
+	err = o.checkListingExpiry(ctx, q, now)
 	if err != nil {
-		return big.NewFloat(feeRate), err
+		return nil, err
 	}
-	if member.GetOtcFeeRate() != "" {
-		rateFloat, err := strconv.ParseFloat(member.GetOtcFeeRate(), 64)
-		if err != nil {
-			return big.NewFloat(feeRate), err
+	err = o.checkEligibility(ctx, q, memberId, now)
+	if err != nil {
+		return nil, err
+	}
+	//validate value
+	valuef, err := fl(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value detected")
+	}
+	ret, err := o.validateOtcValue(valuef, q)
+	if !ret {
+		return nil, status.Errorf(codes.FailedPrecondition, "Invalid otc value: %v", err)
+	}
+	//validate volume
+	volumef, err := fl(volume)
+	if err != nil {
+		return nil, fmt.Errorf("invalid volume detected")
+	}
+	retVo, err := o.validateOtcVolume(volumef, q)
+	if !retVo {
+		return nil, status.Errorf(codes.FailedPrecondition, "Invalid otc volume %v", err)
+	}
+	//validate price
+	price64f, err := o.validateOtcPrice(value, volume, q)
+	if err != nil {
+		return nil, err
+	}
+
+	//expire time
+	if q.ExpireBy == 0 {
+		return nil, status.Errorf(codes.Internal, "Quote's expire time should not be 0, Quote Id : %s", exutil.UUIDtoA(q.Id))
+	}
+	expiredTime := now.Add(time.Duration(q.ExpireBy) * time.Second).UnixNano()
+
+	//fee
+	f, err := o.orderFeeOn(ctx, q, memberId, volume, value, volumef)
+	if err != nil {
+		return nil, err
+	}
+	po = &pricedOrder{
+		order: &pb.OtcOrder{
+			OrderNumber: "",
+			MemberId:    memberId,
+			QuoteOwner:  q.Owner,
+			QuoteId:     q.Id,
+			Price:       price64f,
+			Volume:      volume,
+			Value:       value,
+			Status:      pb.OtcOrder_UNPAID,
+			Time:        now.UnixNano(),
+			Instrument:  q.Instrument,
+			Fee:         f.total().String(),
+			ExpiredTime: expiredTime,
+		},
+		fee: f,
+	}
+	vol, _ := new(big.Int).SetString(volume, 10)
+	val, _ := new(big.Int).SetString(value, 10)
+	if q.Side == pb.OrderSide_ASK {
+		po.order.Side = pb.OrderSide_BID
+		if _, ok := externalCurrency[q.Instrument.Quote.Symbol]; !ok {
+			po.lockCoin, po.lockAmount = q.Instrument.Quote, new(big.Int).Add(val, f.lockedQuote()).String()
 		}
-		otcFeeRate = big.NewFloat(rateFloat)
+		po.receiveCoin, po.receiveAmount = q.Instrument.Base, new(big.Int).Sub(vol, f.deductedBase()).String()
 	} else {
-		otcFeeRate = big.NewFloat(feeRate)
+		po.order.Side = pb.OrderSide_ASK
+		po.lockCoin, po.lockAmount = q.Instrument.Base, new(big.Int).Add(vol, f.lockedBase()).String()
+		po.receiveCoin, po.receiveAmount = q.Instrument.Quote, new(big.Int).Sub(val, f.deductedQuote()).String()
 	}
+	return
+}
 
+// orderFeeOn works out the fee of each party of an order on the quote, as set by the fee
+// policy of the quote
+func (o OtcServer) orderFeeOn(ctx context.Context, q *pb.Quote, memberId *pb.UUID, volume, value string, volumef *big.Float) (f orderFee, err error) {
+	policy, err := o.quoteFeePolicy(ctx, q)
+	if err != nil {
+		return
+	}
+	amount, err := ParseMoney(volume)
+	if policy.Currency == repository.FeeCurrencyQuote {
+		amount, err = ParseMoney(value)
+	}
+	if err != nil {
+		return f, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	makerSells := q.Side == pb.OrderSide_ASK
+	makerFee, takerFee := new(big.Int), new(big.Int)
+	if policy.ChargesMaker() {
+		rate, err := o.getOtcFeeRate(ctx, q.Owner, q.Instrument, q.Side)
+		if err != nil {
+			return f, err
+		}
+		makerFee = partyFee(amount, rate, policy, makerSells)
+		//if buy all remained volume, fee = q lockedfee
+		if makerLocksFee(q.Side, policy) {
+			qvolume, err := fl(q.Volume)
+			if err != nil {
+				return f, fmt.Errorf("invalid quote volume detected")
+			}
+			if qvolume.Cmp(volumef) == 0 {
+				makerFee, _ = new(big.Int).SetString(q.LockedFee, 10)
+			}
+		}
+	}
+	if policy.ChargesTaker() {
+		rate, err := o.getOtcFeeRate(ctx, memberId, q.Instrument, q.Side)
+		if err != nil {
+			return f, err
+		}
+		takerFee = partyFee(amount, rate, policy, !makerSells)
+	}
+	f = orderFee{currency: policy.Currency, buyer: takerFee, seller: makerFee}
+	if !makerSells {
+		f.buyer, f.seller = makerFee, takerFee
+	}
 	return
 }
 
+// partyFee returns the fee of a party at rate on amount. A seller paying in the base locks
+// the fee on top of the volume, grossed up so that the fee is rate of all coin locked.
+func partyFee(amount Money, rate *big.Rat, policy repository.FeePolicy, seller bool) *big.Int {
+	if seller && policy.Currency == repository.FeeCurrencyBase {
+		return GrossUpFee(amount, rate)
+	}
+	return FeeOnVolume(amount, rate)
+}
+
+// makerLocksFee reports whether the maker fee is locked with quotes of side, which is when
+// the maker pays in the currency the quote locks
+func makerLocksFee(side pb.OrderSide, policy repository.FeePolicy) bool {
+	if !policy.ChargesMaker() {
+		return false
+	}
+	if side == pb.OrderSide_ASK {
+		return policy.Currency == repository.FeeCurrencyBase
+	}
+	return policy.Currency == repository.FeeCurrencyQuote
+}
+
+// getOtcFeeRate returns the fee rate of a member trading on a quote of side. A rate set on the member comes first,
+// then the fee schedule of the instrument and quote side in effect, then the default rate.
+func (o OtcServer) getOtcFeeRate(ctx context.Context, memberId *pb.UUID, inst *pb.InstrumentRef, side pb.OrderSide) (otcFeeRate *big.Rat, err error) {
+	member, err := o.apis.FindMember(ctx, memberId)
+	if err != nil {
+		return nil, err
+	}
+	if rate := member.GetOtcFeeRate(); rate != "" {
+		otcFeeRate, err = parseFeeRate(rate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid otc fee rate of member %s: %v", exutil.UUIDtoA(memberId), err)
+		}
+		return
+	}
+	now := time.Now()
+	schedule, err := o.effectiveFeeSchedule(ctx, inst, side, now)
+	if err != nil {
+		return nil, err
+	}
+	if schedule == nil {
+		return ParseRate(defaultFeeRate)
+	}
+	volume, err := o.trades.SumCompletedVolume(ctx, memberId, schedule.Instrument, now.Add(-feeVolumeWindow).UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	return tierRate(schedule, volume)
+}
+
 //Check if the value is in the range of the minValue and maxValue
 func (o OtcServer) validateOtcValue(val *big.Float, q *pb.Quote) (ret bool, err error) {
 	minVal, err := fl(q.MinValue)
@@ -607,6 +698,28 @@ func (o OtcServer) validateOtcValue(val *big.Float, q *pb.Quote) (ret bool, err
 	return
 }
 
+// validateOtcPrice checks the price of trading volume for value against the quote price,
+// within the price tolerance of the instrument. It returns the price as stored on orders.
+func (o OtcServer) validateOtcPrice(value, volume string, q *pb.Quote) (float64, error) {
+	val, err := ParseMoney(value)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid value detected: %v", err)
+	}
+	vol, err := ParseMoney(volume)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid volume detected: %v", err)
+	}
+	price, err := PriceOf(val, vol, q.Instrument)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	qPrice := QuotePrice(q)
+	if !price.Within(qPrice, o.conf.priceTolerance(q.Instrument)) {
+		return 0, status.Errorf(codes.FailedPrecondition, "Invalid price: Quote Price: %s, Order Price: %s", qPrice, price)
+	}
+	return price.UnitPrice(q.Instrument), nil
+}
+
 //Check if order's volume is less than the quote remained volume
 func (o OtcServer) validateOtcVolume(vol *big.Float, q *pb.Quote) (ret bool, err error) {
 	qVol, err := fl(q.Volume)
@@ -623,7 +736,28 @@ func (o OtcServer) validateOtcVolume(vol *big.Float, q *pb.Quote) (ret bool, err
 }
 
 //Sub Quote volume value and fee when there is some action of a otc order action includes: CANCEL,CREATE,COMPLETE,EXPIRE
+//q may be stale: the update only applies to the quote values it was computed from, and is
+//recomputed from a fresh copy of the quote when another order got there first.
 func (o OtcServer) updateQuoteVolumeValueandFee(ctx context.Context, orderVolume, orderValue, orderFee string, q *pb.Quote, orderAction string) (err error) {
+	quoteId := q.Id
+	for i := 0; i < maxQuoteUpdateRetries; i++ {
+		err = o.compareAndUpdateQuote(ctx, orderVolume, orderValue, orderFee, q, orderAction)
+		if err != repository.ErrQuoteModified {
+			return
+		}
+		log.Infof("quote %s modified concurrently on %s, retrying", exutil.UUIDtoA(quoteId), orderAction)
+		q, err = o.quotes.GetQuote(ctx, quoteId)
+		if err != nil {
+			return status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(quoteId))
+		}
+		if orderAction == "CREATE" && q.Status != pb.Quote_ON {
+			return status.Errorf(codes.FailedPrecondition, "quote %s is not on the shelf", exutil.UUIDtoA(quoteId))
+		}
+	}
+	return status.Errorf(codes.Aborted, "quote %s is busy, please try again", exutil.UUIDtoA(quoteId))
+}
+
+func (o OtcServer) compareAndUpdateQuote(ctx context.Context, orderVolume, orderValue, orderFee string, q *pb.Quote, orderAction string) (err error) {
 	orderVolumeInt, ok := new(big.Int).SetString(orderVolume, 10)
 	if !ok {
 		return fmt.Errorf("can not transfer orderVolume to int %s", orderVolume)
@@ -662,16 +796,19 @@ func (o OtcServer) updateQuoteVolumeValueandFee(ctx context.Context, orderVolume
 		updatedVolume = new(big.Int).Add(qVolume, orderVolumeInt).String()
 		updatedValue = new(big.Int).Add(qValue, orderValueInt).String()
 		updatedProcessingVolume = new(big.Int).Sub(qProcessingVolume, orderVolumeInt).String()
-		if q.Side == pb.OrderSide_ASK {
-			updatedFee = new(big.Int).Add(qLockedFee, orderFeeInt).String()
-		}
+		updatedFee = new(big.Int).Add(qLockedFee, orderFeeInt).String()
 	case "CREATE":
-		updatedVolume = new(big.Int).Sub(qVolume, orderVolumeInt).String()
-		updatedValue = new(big.Int).Sub(qValue, orderValueInt).String()
-		updatedProcessingVolume = new(big.Int).Add(qProcessingVolume, orderVolumeInt).String()
-		if q.Side == pb.OrderSide_ASK {
-			updatedFee = new(big.Int).Sub(qLockedFee, orderFeeInt).String()
+		remainingVolume := new(big.Int).Sub(qVolume, orderVolumeInt)
+		remainingValue := new(big.Int).Sub(qValue, orderValueInt)
+		remainingFee := new(big.Int).Sub(qLockedFee, orderFeeInt)
+		if remainingVolume.Sign() < 0 || remainingValue.Sign() < 0 || remainingFee.Sign() < 0 {
+			return status.Errorf(codes.FailedPrecondition, "quote %s is exhausted: remaining volume %s, value %s, order volume %s, value %s",
+				exutil.UUIDtoA(q.Id), q.Volume, q.Value, orderVolume, orderValue)
 		}
+		updatedVolume = remainingVolume.String()
+		updatedValue = remainingValue.String()
+		updatedProcessingVolume = new(big.Int).Add(qProcessingVolume, orderVolumeInt).String()
+		updatedFee = remainingFee.String()
 	case "COMPLETE":
 		updatedVolume = q.Volume
 		updatedValue = q.Value
@@ -685,12 +822,73 @@ func (o OtcServer) updateQuoteVolumeValueandFee(ctx context.Context, orderVolume
 	if updatedFee != "" {
 		fields["lockedFee"] = updatedFee
 	}
+	expected := bson.M{"value": q.Value, "volume": q.Volume, "processingVolume": q.ProcessingVolume, "lockedFee": q.LockedFee}
+	if orderAction == "CREATE" {
+		// a quote paused or closed meanwhile takes no more orders
+		expected["status"] = pb.Quote_ON
+	}
 
-	return o.quotes.UpdateQuote(ctx, q.Id, fields)
+	return o.quotes.CompareAndUpdateQuote(ctx, q.Id, expected, fields)
+}
+
+// restoreQuote puts the volume, value and fee taken by an order back onto its quote
+func (o OtcServer) restoreQuote(ctx context.Context, quoteId *pb.UUID, orderVolume, orderValue, orderFee string) (err error) {
+	q, err := o.quotes.GetQuote(ctx, quoteId)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(quoteId))
+	}
+	return o.updateQuoteVolumeValueandFee(ctx, orderVolume, orderValue, orderFee, q, "CANCEL")
+}
 
+// releaseOrderLock returns the amount locked for an order back to the order member's own account
+func (o OtcServer) releaseOrderLock(ctx context.Context, order *pb.OtcOrder, coinId *pb.UUID, amount string, eventId *pb.UUID) (err error) {
+	orderAccount, err := o.findOrderAccount(ctx, order, coinId)
+	if err != nil {
+		log.Errorf(err.Error())
+		return
+	}
+	req := &pb.ReleaseLockedBalanceRequest{
+		From:   orderAccount.Id,
+		To:     orderAccount.Id,
+		Amount: amount,
+		Order: &pb.OrderRef{
+			Id: order.Id,
+		},
+		Event: &pb.OrderEvent{
+			Id: eventId,
+		},
+	}
+	err = o.apis.ReleaselockedBalance(ctx, req)
+	if err != nil {
+		log.Errorf("fail to release locked balance: %v", err)
+	}
+	return
 }
 
 func (o OtcServer) payOrder(ctx context.Context, order *pb.OtcOrder, eventId *pb.UUID) (err error) {
+	amount, err := o.valueToSeller(ctx, order)
+	if err != nil {
+		return err
+	}
+	return o.payValue(ctx, order, amount, eventId)
+}
+
+// valueToSeller is the order value less the seller fee taken from it, which stays locked
+// with the buyer until the coin is released
+func (o OtcServer) valueToSeller(ctx context.Context, order *pb.OtcOrder) (string, error) {
+	f, err := o.loadOrderFee(ctx, order)
+	if err != nil {
+		return "", err
+	}
+	value, ok := new(big.Int).SetString(order.Value, 10)
+	if !ok {
+		return "", fmt.Errorf("can not transfer order value to int %s", order.Value)
+	}
+	return value.Sub(value, f.deductedQuote()).String(), nil
+}
+
+// payValue moves amount of the locked order value from the buyer to the seller
+func (o OtcServer) payValue(ctx context.Context, order *pb.OtcOrder, amount string, eventId *pb.UUID) (err error) {
 	//if NOT CNY
 	//Bid Quote Currency Account --> Ask Quote Currency Account
 	if _, ok := externalCurrency[order.Instrument.Quote.Symbol]; !ok {
@@ -724,7 +922,7 @@ func (o OtcServer) payOrder(ctx context.Context, order *pb.OtcOrder, eventId *pb
 		req := &pb.ReleaseLockedBalanceRequest{
 			From:   fromAccountID,
 			To:     toAccountID,
-			Amount: order.Value,
+			Amount: amount,
 			Order: &pb.OrderRef{
 				Id: order.Id,
 			},
@@ -742,6 +940,15 @@ func (o OtcServer) payOrder(ctx context.Context, order *pb.OtcOrder, eventId *pb
 }
 
 func (o OtcServer) releaseCoin(ctx context.Context, order *pb.OtcOrder, eventId *pb.UUID) (err error) {
+	f, err := o.loadOrderFee(ctx, order)
+	if err != nil {
+		return err
+	}
+	return o.transferCoin(ctx, order, order.Volume, f, eventId)
+}
+
+// transferCoin moves volume of the locked order coin from the seller to the buyer and collects fee
+func (o OtcServer) transferCoin(ctx context.Context, order *pb.OtcOrder, volume string, f orderFee, eventId *pb.UUID) (err error) {
 	//ASK Base Currency Account --> BID Base Currency Account
 
 	var fromAccountID, toAccountID *pb.UUID
@@ -763,25 +970,19 @@ func (o OtcServer) releaseCoin(ctx context.Context, order *pb.OtcOrder, eventId
 		log.Errorf("Can not find quote account %v", q.Id)
 		return err
 	}
-	var transferAmount string
-	orderFee, ok := new(big.Int).SetString(order.Fee, 10)
-	if !ok {
-		return fmt.Errorf("can not transfer order fee to int %s", q.Volume)
-	}
-	orderVolume, ok := new(big.Int).SetString(order.Volume, 10)
+	orderVolume, ok := new(big.Int).SetString(volume, 10)
 	if !ok {
-		return fmt.Errorf("can not transfer order volume to int %s", q.Volume)
+		return fmt.Errorf("can not transfer order volume to int %s", volume)
 	}
 	if order.Side == pb.OrderSide_ASK {
 		fromAccountID = orderAccount.Id
 		toAccountID = quoteAccount.Id
-		//fee
-		transferAmount = new(big.Int).Sub(orderVolume, orderFee).String()
 	} else {
 		fromAccountID = quoteAccount.Id
 		toAccountID = orderAccount.Id
-		transferAmount = order.Volume
 	}
+	//fee
+	transferAmount := new(big.Int).Sub(orderVolume, f.deductedBase()).String()
 
 	req := &pb.ReleaseLockedBalanceRequest{
 		From:   fromAccountID,
@@ -799,74 +1000,146 @@ func (o OtcServer) releaseCoin(ctx context.Context, order *pb.OtcOrder, eventId
 		log.Error("fail to release locked value")
 		return
 	}
-	if orderFee.Int64() != 0 {
-		req := &pb.ReleaseLockedBalanceRequest{
-			From:   fromAccountID,
-			To:     nil,
-			Amount: order.Fee,
-			Order: &pb.OrderRef{
-				Id: order.Id,
-			},
-			Event: &pb.OrderEvent{
-				Id: exutil.NewUUID(),
-			},
+
+	feeAccountID := fromAccountID
+	if f.currency == repository.FeeCurrencyQuote {
+		// quote currency fees are locked with the value of the buyer
+		var acc *pb.AccountDefined
+		if order.Side == pb.OrderSide_ASK {
+			acc, err = o.findQuoteAccount(ctx, q, q.Instrument.Quote.Id)
+		} else {
+			acc, err = o.findOrderAccount(ctx, order, order.Instrument.Quote.Id)
 		}
-		err = o.apis.ReleaselockedBalance(ctx, req)
 		if err != nil {
-			log.Error("fail to release fee")
-			return
+			return err
 		}
+		feeAccountID = acc.Id
 	}
+	return o.collectFee(ctx, order, feeAccountID, f, q)
+}
 
+// unlockOrder returns the balance locked when the order was placed to the order member
+func (o OtcServer) unlockOrder(ctx context.Context, order *pb.OtcOrder, eventId *pb.UUID) (err error) {
+	coinId, locked, err := o.orderLock(ctx, order)
+	if err != nil || coinId == nil {
+		return err
+	}
+	return o.releaseOrderLock(ctx, order, coinId, locked.String(), eventId)
+}
+
+// relockOrder locks again what unlockOrder released
+func (o OtcServer) relockOrder(ctx context.Context, order *pb.OtcOrder, eventId *pb.UUID) (err error) {
+	coinId, locked, err := o.orderLock(ctx, order)
+	if err != nil || coinId == nil {
+		return err
+	}
+	return o.lockOrderBalance(ctx, order, coinId, locked, eventId)
+}
+
+// lockOrderBalance locks amount of the order member's coin for order, undoing releaseOrderLock
+func (o OtcServer) lockOrderBalance(ctx context.Context, order *pb.OtcOrder, coinId *pb.UUID, amount *big.Int, eventId *pb.UUID) error {
+	return o.apis.LockAccountBalance(ctx, &api.LockBalance{
+		FromAmount: big.NewInt(0),
+		ToAmount:   amount,
+		MemberId:   order.MemberId,
+		CoinId:     coinId,
+		ActivityId: eventId,
+		Source:     pb.ActivitySource_ORDER,
+	})
+}
+
+// orderLock returns the coin and amount the order member locked for order, a nil coin if
+// nothing was locked
+func (o OtcServer) orderLock(ctx context.Context, order *pb.OtcOrder) (coinId *pb.UUID, locked *big.Int, err error) {
+	if _, ok := externalCurrency[order.Instrument.Quote.Symbol]; ok && order.Side == pb.OrderSide_BID {
+		return
+	}
+	f, err := o.loadOrderFee(ctx, order)
+	if err != nil {
+		return
+	}
+	var amount string
+	if order.Side == pb.OrderSide_ASK {
+		coinId = order.GetInstrument().GetBase().Id
+		amount = order.Volume
+	} else {
+		coinId = order.GetInstrument().GetQuote().Id
+		amount = order.Value
+	}
+	locked, _ = new(big.Int).SetString(amount, 10)
+	locked.Add(locked, f.onOrder(order))
 	return
 }
 
-func (o OtcServer) expireOrder(ctx context.Context, order *pb.OtcOrder, eventId *pb.UUID) (err error) {
-	//Release locked account of the for Expirement
-	if _, ok := externalCurrency[order.Instrument.Quote.Symbol]; !(ok && order.Side == pb.OrderSide_BID) {
-		var coinId *pb.UUID
-		var amount string
-		if order.Side == pb.OrderSide_ASK {
-			coinId = order.GetInstrument().GetBase().Id
-			amount = order.Volume
-		} else {
-			coinId = order.GetInstrument().GetQuote().Id
-			amount = order.Value
+// runOrderHook runs a side effect of an order status transition
+func (o OtcServer) runOrderHook(ctx context.Context, hook orderstate.Hook, order *pb.OtcOrder, eventId *pb.UUID) error {
+	switch hook {
+	case orderstate.HookPay:
+		return o.payOrder(ctx, order, eventId)
+	case orderstate.HookRefund:
+		return o.refundOrder(ctx, order, eventId)
+	case orderstate.HookReleaseCoin:
+		return o.releaseCoin(ctx, order, eventId)
+	case orderstate.HookReleaseLock:
+		return o.unlockOrder(ctx, order, eventId)
+	case orderstate.HookReleasePending:
+		return o.releasePendingPro(ctx, order)
+	case orderstate.HookQuoteComplete:
+		q, err := o.quotes.GetQuote(ctx, order.QuoteId)
+		if err != nil {
+			return status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(order.QuoteId))
 		}
-
-		orderAccount, err := o.findOrderAccount(ctx, order, coinId)
+		return o.updateQuoteVolumeValueandFee(ctx, order.Volume, order.Value, "0", q, "COMPLETE")
+	case orderstate.HookQuoteRestore:
+		f, err := o.loadOrderFee(ctx, order)
 		if err != nil {
-			log.Errorf(err.Error())
 			return err
 		}
-		req := &pb.ReleaseLockedBalanceRequest{
-			From:   orderAccount.Id,
-			To:     orderAccount.Id,
-			Amount: amount,
-			Order: &pb.OrderRef{
-				Id: order.Id,
-			},
-			Event: &pb.OrderEvent{
-				Id: eventId,
-			},
+		return o.restoreQuote(ctx, order.QuoteId, order.Volume, order.Value, f.onQuote(order).String())
+	case orderstate.HookSettleAppeal:
+		// needs the outcome chosen by the arbitrator
+		return status.Errorf(codes.FailedPrecondition, "appealed order %s must be settled with DoResolveAppeal", exutil.UUIDtoA(order.Id))
+	}
+	return fmt.Errorf("unknown order hook %d", hook)
+}
+
+// undoOrderHook returns the compensation of a hook which has run, nil if it cannot be undone
+func (o OtcServer) undoOrderHook(hook orderstate.Hook, order *pb.OtcOrder, eventId *pb.UUID) func(ctx context.Context) error {
+	switch hook {
+	case orderstate.HookPay:
+		return func(ctx context.Context) error {
+			return o.refundOrder(ctx, order, eventId)
 		}
-		err = o.apis.ReleaselockedBalance(ctx, req)
-		if err != nil {
-			log.Error("fail to release locked balance: %s", err.Error())
-			return err
+	case orderstate.HookRefund:
+		return func(ctx context.Context) error {
+			return o.payOrder(ctx, order, eventId)
+		}
+	case orderstate.HookReleaseLock:
+		return func(ctx context.Context) error {
+			return o.relockOrder(ctx, order, eventId)
+		}
+	case orderstate.HookReleasePending:
+		return func(ctx context.Context) error {
+			account, err := o.findPendingAccount(ctx, order)
+			if err != nil {
+				return err
+			}
+			return o.addPending(ctx, account.GetId(), eventId, order.Volume)
 		}
 	}
-	//release pending
-	err = o.releasePendingPro(ctx, order)
+	return nil
+}
+
+func (o OtcServer) refundOrder(ctx context.Context, order *pb.OtcOrder, eventId *pb.UUID) (err error) {
+	amount, err := o.valueToSeller(ctx, order)
 	if err != nil {
-		log.Errorf("release pending error: %v", err)
-		return
+		return err
 	}
-
-	return
+	return o.refundValue(ctx, order, amount, eventId)
 }
 
-func (o OtcServer) refundOrder(ctx context.Context, order *pb.OtcOrder, eventId *pb.UUID) (err error) {
+// refundValue moves amount of the paid order value back from the seller to the buyer and locks it again
+func (o OtcServer) refundValue(ctx context.Context, order *pb.OtcOrder, amount string, eventId *pb.UUID) (err error) {
 	if _, ok := externalCurrency[order.Instrument.Quote.Symbol]; ok {
 		return
 	}
@@ -903,7 +1176,10 @@ func (o OtcServer) refundOrder(ctx context.Context, order *pb.OtcOrder, eventId
 	}
 
 	//lock
-	val, err := exutil.DecodeBigInt(order.Value)
+	val, err := exutil.DecodeBigInt(amount)
+	if err != nil {
+		return
+	}
 	lr := &api.LockBalance{
 		FromAmount: big.NewInt(0),
 		ToAmount:   val,
@@ -974,29 +1250,34 @@ func (o OtcServer) releasePending(ctx context.Context, accountId, orderId *pb.UU
 }
 
 func (o OtcServer) releasePendingPro(ctx context.Context, order *pb.OtcOrder) (err error) {
+	return o.releaseOrderPending(ctx, order, order.Volume)
+}
+
+// releaseOrderPending releases volume of the pending amount added for the buyer of an order
+func (o OtcServer) releaseOrderPending(ctx context.Context, order *pb.OtcOrder, volume string) (err error) {
 	eventId := exutil.NewUUID()
-	var account *pb.AccountDefined
-	if order.Side == pb.OrderSide_ASK {
-		//if order is on selling side , release buyer's pending -- quote owner's pending
-		var q *pb.Quote
-		q, err = o.quotes.GetQuote(ctx, order.QuoteId)
-		if err != nil {
-			return status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(order.QuoteId))
-		}
-		account, err = o.findQuoteAccount(ctx, q, order.Instrument.GetBase().GetId())
-		if err != nil {
-			return
-		}
-	} else {
-		account, err = o.findOrderAccount(ctx, order, order.Instrument.GetBase().GetId())
-		if err != nil {
-			return
-		}
+	account, err := o.findPendingAccount(ctx, order)
+	if err != nil {
+		return
 	}
-	err = o.releasePending(ctx, account.GetId(), eventId, order.Volume)
+	err = o.releasePending(ctx, account.GetId(), eventId, volume)
 	if err != nil {
 		log.Errorf("Release pending error: %v", err)
 		return err
 	}
 	return
 }
+
+// findPendingAccount returns the base currency account of the buyer of an order, which
+// holds the pending amount of the order
+func (o OtcServer) findPendingAccount(ctx context.Context, order *pb.OtcOrder) (*pb.AccountDefined, error) {
+	if order.Side == pb.OrderSide_BID {
+		return o.findOrderAccount(ctx, order, order.Instrument.GetBase().GetId())
+	}
+	//if order is on selling side , release buyer's pending -- quote owner's pending
+	q, err := o.quotes.GetQuote(ctx, order.QuoteId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed to find requested quote id: %v", exutil.UUIDtoA(order.QuoteId))
+	}
+	return o.findQuoteAccount(ctx, q, order.Instrument.GetBase().GetId())
+}
@@ -36,6 +36,51 @@ func (m *MockApi) EXPECT() *MockApiMockRecorder {
 	return m.recorder
 }
 
+// AddPending mocks base method
+func (m *MockApi) AddPending(arg0 context.Context, arg1 *protogo.AddPendingRequest) (*protogo.AddPendingResponse, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddPending", arg0, arg1)
+	ret0, _ := ret[0].(*protogo.AddPendingResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AddPending indicates an expected call of AddPending
+func (mr *MockApiMockRecorder) AddPending(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddPending", reflect.TypeOf((*MockApi)(nil).AddPending), arg0, arg1)
+}
+
+// FindInstrument mocks base method
+func (m *MockApi) FindInstrument(arg0 context.Context, arg1 string) (*protogo.Instrument, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindInstrument", arg0, arg1)
+	ret0, _ := ret[0].(*protogo.Instrument)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindInstrument indicates an expected call of FindInstrument
+func (mr *MockApiMockRecorder) FindInstrument(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindInstrument", reflect.TypeOf((*MockApi)(nil).FindInstrument), arg0, arg1)
+}
+
+// FindMember mocks base method
+func (m *MockApi) FindMember(arg0 context.Context, arg1 *protogo.UUID) (*protogo.MemberDefined, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindMember", arg0, arg1)
+	ret0, _ := ret[0].(*protogo.MemberDefined)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindMember indicates an expected call of FindMember
+func (mr *MockApiMockRecorder) FindMember(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindMember", reflect.TypeOf((*MockApi)(nil).FindMember), arg0, arg1)
+}
+
 // FindMemberAccount mocks base method
 func (m *MockApi) FindMemberAccount(arg0 context.Context, arg1, arg2 *protogo.UUID) ([]*protogo.AccountDefined, error) {
 	m.ctrl.T.Helper()
@@ -65,6 +110,21 @@ func (mr *MockApiMockRecorder) LockAccountBalance(arg0, arg1 interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LockAccountBalance", reflect.TypeOf((*MockApi)(nil).LockAccountBalance), arg0, arg1)
 }
 
+// ReleasePending mocks base method
+func (m *MockApi) ReleasePending(arg0 context.Context, arg1 *protogo.ReleasePendingRequest) (*protogo.ReleasePendingResponse, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleasePending", arg0, arg1)
+	ret0, _ := ret[0].(*protogo.ReleasePendingResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReleasePending indicates an expected call of ReleasePending
+func (mr *MockApiMockRecorder) ReleasePending(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleasePending", reflect.TypeOf((*MockApi)(nil).ReleasePending), arg0, arg1)
+}
+
 // ReleaselockedBalance mocks base method
 func (m *MockApi) ReleaselockedBalance(arg0 context.Context, arg1 *protogo.ReleaseLockedBalanceRequest) error {
 	m.ctrl.T.Helper()
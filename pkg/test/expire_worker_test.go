@@ -0,0 +1,253 @@
+package test
+
+import (
+	"bytes"
+	context "context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/spf13/viper"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	rpcapi "gitlab.com/sdce/service/otc/pkg/api"
+	"gitlab.com/sdce/service/otc/pkg/expireworker"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"gitlab.com/sdce/service/otc/pkg/rpc"
+	"google.golang.org/grpc/metadata"
+	"gotest.tools/assert"
+)
+
+// fakeOtcApi records the status updates of the worker, failing the ones of order fail
+type fakeOtcApi struct {
+	updates []*pb.UpdateOtcOrderStatusRequest
+	fail    *pb.UUID
+}
+
+func (f *fakeOtcApi) UpdateOrder(ctx context.Context, in *pb.UpdateOtcOrderStatusRequest) error {
+	f.updates = append(f.updates, in)
+	if f.fail != nil && bytes.Equal(f.fail.Bytes, in.OrderId.Bytes) {
+		return errors.New("otc unavailable")
+	}
+	return nil
+}
+
+func (f *fakeOtcApi) DeleteQuote(ctx context.Context, in *pb.DeleteQuoteRequest) error {
+	return nil
+}
+
+// fakeNotifier records the orders warned, failing to warn order fail
+type fakeNotifier struct {
+	warned []*pb.UUID
+	fail   *pb.UUID
+}
+
+func (f *fakeNotifier) ReleaseDeadlineWarning(ctx context.Context, order *pb.OtcOrder) error {
+	f.warned = append(f.warned, order.Id)
+	if f.fail != nil && bytes.Equal(f.fail.Bytes, order.Id.Bytes) {
+		return errors.New("messaging unavailable")
+	}
+	return nil
+}
+
+func containsId(ids []*pb.UUID, id *pb.UUID) bool {
+	for _, i := range ids {
+		if bytes.Equal(i.Bytes, id.Bytes) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReleaseDeadline(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, member, coin *pb.UUID) ([]*pb.AccountDefined, error) {
+		return []*pb.AccountDefined{{Id: member, Owner: member, Currency: BTCRef}}, nil
+	}).AnyTimes()
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	api.EXPECT().ReleaselockedBalance(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	api.EXPECT().AddPending(gomock.Any(), gomock.Any()).Return(&pb.AddPendingResponse{}, nil).AnyTimes()
+	api.EXPECT().ReleasePending(gomock.Any(), gomock.Any()).Return(&pb.ReleasePendingResponse{}, nil).AnyTimes()
+	v := viper.New()
+	v.Set("otc.releaseTimeout", time.Hour)
+	conf, err := rpc.GetConfig(v)
+	assert.NilError(t, err)
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	rpcServer.SetConfig(conf)
+	setUpBank(ctx, t, rpcServer, user1)
+	trades := repository.NewOtcTradeRepository(db)
+
+	res, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: &pb.Quote{
+		Instrument:             FakeInstrumentRef,
+		Price:                  0.001,
+		Side:                   pb.OrderSide_ASK,
+		Owner:                  user1,
+		Type:                   pb.Quote_REGULAR,
+		Volume:                 "100000000",
+		MinValue:               "1000",
+		MaxValue:               "100000",
+		ExpireBy:               1800,
+		AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+	}})
+	assert.NilError(t, err)
+	buyerCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user2)))
+	var orderIds []*pb.UUID
+	for i := 0; i < 4; i++ {
+		bo, err := rpcServer.DoBuyQuote(ctx, &pb.BuyQuoteRequest{
+			QuoteId:   res.Id,
+			MemberId:  user2,
+			AccountId: user2,
+			Method:    pb.PaymentMethod_BANK,
+			Volume:    "10000000",
+			Value:     "10000",
+		})
+		assert.NilError(t, err)
+		orderIds = append(orderIds, bo.OrderId)
+	}
+	// the last order stays unpaid and has no deadline
+	paidAt := time.Now()
+	for _, id := range orderIds[:3] {
+		_, err = rpcServer.DoUpdateOrder(buyerCtx, &pb.UpdateOtcOrderStatusRequest{OrderId: id, Status: pb.OtcOrder_PAID})
+		assert.NilError(t, err)
+	}
+
+	// paying stamps a deadline of the release timeout
+	due := func(before time.Time) (ids []*pb.UUID) {
+		orders, err := trades.SearchUnwarnedPaidOrders(ctx, before.UnixNano())
+		assert.NilError(t, err)
+		for _, o := range orders {
+			ids = append(ids, o.Id)
+		}
+		return
+	}
+	assert.Equal(t, 0, len(due(paidAt.Add(59*time.Minute))))
+	ids := due(time.Now().Add(time.Hour))
+	assert.Equal(t, 3, len(ids))
+	assert.Assert(t, !containsId(ids, orderIds[3]))
+	overdue, err := trades.SearchOverduePaidOrders(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(overdue))
+
+	// nothing is due within a warning shorter than the timeout
+	otc := &fakeOtcApi{}
+	notifier := &fakeNotifier{}
+	worker := expireworker.NewExpireCheckService(otc, api, db, expireworker.Config{ReleaseWarning: 30 * time.Minute, RebateSettlement: "@hourly"})
+	worker.SetNotifier(notifier)
+	worker.CheckExpiry(ctx)
+	assert.Equal(t, 0, len(notifier.warned))
+	assert.Equal(t, 0, len(otc.updates))
+
+	// the first order is due soon, the other two are overdue. The orders failing to be warned
+	// or appealed do not stop the others.
+	for _, id := range orderIds[1:3] {
+		assert.NilError(t, trades.SetReleaseDeadline(ctx, id, time.Now().Add(-time.Minute).UnixNano()))
+	}
+	otc = &fakeOtcApi{fail: orderIds[1]}
+	notifier = &fakeNotifier{fail: orderIds[0]}
+	worker = expireworker.NewExpireCheckService(otc, api, db, expireworker.Config{ReleaseWarning: 2 * time.Hour, RebateSettlement: "@hourly"})
+	worker.SetNotifier(notifier)
+	worker.CheckExpiry(ctx)
+	assert.Equal(t, 3, len(notifier.warned))
+	assert.Equal(t, 2, len(otc.updates))
+	for _, u := range otc.updates {
+		assert.Equal(t, pb.OtcOrder_APPEAL, u.Status)
+		assert.Assert(t, containsId(orderIds[1:3], u.OrderId))
+	}
+	// only the order which failed is warned again
+	ids = due(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, 1, len(ids))
+	assert.Assert(t, containsId(ids, orderIds[0]))
+}
+
+func TestSettleRebates(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	// user4 owns the fee accounts, user3 has no account. Accounts have the id of their owner.
+	api.EXPECT().FindMemberAccount(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, member, coin *pb.UUID) ([]*pb.AccountDefined, error) {
+		if bytes.Equal(member.Bytes, user3.Bytes) {
+			return nil, nil
+		}
+		return []*pb.AccountDefined{{Id: member, Owner: member, Currency: BTCRef}}, nil
+	}).AnyTimes()
+	var locks []*rpcapi.LockBalance
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, lr *rpcapi.LockBalance) error {
+		locks = append(locks, lr)
+		return nil
+	}).AnyTimes()
+	// the first payout of 300 fails
+	var payouts []*pb.ReleaseLockedBalanceRequest
+	failed := false
+	api.EXPECT().ReleaselockedBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, req *pb.ReleaseLockedBalanceRequest) error {
+		payouts = append(payouts, req)
+		if req.Amount == "300" && !failed {
+			failed = true
+			return errors.New("accounts unavailable")
+		}
+		return nil
+	}).AnyTimes()
+
+	rebates := repository.NewRebateLedgerRepo(db)
+	for _, e := range []*repository.RebateEntry{
+		{FeeEventId: exutil.NewUUID(), Referrer: user1, Referee: user2, CoinId: BTCRef.Id, Currency: "BTC", Amount: "200", Time: 100},
+		{FeeEventId: exutil.NewUUID(), Referrer: user1, Referee: user2, CoinId: BTCRef.Id, Currency: "BTC", Amount: "300", Time: 200},
+		{FeeEventId: exutil.NewUUID(), Referrer: user3, Referee: user2, CoinId: BTCRef.Id, Currency: "BTC", Amount: "400", Time: 300},
+	} {
+		assert.NilError(t, rebates.AccrueRebate(ctx, e))
+	}
+
+	worker := expireworker.NewExpireCheckService(&fakeOtcApi{}, api, db, expireworker.Config{RebateSettlement: "@hourly"})
+	assert.ErrorContains(t, worker.SettleRebates(ctx), "fee account owner")
+	assert.Equal(t, 0, len(payouts))
+
+	worker = expireworker.NewExpireCheckService(&fakeOtcApi{}, api, db, expireworker.Config{RebateSettlement: "@hourly", FeeAccountOwner: user4})
+	assert.ErrorContains(t, worker.SettleRebates(ctx), "1 of 3 rebates not paid")
+	assert.Equal(t, 2, len(payouts))
+	for i, p := range payouts {
+		assert.Assert(t, bytes.Equal(user4.Bytes, p.From.Bytes))
+		assert.Assert(t, bytes.Equal(user1.Bytes, p.To.Bytes))
+		assert.Assert(t, bytes.Equal(user4.Bytes, locks[i].MemberId.Bytes))
+		assert.Assert(t, bytes.Equal(p.Event.Id.Bytes, locks[i].ActivityId.Bytes))
+	}
+	paid, _, err := rebates.SearchRebates(ctx, &repository.RebateFilter{Status: repository.RebatePaid})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(paid))
+	assert.Equal(t, "200", paid[0].Amount)
+	assert.Assert(t, bytes.Equal(payouts[0].Event.Id.Bytes, paid[0].PayoutId.Bytes))
+
+	// the failed payout is retried with the same event, the rebate without an account waits
+	assert.NilError(t, worker.SettleRebates(ctx))
+	assert.Equal(t, 3, len(payouts))
+	assert.Equal(t, "300", payouts[2].Amount)
+	assert.Assert(t, bytes.Equal(payouts[1].Event.Id.Bytes, payouts[2].Event.Id.Bytes))
+	unpaid, err := rebates.SearchUnpaidRebates(ctx, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(unpaid))
+	assert.Equal(t, "400", unpaid[0].Amount)
+}
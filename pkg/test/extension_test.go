@@ -0,0 +1,44 @@
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"gitlab.com/sdce/service/otc/pkg/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gotest.tools/assert"
+)
+
+func TestExtensionService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	rpc.RegisterOtcTradingExtensionServer(gs, &rpc.OtcServer{})
+	go gs.Serve(lis)
+	defer gs.Stop()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithInsecure(), grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	// requests are decoded and reach the server, which rejects this one before using the database
+	adminCtx := metadata.AppendToOutgoingContext(ctx, orderstate.ActorRoleHeader, string(orderstate.RoleAdmin))
+	err = conn.Invoke(adminCtx, "/"+rpc.ExtensionServiceName+"/DoResolveAppeal", &rpc.ResolveAppealRequest{Reason: "no arbitrator"},
+		&rpc.ResolveAppealResponse{}, grpc.CallContentSubtype(rpc.ExtensionContentSubtype))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "arbitrator is required", status.Convert(err).Message())
+
+	err = conn.Invoke(ctx, "/"+rpc.ExtensionServiceName+"/DoNothing", &rpc.ResolveAppealRequest{},
+		&rpc.ResolveAppealResponse{}, grpc.CallContentSubtype(rpc.ExtensionContentSubtype))
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
@@ -0,0 +1,52 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"gotest.tools/assert"
+)
+
+func TestFeeLedgerSum(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+	repo := repository.NewFeeLedgerRepo(db)
+
+	eventId := exutil.NewUUID()
+	entries := []*repository.FeeLedgerEntry{
+		{EventId: eventId, Payer: user1, Currency: "BTC", Instrument: "btc-cny", Amount: "200000", Time: 100, Day: "2019-03-01"},
+		{EventId: exutil.NewUUID(), Payer: user2, Currency: "BTC", Instrument: "btc-cny", Amount: "300000", Time: 200, Day: "2019-03-01"},
+		{EventId: exutil.NewUUID(), Payer: user1, Currency: "ETH", Instrument: "eth-cny", Amount: "5", Time: 300, Day: "2019-03-02"},
+	}
+	for _, e := range entries {
+		assert.NilError(t, repo.RecordFee(ctx, e))
+	}
+	// the same fee event is booked once
+	assert.NilError(t, repo.RecordFee(ctx, &repository.FeeLedgerEntry{EventId: eventId, Payer: user1, Currency: "BTC", Amount: "200000"}))
+
+	byDay, err := repo.SumFees(ctx, &repository.FeeLedgerFilter{}, repository.FeeRevenueByDay)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(byDay))
+	assert.Equal(t, "2019-03-01", byDay[0].Key)
+	assert.Equal(t, "500000", byDay[0].Amount)
+	assert.Equal(t, int64(2), byDay[0].Count)
+
+	byMember, err := repo.SumFees(ctx, &repository.FeeLedgerFilter{Instrument: "btc-cny"}, repository.FeeRevenueByMember)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(byMember))
+
+	byInstrument, err := repo.SumFees(ctx, &repository.FeeLedgerFilter{From: 150}, repository.FeeRevenueByInstrument)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(byInstrument))
+	assert.Equal(t, "300000", byInstrument[0].Amount)
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"gitlab.com/sdce/service/otc/pkg/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gotest.tools/assert"
+)
+
+func TestFeeScheduleEffective(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+	repo := repository.NewFeeScheduleRepo(db)
+
+	now := time.Now().UnixNano()
+	hour := int64(time.Hour)
+	both := &repository.FeeSchedule{
+		Instrument:    "btc-cny",
+		EffectiveFrom: now - 2*hour,
+		Tiers:         []*repository.FeeTier{{MinVolume: "0", Rate: "0.002"}},
+	}
+	ask := &repository.FeeSchedule{
+		Instrument:    "btc-cny",
+		Side:          pb.OrderSide_ASK,
+		EffectiveFrom: now - 2*hour,
+		Policy:        repository.FeePolicy{Payer: repository.FeePayerBoth, Currency: repository.FeeCurrencyQuote},
+		Tiers:         []*repository.FeeTier{{MinVolume: "0", Rate: "0.003"}},
+	}
+	future := &repository.FeeSchedule{
+		Instrument:    "btc-cny",
+		EffectiveFrom: now + hour,
+		Tiers:         []*repository.FeeTier{{MinVolume: "0", Rate: "0.001"}},
+	}
+	for _, s := range []*repository.FeeSchedule{both, ask, future} {
+		_, err := repo.CreateFeeSchedule(ctx, s)
+		assert.NilError(t, err)
+	}
+
+	s, err := repo.FindEffectiveFeeSchedule(ctx, "btc-cny", pb.OrderSide_ASK, now)
+	assert.NilError(t, err)
+	assert.Equal(t, "0.003", s.Tiers[0].Rate)
+	assert.Equal(t, repository.FeePayerBoth, s.Policy.Payer)
+	assert.Equal(t, repository.FeeCurrencyQuote, s.Policy.Currency)
+	s, err = repo.FindEffectiveFeeSchedule(ctx, "btc-cny", pb.OrderSide_BID, now)
+	assert.NilError(t, err)
+	assert.Equal(t, "0.002", s.Tiers[0].Rate)
+	s, err = repo.FindEffectiveFeeSchedule(ctx, "btc-cny", pb.OrderSide_BID, now+2*hour)
+	assert.NilError(t, err)
+	assert.Equal(t, "0.001", s.Tiers[0].Rate)
+	s, err = repo.FindEffectiveFeeSchedule(ctx, "eth-cny", pb.OrderSide_BID, now)
+	assert.NilError(t, err)
+	assert.Assert(t, s == nil)
+
+	assert.Equal(t, repository.ErrFeeScheduleInEffect, repo.DeleteFeeSchedule(ctx, both.Id, now))
+	assert.NilError(t, repo.DeleteFeeSchedule(ctx, future.Id, now))
+}
+
+func TestFeeScheduleAdminOnly(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+	rpcServer := rpc.NewOtcTradingServer(NewMockApi(ctrl), db)
+
+	schedule := func() *repository.FeeSchedule {
+		return &repository.FeeSchedule{
+			Instrument:    "btc-cny",
+			EffectiveFrom: time.Now().Add(time.Hour).UnixNano(),
+			Tiers:         []*repository.FeeTier{{MinVolume: "0", Rate: "0.001"}},
+		}
+	}
+	memberCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user1)))
+	adminCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorRoleHeader, string(orderstate.RoleAdmin)))
+
+	_, err := rpcServer.DoCreateFeeSchedule(ctx, &rpc.CreateFeeScheduleRequest{Schedule: schedule()})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = rpcServer.DoCreateFeeSchedule(memberCtx, &rpc.CreateFeeScheduleRequest{Schedule: schedule()})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	created, err := rpcServer.DoCreateFeeSchedule(adminCtx, &rpc.CreateFeeScheduleRequest{Schedule: schedule()})
+	assert.NilError(t, err)
+
+	update := schedule()
+	update.Id = created.Id
+	update.Tiers[0].Rate = "0.002"
+	_, err = rpcServer.DoUpdateFeeSchedule(memberCtx, &rpc.UpdateFeeScheduleRequest{Schedule: update})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = rpcServer.DoUpdateFeeSchedule(adminCtx, &rpc.UpdateFeeScheduleRequest{Schedule: update})
+	assert.NilError(t, err)
+
+	_, err = rpcServer.DoDeleteFeeSchedule(memberCtx, &rpc.DeleteFeeScheduleRequest{Id: created.Id})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = rpcServer.DoDeleteFeeSchedule(adminCtx, &rpc.DeleteFeeScheduleRequest{Id: created.Id})
+	assert.NilError(t, err)
+}
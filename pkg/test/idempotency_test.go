@@ -0,0 +1,178 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	pb "gitlab.com/sdce/protogo"
+	rpcapi "gitlab.com/sdce/service/otc/pkg/api"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"gitlab.com/sdce/service/otc/pkg/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gotest.tools/assert"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+	keys := repository.NewIdempotencyRepo(db)
+
+	rec, reserved, err := keys.Reserve(ctx, "k1", "DoBuyQuote", user1)
+	assert.NilError(t, err)
+	assert.Assert(t, reserved)
+	_, reserved, err = keys.Reserve(ctx, "k1", "DoBuyQuote", user1)
+	assert.NilError(t, err)
+	assert.Assert(t, !reserved)
+	// keys are scoped by member
+	_, reserved, err = keys.Reserve(ctx, "k1", "DoBuyQuote", user2)
+	assert.NilError(t, err)
+	assert.Assert(t, reserved)
+
+	resultId := exutil.NewUUID()
+	assert.NilError(t, keys.Complete(ctx, rec, resultId))
+	done, reserved, err := keys.Reserve(ctx, "k1", "DoBuyQuote", user1)
+	assert.NilError(t, err)
+	assert.Assert(t, !reserved)
+	assert.Equal(t, repository.IdempotencyDone, done.Status)
+	assert.Assert(t, bytes.Equal(resultId.Bytes, done.ResultId.Bytes))
+	assert.Equal(t, repository.ErrIdempotencyKeyLost, keys.Complete(ctx, rec, resultId))
+
+	// a key pending for long is still not taken over
+	_, err = db.Db.Collection(repository.IdempotencyCollection).InsertOne(ctx, &repository.IdempotencyRecord{
+		Key:       "DoBuyQuote:" + exutil.UUIDtoA(user3) + ":k2",
+		Method:    "DoBuyQuote",
+		MemberId:  user3,
+		Status:    repository.IdempotencyPending,
+		CreatedAt: time.Now().Add(-time.Hour),
+	})
+	assert.NilError(t, err)
+	stale, reserved, err := keys.Reserve(ctx, "k2", "DoBuyQuote", user3)
+	assert.NilError(t, err)
+	assert.Assert(t, !reserved)
+	assert.Equal(t, repository.IdempotencyPending, stale.Status)
+
+	// a released key can be reserved again
+	rec, _, err = keys.Reserve(ctx, "k3", "DoBuyQuote", user1)
+	assert.NilError(t, err)
+	assert.NilError(t, keys.Release(ctx, rec))
+	_, reserved, err = keys.Reserve(ctx, "k3", "DoBuyQuote", user1)
+	assert.NilError(t, err)
+	assert.Assert(t, reserved)
+}
+
+func TestIdempotentCreateQuote(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	// the first lock fails, the others wait for the gate once locking is signalled
+	var mu sync.Mutex
+	locks := 0
+	locking, gate := make(chan struct{}, 1), make(chan struct{})
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, lr *rpcapi.LockBalance) error {
+		mu.Lock()
+		locks++
+		n := locks
+		mu.Unlock()
+		if n == 1 {
+			return errors.New("member service unavailable")
+		}
+		if n == 3 {
+			locking <- struct{}{}
+			<-gate
+		}
+		return nil
+	}).AnyTimes()
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
+
+	create := func(key string) (*pb.CreateQuoteResponse, error) {
+		return rpcServer.DoCreateQuote(metadata.NewIncomingContext(ctx, metadata.Pairs(rpc.IdempotencyKeyHeader, key)), &pb.CreateQuoteRequest{Quote: &pb.Quote{
+			Instrument:             FakeInstrumentRef,
+			Price:                  0.001,
+			Side:                   pb.OrderSide_ASK,
+			Owner:                  user1,
+			Type:                   pb.Quote_REGULAR,
+			Volume:                 "100000000",
+			MinValue:               "1000",
+			MaxValue:               "100000",
+			AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+		}})
+	}
+
+	// a failed call releases its key for the retry, which is replayed after
+	_, err := create("create-1")
+	assert.Assert(t, err != nil)
+	first, err := create("create-1")
+	assert.NilError(t, err)
+	replay, err := create("create-1")
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(first.Id.Bytes, replay.Id.Bytes))
+	assert.Equal(t, 2, locks)
+
+	// duplicates sent while the first call runs get its result, and lock nothing
+	var wg sync.WaitGroup
+	ids := make([]*pb.UUID, 4)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		res, err := create("create-2")
+		assert.NilError(t, err)
+		ids[0] = res.Id
+	}()
+	<-locking
+	for i := 1; i < len(ids); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := create("create-2")
+			assert.NilError(t, err)
+			ids[i] = res.Id
+		}(i)
+	}
+	time.Sleep(500 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+	for _, id := range ids {
+		assert.Assert(t, bytes.Equal(ids[0].Bytes, id.Bytes))
+	}
+	assert.Equal(t, 3, locks)
+
+	// a key left pending by a call which never finished is not run again
+	_, err = db.Db.Collection(repository.IdempotencyCollection).InsertOne(ctx, &repository.IdempotencyRecord{
+		Key:       "DoCreateQuote:" + exutil.UUIDtoA(user1) + ":create-3",
+		Method:    "DoCreateQuote",
+		MemberId:  user1,
+		Status:    repository.IdempotencyPending,
+		CreatedAt: time.Now().Add(-time.Hour),
+	})
+	assert.NilError(t, err)
+	_, err = create("create-3")
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Equal(t, 3, locks)
+}
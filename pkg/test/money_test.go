@@ -0,0 +1,89 @@
+package test
+
+import (
+	"math/big"
+	"testing"
+
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/rpc"
+	"gotest.tools/assert"
+)
+
+func TestMoneyRound(t *testing.T) {
+	cases := []struct {
+		num, denom int64
+		mode       rpc.RoundingMode
+		want       int64
+	}{
+		{5, 2, rpc.RoundDown, 2},
+		{5, 2, rpc.RoundUp, 3},
+		{5, 2, rpc.RoundHalfUp, 3},
+		{5, 2, rpc.RoundHalfEven, 2},
+		{7, 2, rpc.RoundHalfEven, 4},
+		{-5, 2, rpc.RoundHalfUp, -3},
+		{-5, 2, rpc.RoundHalfEven, -2},
+		{-5, 2, rpc.RoundDown, -2},
+		{7, 3, rpc.RoundHalfUp, 2},
+		{8, 3, rpc.RoundHalfEven, 3},
+		{6, 3, rpc.RoundUp, 2},
+	}
+	for _, c := range cases {
+		m := rpc.MoneyFromInt(big.NewInt(c.num)).Quo(big.NewRat(c.denom, 1))
+		assert.Equal(t, c.want, m.Round(c.mode).Int64(), "%d/%d mode %d", c.num, c.denom, c.mode)
+	}
+
+	_, err := rpc.ParseMoney("1.5")
+	assert.Assert(t, err != nil)
+}
+
+func TestMoneyFee(t *testing.T) {
+	rate, err := rpc.ParseRate("0.002")
+	assert.NilError(t, err)
+	volume, _ := rpc.ParseMoney("100000000")
+	assert.Equal(t, "200000", rpc.FeeOnVolume(volume, rate).String())
+	// 100000000 * 0.002 / 0.998 = 200400.8...
+	assert.Equal(t, "200401", rpc.GrossUpFee(volume, rate).String())
+	// 1250 * 0.002 = 2.5 rounds to even
+	volume, _ = rpc.ParseMoney("1250")
+	assert.Equal(t, "2", rpc.FeeOnVolume(volume, rate).String())
+}
+
+func TestMoneyPrice(t *testing.T) {
+	inst := &pb.InstrumentRef{
+		Base:  &pb.CurrencyRef{Decimal: 8},
+		Quote: &pb.CurrencyRef{Decimal: 2},
+	}
+	// 1 BTC for 7000.10 CNY
+	q := &pb.Quote{Instrument: inst, Price: 0.0070001}
+	value, _ := rpc.ParseMoney("700010")
+	volume, _ := rpc.ParseMoney("100000000")
+	price, err := rpc.PriceOf(value, volume, inst)
+	assert.NilError(t, err)
+	assert.Assert(t, price.Within(rpc.QuotePrice(q), new(big.Rat)))
+	assert.Equal(t, q.Price, price.UnitPrice(inst))
+
+	value, _ = rpc.ParseMoney("700011")
+	price, _ = rpc.PriceOf(value, volume, inst)
+	assert.Assert(t, !price.Within(rpc.QuotePrice(q), new(big.Rat)))
+	assert.Assert(t, price.Within(rpc.QuotePrice(q), big.NewRat(1, 100)))
+
+	value, _ = rpc.ParseMoney("700012")
+	price, _ = rpc.PriceOf(value, volume, inst)
+	assert.Assert(t, !price.Within(rpc.QuotePrice(q), big.NewRat(1, 100)))
+
+	assert.Equal(t, "700010", rpc.ValueAt(volume, q.Price).Round(rpc.RoundHalfUp).String())
+}
+
+func TestMoneyParsePrice(t *testing.T) {
+	inst := &pb.InstrumentRef{
+		Base:  &pb.CurrencyRef{Decimal: 8},
+		Quote: &pb.CurrencyRef{Decimal: 2},
+	}
+	price, err := rpc.ParsePrice("7000.105")
+	assert.NilError(t, err)
+	assert.Equal(t, "7000.11000000", price.Round(2, rpc.RoundHalfUp).String())
+	assert.Equal(t, 0.00700011, price.Round(2, rpc.RoundHalfUp).UnitPrice(inst))
+
+	_, err = rpc.ParsePrice("-1")
+	assert.Assert(t, err != nil)
+}
@@ -0,0 +1,72 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	pb "gitlab.com/sdce/protogo"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"gotest.tools/assert"
+)
+
+func TestOrderTransitions(t *testing.T) {
+	allowed := map[pb.OtcOrder_OrderStatus][]pb.OtcOrder_OrderStatus{
+		pb.OtcOrder_UNPAID:    {pb.OtcOrder_PAID, pb.OtcOrder_CANCELLED, pb.OtcOrder_EXPIRED, pb.OtcOrder_APPEAL},
+		pb.OtcOrder_PAID:      {pb.OtcOrder_COMPLETED, pb.OtcOrder_UNPAID, pb.OtcOrder_APPEAL},
+		pb.OtcOrder_APPEAL:    {pb.OtcOrder_RESOLVED, pb.OtcOrder_CANCELLED},
+		pb.OtcOrder_COMPLETED: {},
+		pb.OtcOrder_CANCELLED: {},
+		pb.OtcOrder_RESOLVED:  {},
+		pb.OtcOrder_EXPIRED:   {},
+	}
+	assert.Equal(t, len(allowed), len(pb.OtcOrder_OrderStatus_name))
+
+	for f := range pb.OtcOrder_OrderStatus_name {
+		from := pb.OtcOrder_OrderStatus(f)
+		for to := range pb.OtcOrder_OrderStatus_name {
+			to := pb.OtcOrder_OrderStatus(to)
+			want := false
+			for _, s := range allowed[from] {
+				if s == to {
+					want = true
+				}
+			}
+			tr, err := orderstate.Lookup(from, to)
+			if want {
+				assert.NilError(t, err, "%s to %s", from, to)
+				assert.Equal(t, tr.From, from)
+				assert.Equal(t, tr.To, to)
+				assert.Assert(t, len(tr.Roles) > 0, "%s to %s has no roles", from, to)
+			} else {
+				assert.ErrorContains(t, err, "order transition invalid", "%s to %s", from, to)
+			}
+		}
+		assert.Equal(t, orderstate.IsTerminal(from), len(allowed[from]) == 0, "%s", from)
+	}
+}
+
+func TestOrderTransitionGuards(t *testing.T) {
+	tr, err := orderstate.Lookup(pb.OtcOrder_UNPAID, pb.OtcOrder_PAID)
+	assert.NilError(t, err)
+	assert.Assert(t, tr.Permits(orderstate.RoleBuyer))
+	assert.Assert(t, !tr.Permits(orderstate.RoleSeller, orderstate.RoleSystem))
+
+	tr, err = orderstate.Lookup(pb.OtcOrder_PAID, pb.OtcOrder_COMPLETED)
+	assert.NilError(t, err)
+	assert.Assert(t, tr.Permits(orderstate.RoleSeller))
+	assert.Assert(t, !tr.Permits(orderstate.RoleBuyer))
+	assert.DeepEqual(t, tr.Hooks, []orderstate.Hook{orderstate.HookReleasePending, orderstate.HookReleaseCoin, orderstate.HookQuoteComplete})
+
+	tr, err = orderstate.Lookup(pb.OtcOrder_UNPAID, pb.OtcOrder_CANCELLED)
+	assert.NilError(t, err)
+	assert.Assert(t, tr.Permits(orderstate.RoleBuyer))
+	assert.Assert(t, tr.Permits(orderstate.RoleAdmin))
+	assert.Assert(t, !tr.Permits(orderstate.RoleSeller))
+
+	tr, err = orderstate.Lookup(pb.OtcOrder_UNPAID, pb.OtcOrder_EXPIRED)
+	assert.NilError(t, err)
+	order := &pb.OtcOrder{ExpiredTime: time.Now().Add(time.Minute).UnixNano()}
+	assert.ErrorContains(t, tr.CheckPreconditions(order), "cannot be expired")
+	order.ExpiredTime = time.Now().Add(-time.Minute).UnixNano()
+	assert.NilError(t, tr.CheckPreconditions(order))
+}
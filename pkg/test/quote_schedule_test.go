@@ -0,0 +1,58 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"gotest.tools/assert"
+)
+
+func TestQuoteScheduleWindow(t *testing.T) {
+	s := &repository.QuoteSchedule{
+		Timezone: "Australia/Sydney",
+		Windows: []repository.TradingWindow{
+			{Day: time.Monday, Start: "09:00", End: "17:30"},
+			// Friday night into Saturday
+			{Day: time.Friday, Start: "22:00", End: "02:00"},
+		},
+		AutoOffMinutes: 30,
+	}
+	assert.NilError(t, s.Validate())
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	assert.NilError(t, err)
+
+	cases := []struct {
+		at time.Time
+		in bool
+	}{
+		{time.Date(2019, 7, 1, 9, 0, 0, 0, sydney), true},
+		{time.Date(2019, 7, 1, 17, 29, 0, 0, sydney), true},
+		{time.Date(2019, 7, 1, 17, 30, 0, 0, sydney), false},
+		{time.Date(2019, 7, 1, 8, 59, 0, 0, sydney), false},
+		{time.Date(2019, 7, 2, 10, 0, 0, 0, sydney), false},
+		{time.Date(2019, 7, 5, 23, 0, 0, 0, sydney), true},
+		{time.Date(2019, 7, 6, 1, 59, 0, 0, sydney), true},
+		{time.Date(2019, 7, 6, 2, 0, 0, 0, sydney), false},
+		// the same Monday morning seen from UTC
+		{time.Date(2019, 6, 30, 23, 30, 0, 0, time.UTC), true},
+	}
+	for _, c := range cases {
+		in, err := s.InWindow(c.at)
+		assert.NilError(t, err)
+		assert.Equal(t, c.in, in, "at %v", c.at)
+	}
+
+	open := time.Date(2019, 7, 1, 10, 0, 0, 0, sydney)
+	s.LastActive = open.Add(-29 * time.Minute).UnixNano()
+	ok, err := s.Open(open)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	s.LastActive = open.Add(-31 * time.Minute).UnixNano()
+	ok, err = s.Open(open)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+
+	assert.Assert(t, (&repository.QuoteSchedule{Timezone: "Mars/Olympus"}).Validate() != nil)
+	assert.Assert(t, (&repository.QuoteSchedule{Windows: []repository.TradingWindow{{Start: "9am", End: "17:00"}}}).Validate() != nil)
+}
@@ -2,6 +2,7 @@ package test
 
 import (
 	"context"
+	"strings"
 	"testing"
 
 	"gotest.tools/assert"
@@ -126,9 +127,9 @@ func TestQuoteCreateSearch(t *testing.T) {
 
 	filter := &repository.QuoteFilter{
 		MemberId:     user1,
-		BaseCurrency: FakeInstrumentRef.GetBase().GetId(),
+		BaseCurrency: FakeInstrumentRef.GetBase().GetSymbol(),
 	}
-	out, err := quoteRepo.SearchQuotes(ctx, filter)
+	out, _, err := quoteRepo.SearchQuotes(ctx, filter)
 	if err != nil {
 		t.Fail()
 	}
@@ -139,3 +140,54 @@ func TestQuoteCreateSearch(t *testing.T) {
 	assert.Assert(t, len(out) == 1, "only one record should be returned")
 	db.Db.Drop(ctx)
 }
+
+func TestQuoteDepth(t *testing.T) {
+	quotes := []*pb.Quote{
+		{Price: 0.002, Volume: "100", Value: "200", MinValue: "10", MaxValue: "200"},
+		{Price: 0.001, Volume: "100", Value: "100", MinValue: "20", MaxValue: "50",
+			AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK}},
+		{Price: 0.001, Volume: "300", Value: "300", MinValue: "5", MaxValue: "100"},
+		{Price: 0.001, Volume: "0", Value: "0", MinValue: "1", MaxValue: "1"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+	quoteRepo := repository.NewQuoteRepo(db)
+	for _, q := range quotes {
+		q.Instrument = FakeInstrumentRef
+		q.Side = pb.OrderSide_ASK
+		q.Status = pb.Quote_ON
+		q.Owner = user1
+		_, err := quoteRepo.CreateQuote(ctx, q)
+		assert.NilError(t, err)
+	}
+
+	levels, err := quoteRepo.QuoteDepth(ctx, &repository.DepthFilter{
+		Instrument: strings.ToLower(FakeInstrumentRef.Code),
+		Side:       pb.OrderSide_ASK,
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(levels))
+	assert.Equal(t, 0.001, levels[0].Price)
+	assert.Equal(t, "400", levels[0].Volume)
+	assert.Equal(t, int64(2), levels[0].Count)
+	assert.Equal(t, "5", levels[0].MinValue)
+	assert.Equal(t, "100", levels[0].MaxValue)
+
+	levels, err = quoteRepo.QuoteDepth(ctx, &repository.DepthFilter{
+		Instrument:    FakeInstrumentRef.Code,
+		Side:          pb.OrderSide_ASK,
+		PaymentMethod: pb.PaymentMethod_BANK,
+		MaxDepth:      1,
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(levels))
+	assert.Equal(t, "100", levels[0].Volume)
+}
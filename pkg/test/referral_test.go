@@ -0,0 +1,61 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"gitlab.com/sdce/exlib/exutil"
+	exmongo "gitlab.com/sdce/exlib/mongo"
+	"gitlab.com/sdce/service/otc/pkg/repository"
+	"gotest.tools/assert"
+)
+
+func TestReferralRebates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+	referrals := repository.NewReferralRepo(db)
+	rebates := repository.NewRebateLedgerRepo(db)
+
+	_, err := referrals.CreateReferral(ctx, &repository.Referral{Referee: user2, Referrer: user1})
+	assert.NilError(t, err)
+	_, err = referrals.CreateReferral(ctx, &repository.Referral{Referee: user2, Referrer: user1})
+	assert.Equal(t, repository.ErrReferralExists, err)
+	r, err := referrals.GetReferral(ctx, user2)
+	assert.NilError(t, err)
+	assert.Assert(t, exutil.UUIDtoA(r.Referrer) == exutil.UUIDtoA(user1))
+	r, err = referrals.GetReferral(ctx, user1)
+	assert.NilError(t, err)
+	assert.Assert(t, r == nil)
+
+	feeEventId := exutil.NewUUID()
+	entries := []*repository.RebateEntry{
+		{FeeEventId: feeEventId, Referrer: user1, Referee: user2, Currency: "BTC", Fee: "1000", Amount: "200", Time: 100},
+		{FeeEventId: exutil.NewUUID(), Referrer: user1, Referee: user2, Currency: "BTC", Fee: "500", Amount: "100", Time: 200},
+	}
+	for _, e := range entries {
+		assert.NilError(t, rebates.AccrueRebate(ctx, e))
+	}
+	// the same fee earns one rebate
+	assert.NilError(t, rebates.AccrueRebate(ctx, &repository.RebateEntry{FeeEventId: feeEventId, Referrer: user1, Amount: "200"}))
+
+	unpaid, err := rebates.SearchUnpaidRebates(ctx, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(unpaid))
+	assert.NilError(t, rebates.MarkRebatePaid(ctx, unpaid[0].Id, exutil.NewUUID(), 300))
+	assert.Equal(t, repository.ErrRebatePaid, rebates.MarkRebatePaid(ctx, unpaid[0].Id, exutil.NewUUID(), 400))
+
+	sums, err := rebates.SumRebates(ctx, user1)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(sums))
+	assert.Equal(t, repository.RebateAccrued, sums[0].Status)
+	assert.Equal(t, "100", sums[0].Amount)
+	assert.Equal(t, repository.RebatePaid, sums[1].Status)
+	assert.Equal(t, "200", sums[1].Amount)
+}
@@ -3,14 +3,24 @@ package test
 import (
 	"bytes"
 	context "context"
+	"errors"
+	"math/big"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/sdce/exlib/exutil"
 	exmongo "gitlab.com/sdce/exlib/mongo"
 	pb "gitlab.com/sdce/protogo"
+	rpcapi "gitlab.com/sdce/service/otc/pkg/api"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"gitlab.com/sdce/service/otc/pkg/repository"
 	"gitlab.com/sdce/service/otc/pkg/rpc"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"gotest.tools/assert"
 )
 
@@ -53,6 +63,7 @@ func TestCreateQuote(t *testing.T) {
 	api.EXPECT().LockAccountBalance(ctx, gomock.Any()).Return(nil)
 	//	api.EXPECT().FindMemberAccount(ctx, user1, coin).Return(accounts, nil)
 	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
 
 	req := &pb.CreateQuoteRequest{
 		Quote:  q,
@@ -79,7 +90,7 @@ func TestCreateQuote(t *testing.T) {
 
 	inReq := &pb.ListQuoteRequest{
 		UserId:       user1,
-		BaseCurrency: FakeInstrumentRef.Base.GetId(),
+		BaseCurrency: FakeInstrumentRef.Base.GetSymbol(),
 	}
 	qres, err := rpcServer.DoListQuote(ctx, inReq)
 	if err != nil {
@@ -132,6 +143,7 @@ func TestUpdateQuote(t *testing.T) {
 	api.EXPECT().LockAccountBalance(ctx, gomock.Any()).Return(nil)
 	//	api.EXPECT().FindMemberAccount(ctx, user1, coin).Return(accounts, nil)
 	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
 
 	req := &pb.CreateQuoteRequest{
 		Quote:  q,
@@ -145,6 +157,9 @@ func TestUpdateQuote(t *testing.T) {
 	created := res.GetId()
 	log.Printf("new created quote: %s", exutil.UUIDtoA(created))
 
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(ctx, user1, gomock.Any()).Return([]*pb.AccountDefined{{Id: coin, Owner: user1, Currency: BTCRef}}, nil)
+	api.EXPECT().LockAccountBalance(ctx, gomock.Any()).Return(nil)
 	template := &pb.Quote{}
 	fm, err := exutil.GenerateFieldMask([]string{"Volume", "Value"}, template)
 	ur := &pb.UpdateQuoteRequest{
@@ -164,5 +179,487 @@ func TestUpdateQuote(t *testing.T) {
 	}
 
 	log.Infof("updated quote: %v", uRes.Message)
+
+	// the other fields are only updated when the amounts are
+	api.EXPECT().FindMemberAccount(ctx, user1, gomock.Any()).Return([]*pb.AccountDefined{{Id: coin, Owner: user1, Currency: BTCRef}}, nil).Times(2)
+	api.EXPECT().LockAccountBalance(ctx, gomock.Any()).Return(errors.New("accounts unavailable"))
+	fm, err = exutil.GenerateFieldMask([]string{"Volume", "ExpireBy"}, template)
+	assert.NilError(t, err)
+	ur = &pb.UpdateQuoteRequest{
+		NewQuote: &pb.Quote{
+			Id:         created,
+			Volume:     "300000000",
+			ExpireBy:   3600,
+			Instrument: FakeInstrumentRef,
+		},
+		UpdateMask: fm,
+	}
+	_, err = rpcServer.DoUpdateQuote(ctx, ur)
+	assert.Assert(t, err != nil)
+	qd, err := rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: created})
+	assert.NilError(t, err)
+	assert.Equal(t, "200000000", qd.Quote.Volume)
+	assert.Assert(t, qd.Quote.ExpireBy != 3600)
+	api.EXPECT().LockAccountBalance(ctx, gomock.Any()).Return(nil)
+	_, err = rpcServer.DoUpdateQuote(ctx, ur)
+	assert.NilError(t, err)
+	qd, err = rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: created})
+	assert.NilError(t, err)
+	assert.Equal(t, "300000000", qd.Quote.Volume)
+	assert.Assert(t, qd.Quote.ExpireBy == 3600)
 	db.Db.Drop(ctx)
 }
+
+func TestFloatingQuote(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).Return(nil)
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
+
+	setReference := func(price string) {
+		_, err := rpcServer.DoCreateSDCEQuote(ctx, &pb.SDCEQuoteRequest{Quote: &pb.CurrencyQuote{
+			Ticker:       FakeInstrumentRef.Code,
+			BuyUnitPrice: &pb.UnitPrice{Price: price},
+		}})
+		assert.NilError(t, err)
+	}
+	setReference("7000.00")
+
+	res, err := rpcServer.DoCreateFloatingQuote(ctx, &rpc.CreateFloatingQuoteRequest{
+		Quote: &pb.Quote{
+			Instrument:             FakeInstrumentRef,
+			Side:                   pb.OrderSide_ASK,
+			Owner:                  user1,
+			Type:                   pb.Quote_REGULAR,
+			Volume:                 "100000000",
+			ExpireBy:               900,
+			AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+		},
+		Pricing: &repository.QuotePricing{Premium: "1.5", Ceiling: "7100"},
+	})
+	assert.NilError(t, err)
+
+	// 7105 AUD is above the ceiling
+	qd, err := rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: res.Id})
+	assert.NilError(t, err)
+	assert.Equal(t, 0.0071, qd.Quote.Price)
+	assert.Equal(t, "710000", qd.Quote.Value)
+
+	// listed at 6090 AUD once the reference drops
+	setReference("6000.00")
+	ql, err := rpcServer.DoListQuote(ctx, &pb.ListQuoteRequest{UserId: user1})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(ql.Quotes))
+	assert.Equal(t, 0.00609, ql.Quotes[0].Price)
+	assert.Equal(t, "609000", ql.Quotes[0].Value)
+}
+
+func TestAmendQuote(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	accId, _ := exutil.AtoUUID("5c7f6bc09e7405297329f087")
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(gomock.Any(), user1, gomock.Any()).Return([]*pb.AccountDefined{{Id: accId, Owner: user1, Currency: BTCRef}}, nil).AnyTimes()
+	var locks []*rpcapi.LockBalance
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, lr *rpcapi.LockBalance) error {
+		locks = append(locks, lr)
+		return nil
+	}).Times(2)
+	var released string
+	api.EXPECT().ReleaselockedBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, req *pb.ReleaseLockedBalanceRequest) error {
+		released = req.Amount
+		return nil
+	})
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
+
+	res, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: &pb.Quote{
+		Instrument:             FakeInstrumentRef,
+		Price:                  0.001,
+		Side:                   pb.OrderSide_ASK,
+		Owner:                  user1,
+		Type:                   pb.Quote_REGULAR,
+		Volume:                 "100000000",
+		AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+	}})
+	assert.NilError(t, err)
+
+	// 1 BTC with the fee grossed up locks 100200401, 2 BTC locks 200400802
+	_, err = rpcServer.DoAmendQuote(ctx, &rpc.AmendQuoteRequest{QuoteId: res.Id, MemberId: user2, Volume: "200000000"})
+	assert.Assert(t, err != nil)
+	amended, err := rpcServer.DoAmendQuote(ctx, &rpc.AmendQuoteRequest{QuoteId: res.Id, MemberId: user1, Volume: "200000000"})
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(locks))
+	assert.Equal(t, "100200401", locks[1].FromAmount.String())
+	assert.Equal(t, "200400802", locks[1].ToAmount.String())
+	assert.Equal(t, "200000", amended.Quote.Value)
+	assert.Equal(t, "400802", amended.Quote.LockedFee)
+
+	// down to 0.5 BTC at a new price releases the rest
+	amended, err = rpcServer.DoAmendQuote(ctx, &rpc.AmendQuoteRequest{QuoteId: res.Id, MemberId: user1, Volume: "50000000", Price: 0.002})
+	assert.NilError(t, err)
+	assert.Equal(t, "150300602", released)
+
+	qd, err := rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: res.Id})
+	assert.NilError(t, err)
+	assert.Equal(t, "50000000", qd.Quote.Volume)
+	assert.Equal(t, "100000", qd.Quote.Value)
+	assert.Equal(t, "50000000", qd.Quote.VolumeToFill)
+	assert.Equal(t, "100200", qd.Quote.LockedFee)
+	assert.Equal(t, 0.002, qd.Quote.Price)
+	assert.Equal(t, pb.OrderEventType_UPDATE_ORDER, qd.Quote.Events[len(qd.Quote.Events)-1].Type)
+}
+
+func TestQuoteEligibility(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).Return(nil)
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
+
+	res, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: &pb.Quote{
+		Instrument:             FakeInstrumentRef,
+		Price:                  0.001,
+		Side:                   pb.OrderSide_ASK,
+		Owner:                  user1,
+		Type:                   pb.Quote_REGULAR,
+		Volume:                 "100000000",
+		MinValue:               "1000",
+		MaxValue:               "100000",
+		AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+	}})
+	assert.NilError(t, err)
+	_, err = rpcServer.DoSetQuoteEligibility(ctx, &rpc.SetQuoteEligibilityRequest{
+		QuoteId:     res.Id,
+		MemberId:    user1,
+		Eligibility: &repository.QuoteEligibility{MinKycLevel: 2, MinCompletedTrades: 1, Blocked: []*pb.UUID{user3}},
+	})
+	assert.NilError(t, err)
+	// members cannot report their own standing, the member service does
+	memberCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user2)))
+	_, err = rpcServer.DoSetMemberStanding(memberCtx, &rpc.SetMemberStandingRequest{MemberId: user2, KycLevel: 99, RegisteredAt: 1})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	systemCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorRoleHeader, string(orderstate.RoleSystem)))
+	_, err = rpcServer.DoSetMemberStanding(systemCtx, &rpc.SetMemberStandingRequest{MemberId: user2, KycLevel: 1})
+	assert.NilError(t, err)
+
+	// user2 fails the KYC level and completed trades, each a violation
+	_, err = rpcServer.DoPreviewOrder(ctx, &rpc.PreviewOrderRequest{QuoteId: res.Id, MemberId: user2, Volume: "10000000"})
+	st := status.Convert(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	assert.Equal(t, 1, len(st.Details()))
+	failure := st.Details()[0].(*errdetails.PreconditionFailure)
+	assert.Equal(t, 2, len(failure.Violations))
+	assert.Equal(t, rpc.RuleKycLevel, failure.Violations[0].Type)
+	assert.Equal(t, rpc.RuleCompletedTrades, failure.Violations[1].Type)
+
+	list := &pb.ListQuoteRequest{UserId: user1}
+	ql, err := rpcServer.DoListEligibleQuotes(ctx, &rpc.ListEligibleQuotesRequest{List: list, TakerId: user2})
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(ql.Quotes))
+	assert.Equal(t, int64(0), ql.ResultCount)
+
+	_, err = rpcServer.DoSetQuoteEligibility(ctx, &rpc.SetQuoteEligibilityRequest{
+		QuoteId:     res.Id,
+		MemberId:    user1,
+		Eligibility: &repository.QuoteEligibility{MinKycLevel: 1, Blocked: []*pb.UUID{user3}},
+	})
+	assert.NilError(t, err)
+	ql, err = rpcServer.DoListEligibleQuotes(ctx, &rpc.ListEligibleQuotesRequest{List: list, TakerId: user2})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(ql.Quotes))
+	ql, err = rpcServer.DoListEligibleQuotes(ctx, &rpc.ListEligibleQuotesRequest{List: list, TakerId: user3})
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(ql.Quotes))
+	ql, err = rpcServer.DoListQuote(ctx, list)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(ql.Quotes))
+}
+
+// setUpBank registers bank details for members, so their quotes accepting BANK can be paid
+func setUpBank(ctx context.Context, t *testing.T, rpcServer *rpc.OtcServer, members ...*pb.UUID) {
+	for _, m := range members {
+		_, err := rpcServer.DoSetPaymentDetails(ctx, &rpc.SetPaymentDetailsRequest{
+			MemberId: m,
+			Method:   pb.PaymentMethod_BANK,
+			Details:  map[string]string{"accountName": exutil.UUIDtoA(m), "accountNumber": "062000 12345678"},
+		})
+		assert.NilError(t, err)
+	}
+}
+
+func TestPaymentMethods(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	accId, _ := exutil.AtoUUID("5c7cff810948c6e942e3e6e3")
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(gomock.Any(), gomock.Any(), gomock.Any()).Return([]*pb.AccountDefined{{Id: accId, Owner: user2, Currency: BTCRef}}, nil).AnyTimes()
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+
+	q := &pb.Quote{
+		Instrument:             FakeInstrumentRef,
+		Price:                  0.001,
+		Side:                   pb.OrderSide_ASK,
+		Owner:                  user1,
+		Type:                   pb.Quote_REGULAR,
+		Volume:                 "100000000",
+		MinValue:               "1000",
+		MaxValue:               "100000",
+		AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+	}
+
+	// the owner is paid on an ASK quote, so their bank details are needed first
+	_, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: q})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	setUpBank(ctx, t, rpcServer, user1)
+	res, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: q})
+	assert.NilError(t, err)
+
+	// paying by a method the quote does not accept is refused
+	buy := &pb.BuyQuoteRequest{
+		QuoteId:   res.Id,
+		MemberId:  user2,
+		AccountId: accId,
+		Method:    pb.PaymentMethod(2),
+		Volume:    "10000000",
+		Value:     "10000",
+	}
+	_, err = rpcServer.DoBuyQuote(ctx, buy)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// the order keeps the details the seller had when it was placed
+	buy.Method = pb.PaymentMethod_BANK
+	bo, err := rpcServer.DoBuyQuote(ctx, buy)
+	assert.NilError(t, err)
+	_, err = rpcServer.DoSetPaymentDetails(ctx, &rpc.SetPaymentDetailsRequest{MemberId: user1, Method: pb.PaymentMethod_BANK})
+	assert.NilError(t, err)
+	payment, err := repository.NewOtcTradeRepository(db).GetOtcOrderPayment(ctx, bo.OrderId)
+	assert.NilError(t, err)
+	assert.Equal(t, pb.PaymentMethod_BANK, payment.Method)
+	assert.Assert(t, bytes.Equal(user1.Bytes, payment.Payee.Bytes))
+	assert.Equal(t, exutil.UUIDtoA(user1), payment.Details["accountName"])
+}
+
+func TestPauseQuote(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	// each member has one account, with the id of the member
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, member, coin *pb.UUID) ([]*pb.AccountDefined, error) {
+		return []*pb.AccountDefined{{Id: member, Owner: member, Currency: BTCRef}}, nil
+	}).AnyTimes()
+	api.EXPECT().AddPending(gomock.Any(), gomock.Any()).Return(&pb.AddPendingResponse{}, nil).AnyTimes()
+	api.EXPECT().ReleasePending(gomock.Any(), gomock.Any()).Return(&pb.ReleasePendingResponse{}, nil).AnyTimes()
+	// what the quote owner has locked less what was released to them
+	makerLocked := new(big.Int)
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, lr *rpcapi.LockBalance) error {
+		if bytes.Equal(lr.MemberId.Bytes, user1.Bytes) {
+			makerLocked.Add(makerLocked, new(big.Int).Sub(lr.ToAmount, lr.FromAmount))
+		}
+		return nil
+	}).AnyTimes()
+	var released string
+	api.EXPECT().ReleaselockedBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, req *pb.ReleaseLockedBalanceRequest) error {
+		if bytes.Equal(req.From.Bytes, user1.Bytes) {
+			amount, _ := new(big.Int).SetString(req.Amount, 10)
+			makerLocked.Sub(makerLocked, amount)
+			released = req.Amount
+		}
+		return nil
+	}).AnyTimes()
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
+
+	res, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: &pb.Quote{
+		Instrument:             FakeInstrumentRef,
+		Price:                  0.001,
+		Side:                   pb.OrderSide_ASK,
+		Owner:                  user1,
+		Type:                   pb.Quote_REGULAR,
+		Volume:                 "100000000",
+		MinValue:               "1000",
+		MaxValue:               "100000",
+		ExpireBy:               1800,
+		AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+	}})
+	assert.NilError(t, err)
+	assert.Equal(t, "100200401", makerLocked.String())
+	buy := &pb.BuyQuoteRequest{
+		QuoteId:   res.Id,
+		MemberId:  user2,
+		AccountId: user2,
+		Method:    pb.PaymentMethod_BANK,
+		Volume:    "10000000",
+		Value:     "10000",
+	}
+	bo, err := rpcServer.DoBuyQuote(ctx, buy)
+	assert.NilError(t, err)
+
+	// paused, only the 0.1 BTC of the open order stays locked
+	paused, err := rpcServer.DoPauseQuote(ctx, &rpc.PauseQuoteRequest{QuoteId: res.Id, MemberId: user1, ReleaseCollateral: true})
+	assert.NilError(t, err)
+	assert.Equal(t, released, paused.Released)
+	qd, err := rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: res.Id})
+	assert.NilError(t, err)
+	assert.Equal(t, pb.Quote_OFF, qd.Quote.Status)
+	volume, _ := new(big.Int).SetString(qd.Quote.Volume, 10)
+	fee, _ := new(big.Int).SetString(qd.Quote.LockedFee, 10)
+	assert.Equal(t, paused.Released, volume.Add(volume, fee).String())
+	_, err = rpcServer.DoBuyQuote(ctx, buy)
+	assert.Assert(t, err != nil)
+	_, err = rpcServer.DoAmendQuote(ctx, &rpc.AmendQuoteRequest{QuoteId: res.Id, MemberId: user1, Volume: "50000000"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	resumed, err := rpcServer.DoResumeQuote(ctx, &rpc.ResumeQuoteRequest{QuoteId: res.Id, MemberId: user1})
+	assert.NilError(t, err)
+	assert.Equal(t, paused.Released, resumed.Relocked)
+	assert.Equal(t, "100200401", makerLocked.String())
+
+	// closed with an open order, the quote closes once the order is cancelled
+	del, err := rpcServer.DoDeleteQuote(ctx, &pb.DeleteQuoteRequest{Id: res.Id})
+	assert.NilError(t, err)
+	assert.Assert(t, del.Message != "Success")
+	qd, err = rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: res.Id})
+	assert.NilError(t, err)
+	assert.Equal(t, pb.Quote_OFF, qd.Quote.Status)
+	_, err = rpcServer.DoResumeQuote(ctx, &rpc.ResumeQuoteRequest{QuoteId: res.Id, MemberId: user1})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// only the buyer may cancel
+	sellerCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user1)))
+	_, err = rpcServer.DoCancelOrder(sellerCtx, &pb.CancelOtcOrderRequest{OrderId: bo.OrderId})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	buyerCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user2)))
+	_, err = rpcServer.DoCancelOrder(buyerCtx, &pb.CancelOtcOrderRequest{OrderId: bo.OrderId})
+	assert.NilError(t, err)
+	order, err := repository.NewOtcTradeRepository(db).GetOtcOrder(ctx, bo.OrderId)
+	assert.NilError(t, err)
+	assert.Equal(t, pb.OtcOrder_CANCELLED, order.Status)
+	qd, err = rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: res.Id})
+	assert.NilError(t, err)
+	assert.Equal(t, pb.Quote_CLOSED, qd.Quote.Status)
+	assert.Equal(t, "0", makerLocked.String())
+}
+
+func TestQuoteExpiry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	accId, _ := exutil.AtoUUID("5c7cff810948c6e942e3e6e3")
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(gomock.Any(), gomock.Any(), gomock.Any()).Return([]*pb.AccountDefined{{Id: accId, Owner: user1, Currency: BTCRef}}, nil).AnyTimes()
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).Return(nil)
+	var released string
+	api.EXPECT().ReleaselockedBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, req *pb.ReleaseLockedBalanceRequest) error {
+		released = req.Amount
+		return nil
+	})
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
+
+	res, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: &pb.Quote{
+		Instrument:             FakeInstrumentRef,
+		Price:                  0.001,
+		Side:                   pb.OrderSide_ASK,
+		Owner:                  user1,
+		Type:                   pb.Quote_REGULAR,
+		Volume:                 "100000000",
+		AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+	}})
+	assert.NilError(t, err)
+	now := time.Now()
+	_, err = rpcServer.DoSetQuoteExpiry(ctx, &rpc.SetQuoteExpiryRequest{QuoteId: res.Id, MemberId: user1, ExpiresAt: now.Add(-time.Minute).UnixNano()})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = rpcServer.DoSetQuoteExpiry(ctx, &rpc.SetQuoteExpiryRequest{QuoteId: res.Id, MemberId: user1, ExpiresAt: now.Add(time.Hour).UnixNano()})
+	assert.NilError(t, err)
+	quotes := repository.NewQuoteRepo(db)
+	expired, err := quotes.SearchExpiredQuotes(ctx, now.UnixNano())
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(expired))
+
+	// past its expiry the quote takes no orders until the worker closes it
+	expired, err = quotes.SearchExpiredQuotes(ctx, now.Add(2*time.Hour).UnixNano())
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(expired))
+	assert.NilError(t, quotes.SetQuoteExpiry(ctx, res.Id, now.UnixNano()))
+	_, err = rpcServer.DoPreviewOrder(ctx, &rpc.PreviewOrderRequest{QuoteId: res.Id, MemberId: user2, Volume: "10000000"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	systemCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorRoleHeader, string(orderstate.RoleSystem)))
+	_, err = rpcServer.DoDeleteQuote(systemCtx, &pb.DeleteQuoteRequest{Id: res.Id})
+	assert.NilError(t, err)
+	assert.Equal(t, "100200401", released)
+	qd, err := rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: res.Id})
+	assert.NilError(t, err)
+	assert.Equal(t, pb.Quote_CLOSED, qd.Quote.Status)
+	assert.Equal(t, pb.OrderEventType_CANCEL_ORDER, qd.Quote.Events[len(qd.Quote.Events)-1].Type)
+}
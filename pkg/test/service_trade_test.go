@@ -1,15 +1,27 @@
 package test
 
 import (
+	"bytes"
 	context "context"
+	"math/big"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/sdce/exlib/exutil"
 	exmongo "gitlab.com/sdce/exlib/mongo"
 	pb "gitlab.com/sdce/protogo"
+	rpcapi "gitlab.com/sdce/service/otc/pkg/api"
+	"gitlab.com/sdce/service/otc/pkg/orderstate"
+	"gitlab.com/sdce/service/otc/pkg/repository"
 	"gitlab.com/sdce/service/otc/pkg/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gotest.tools/assert"
 )
 
 func TestBuyOrder(t *testing.T) {
@@ -51,6 +63,7 @@ func TestBuyOrder(t *testing.T) {
 	api.EXPECT().LockAccountBalance(ctx, gomock.Any()).Return(nil)
 	//	api.EXPECT().FindMemberAccount(ctx, user1, coin).Return(accounts, nil)
 	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
 
 	req := &pb.CreateQuoteRequest{
 		Quote:  q,
@@ -133,6 +146,7 @@ func TestSellOrder(t *testing.T) {
 	api.EXPECT().LockAccountBalance(ctx, gomock.Any()).Return(nil)
 	//	api.EXPECT().FindMemberAccount(ctx, user1, coin).Return(accounts, nil)
 	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
 
 	req := &pb.CreateQuoteRequest{
 		Quote:  q,
@@ -166,6 +180,21 @@ func TestSellOrder(t *testing.T) {
 		t.Fail()
 	}
 	log.Infof("newly created order %s", exutil.UUIDtoA(boRes.OrderId))
+
+	// the preview of the same trade matches the order placed
+	order, err := repository.NewOtcTradeRepository(db).GetOtcOrder(ctx, boRes.OrderId)
+	assert.NilError(t, err)
+	preview, err := rpcServer.DoPreviewOrder(ctx, &rpc.PreviewOrderRequest{
+		QuoteId:  created,
+		MemberId: user1,
+		Volume:   bReq.Volume,
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, pb.OrderSide_ASK, preview.Side)
+	assert.Equal(t, order.Value, preview.Value)
+	assert.Equal(t, order.Fee, preview.Fee)
+	assert.Equal(t, order.Price, preview.Price)
+	assert.Equal(t, bReq.Volume, preview.LockAmount)
 	db.Db.Drop(ctx)
 }
 
@@ -208,6 +237,7 @@ func TestUpdateOrder(t *testing.T) {
 	api.EXPECT().LockAccountBalance(ctx, gomock.Any()).Return(nil)
 	//	api.EXPECT().FindMemberAccount(ctx, user1, coin).Return(accounts, nil)
 	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
 
 	req := &pb.CreateQuoteRequest{
 		Quote:  q,
@@ -281,6 +311,7 @@ func TestUpdateOtcOrder(t *testing.T) {
 	}
 
 	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
 
 	accId1, _ := exutil.AtoUUID("5c7f6bc09e7405297329f087")
 	accId2, _ := exutil.AtoUUID("5c7cff810948c6e942e3e6e3")
@@ -342,7 +373,13 @@ func TestUpdateOtcOrder(t *testing.T) {
 		Status:   pb.OtcOrder_PAID,
 	}
 
-	uoRes, err := rpcServer.DoUpdateOrder(ctx, uoReq)
+	// only the buyer may mark an order paid
+	sellerCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user1)))
+	_, err = rpcServer.DoUpdateOrder(sellerCtx, uoReq)
+	assert.Equal(t, status.Code(err), codes.PermissionDenied)
+
+	buyerCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user2)))
+	uoRes, err := rpcServer.DoUpdateOrder(buyerCtx, uoReq)
 	if err != nil {
 		log.Errorf("cannot update order %v", err)
 		t.Fail()
@@ -351,3 +388,693 @@ func TestUpdateOtcOrder(t *testing.T) {
 	log.Infof("updated order successed %v", uoRes.Message)
 	db.Db.Drop(ctx)
 }
+
+func TestConcurrentBuyQuote(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	user1, _ := exutil.AtoUUID("5c7e0420ae3e23c93982b684")
+	user2, _ := exutil.AtoUUID("5c7f72aaae9411b00e000491")
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+
+	q := &pb.Quote{
+		Instrument:             FakeInstrumentRef,
+		Price:                  0.001,
+		Side:                   pb.OrderSide_ASK,
+		Owner:                  user1,
+		Type:                   pb.Quote_REGULAR,
+		Volume:                 "100000000",
+		Value:                  "100000",
+		MinValue:               "0",
+		MaxValue:               "100000",
+		ExpireBy:               1800,
+		Events:                 []*pb.OrderEvent{},
+		AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+	}
+
+	accId, _ := exutil.AtoUUID("5c7cff810948c6e942e3e6e3")
+	fakeAcc := &pb.AccountDefined{
+		Id:       accId,
+		OnHold:   "0",
+		Balance:  "100000000",
+		Owner:    user2,
+		Currency: BTCRef,
+	}
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	api.EXPECT().ReleaselockedBalance(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(gomock.Any(), gomock.Any(), gomock.Any()).Return([]*pb.AccountDefined{fakeAcc}, nil).AnyTimes()
+	api.EXPECT().AddPending(gomock.Any(), gomock.Any()).Return(&pb.AddPendingResponse{}, nil).AnyTimes()
+	api.EXPECT().ReleasePending(gomock.Any(), gomock.Any()).Return(&pb.ReleasePendingResponse{}, nil).AnyTimes()
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
+
+	res, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{
+		Quote:  q,
+		Method: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+	})
+	if err != nil {
+		log.Errorf("failed to create quote: %v", err)
+		t.FailNow()
+	}
+	created := res.GetId()
+
+	// 20 orders of 0.1 BTC against a 1 BTC quote: exactly 10 can be filled
+	const buyers = 20
+	var (
+		wg     sync.WaitGroup
+		filled int32
+	)
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := rpcServer.DoBuyQuote(ctx, &pb.BuyQuoteRequest{
+				QuoteId:   created,
+				MemberId:  user2,
+				AccountId: accId,
+				Method:    pb.PaymentMethod_BANK,
+				Volume:    "10000000",
+				Value:     "10000",
+			})
+			if err == nil {
+				atomic.AddInt32(&filled, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	qd, err := rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: created})
+	if err != nil {
+		log.Errorf("failed to get quote")
+		t.FailNow()
+	}
+	assert.Assert(t, filled == 10, "10 orders should be filled, got %d", filled)
+	assert.Assert(t, qd.GetQuote().Volume == "0", "quote volume should be exhausted, got %s", qd.GetQuote().Volume)
+	assert.Assert(t, qd.GetQuote().ProcessingVolume == "100000000", "quote processing volume should be 100000000, got %s", qd.GetQuote().ProcessingVolume)
+	db.Db.Drop(ctx)
+}
+
+func TestInstantTrade(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	accId, _ := exutil.AtoUUID("5c7cff810948c6e942e3e6e3")
+	fakeAcc := &pb.AccountDefined{Id: accId, Owner: user2, Currency: BTCRef}
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	api.EXPECT().ReleaselockedBalance(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(gomock.Any(), gomock.Any(), gomock.Any()).Return([]*pb.AccountDefined{fakeAcc}, nil).AnyTimes()
+	api.EXPECT().AddPending(gomock.Any(), gomock.Any()).Return(&pb.AddPendingResponse{}, nil).AnyTimes()
+	api.EXPECT().ReleasePending(gomock.Any(), gomock.Any()).Return(&pb.ReleasePendingResponse{}, nil).AnyTimes()
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1, user3)
+
+	// 0.5 BTC at 0.002 and 0.5 BTC at 0.001, orders of at most 40000 each
+	for i, price := range []float64{0.002, 0.001} {
+		_, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: &pb.Quote{
+			Instrument:             FakeInstrumentRef,
+			Price:                  price,
+			Side:                   pb.OrderSide_ASK,
+			Owner:                  []*pb.UUID{user1, user3}[i],
+			Type:                   pb.Quote_REGULAR,
+			Volume:                 "50000000",
+			MinValue:               "1000",
+			MaxValue:               "40000",
+			ExpireBy:               1800,
+			AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+		}})
+		assert.NilError(t, err)
+	}
+
+	// more than both quotes hold is refused without placing any order
+	_, err := rpcServer.DoInstantTrade(ctx, &rpc.InstantTradeRequest{
+		MemberId:   user2,
+		Instrument: FakeInstrumentRef.Code,
+		Side:       pb.OrderSide_BID,
+		Volume:     "90000000",
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// the cheaper quote fills up to its 40000 limit, the rest comes from the other one
+	res, err := rpcServer.DoInstantTrade(ctx, &rpc.InstantTradeRequest{
+		MemberId:   user2,
+		Instrument: FakeInstrumentRef.Code,
+		Side:       pb.OrderSide_BID,
+		Volume:     "50000000",
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(res.OrderIds))
+	assert.Equal(t, "50000000", res.Volume)
+	assert.Equal(t, "60000", res.Value)
+	assert.Equal(t, "1200.00000000", res.AveragePrice)
+}
+
+func TestPlanInstantTrade(t *testing.T) {
+	quote := func(owner *pb.UUID, price float64, volume, value, minValue, maxValue string) *pb.Quote {
+		return &pb.Quote{Id: exutil.NewUUID(), Owner: owner, Instrument: FakeInstrumentRef, Price: price,
+			Volume: volume, Value: value, MinValue: minValue, MaxValue: maxValue}
+	}
+	quotes := []*pb.Quote{
+		// the member's own quote is never traded on
+		quote(user2, 0.0005, "100000000", "50000", "1000", "100000"),
+		// orders of at most 20000 on a quote with 30000 left
+		quote(user1, 0.001, "30000000", "30000", "1000", "20000"),
+		// 20000 left of a quote with orders up to 100000
+		quote(user3, 0.002, "10000000", "20000", "1000", "100000"),
+		// orders of at least 5000
+		quote(user4, 0.003, "100000000", "300000", "5000", "100000"),
+	}
+	cases := []struct {
+		amount   int64
+		byVolume bool
+		// volume and value of each leg, on the quotes from the second on
+		legs [][2]int64
+	}{
+		{25000000, true, [][2]int64{{20000000, 20000}, {5000000, 10000}}},
+		{32000000, true, [][2]int64{{20000000, 20000}, {10000000, 20000}, {2000000, 6000}}},
+		// 1000000 more at 0.003 is below the minimum of the last quote
+		{31000000, true, nil},
+		{25000, false, [][2]int64{{20000000, 20000}, {2500000, 5000}}},
+		{46000, false, [][2]int64{{20000000, 20000}, {10000000, 20000}, {2000000, 6000}}},
+		{41000, false, nil},
+	}
+	for _, c := range cases {
+		legs, err := rpc.PlanInstantTrade(quotes, user2, big.NewInt(c.amount), c.byVolume)
+		if c.legs == nil {
+			assert.Equal(t, codes.FailedPrecondition, status.Code(err), "amount %d", c.amount)
+			continue
+		}
+		assert.NilError(t, err, "amount %d", c.amount)
+		assert.Equal(t, len(c.legs), len(legs), "amount %d", c.amount)
+		for i, leg := range legs {
+			assert.Equal(t, quotes[i+1], leg.Quote)
+			assert.Equal(t, c.legs[i][0], leg.Volume.Int64(), "amount %d leg %d", c.amount, i)
+			assert.Equal(t, c.legs[i][1], leg.Value.Int64(), "amount %d leg %d", c.amount, i)
+		}
+	}
+
+	// what is left by value after rounding down to whole units does not buy another one
+	legs, err := rpc.PlanInstantTrade([]*pb.Quote{quote(user1, 3, "1000", "3000", "1", "3000")}, user2, big.NewInt(10), false)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(legs))
+	assert.Equal(t, int64(3), legs[0].Volume.Int64())
+	assert.Equal(t, int64(9), legs[0].Value.Int64())
+
+	// only the member's own quote is left
+	_, err = rpc.PlanInstantTrade(quotes[:1], user2, big.NewInt(1000000), true)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestKillSwitch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	// each member has one account, with the id of the member
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, member, coin *pb.UUID) ([]*pb.AccountDefined, error) {
+		return []*pb.AccountDefined{{Id: member, Owner: member, Currency: BTCRef}}, nil
+	}).AnyTimes()
+	api.EXPECT().AddPending(gomock.Any(), gomock.Any()).Return(&pb.AddPendingResponse{}, nil).AnyTimes()
+	api.EXPECT().ReleasePending(gomock.Any(), gomock.Any()).Return(&pb.ReleasePendingResponse{}, nil).AnyTimes()
+	// what the quote owner has locked less what was released to them
+	makerLocked := new(big.Int)
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, lr *rpcapi.LockBalance) error {
+		if bytes.Equal(lr.MemberId.Bytes, user1.Bytes) {
+			makerLocked.Add(makerLocked, new(big.Int).Sub(lr.ToAmount, lr.FromAmount))
+		}
+		return nil
+	}).AnyTimes()
+	api.EXPECT().ReleaselockedBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, req *pb.ReleaseLockedBalanceRequest) error {
+		if bytes.Equal(req.From.Bytes, user1.Bytes) {
+			amount, _ := new(big.Int).SetString(req.Amount, 10)
+			makerLocked.Sub(makerLocked, amount)
+		}
+		return nil
+	}).AnyTimes()
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
+
+	var quoteIds []*pb.UUID
+	for i := 0; i < 2; i++ {
+		res, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: &pb.Quote{
+			Instrument:             FakeInstrumentRef,
+			Price:                  0.001,
+			Side:                   pb.OrderSide_ASK,
+			Owner:                  user1,
+			Type:                   pb.Quote_REGULAR,
+			Volume:                 "100000000",
+			MinValue:               "1000",
+			MaxValue:               "100000",
+			ExpireBy:               1800,
+			AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+		}})
+		assert.NilError(t, err)
+		quoteIds = append(quoteIds, res.Id)
+	}
+	bo, err := rpcServer.DoBuyQuote(ctx, &pb.BuyQuoteRequest{
+		QuoteId:   quoteIds[0],
+		MemberId:  user2,
+		AccountId: user2,
+		Method:    pb.PaymentMethod_BANK,
+		Volume:    "10000000",
+		Value:     "10000",
+	})
+	assert.NilError(t, err)
+
+	// the quote with the unpaid order closes once the order is cancelled
+	_, err = rpcServer.DoAdminKillSwitch(metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user4))),
+		&rpc.AdminKillSwitchRequest{MemberId: user1, Reason: "bank account frozen"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	adminCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user4),
+		orderstate.ActorRoleHeader, string(orderstate.RoleAdmin)))
+	res, err := rpcServer.DoAdminKillSwitch(adminCtx, &rpc.AdminKillSwitchRequest{MemberId: user1, Reason: "bank account frozen"})
+	assert.NilError(t, err)
+	assert.Equal(t, int32(0), res.Failed)
+	assert.Equal(t, 3, len(res.Items))
+	for _, item := range res.Items {
+		if item.OrderId != nil {
+			assert.Assert(t, bytes.Equal(bo.OrderId.Bytes, item.OrderId.Bytes))
+			assert.Equal(t, rpc.KillCancelled, item.Status)
+		} else {
+			assert.Equal(t, rpc.KillClosed, item.Status)
+		}
+	}
+	for _, id := range quoteIds {
+		qd, err := rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: id})
+		assert.NilError(t, err)
+		assert.Equal(t, pb.Quote_CLOSED, qd.Quote.Status)
+	}
+	assert.Equal(t, "0", makerLocked.String())
+
+	// nothing is left to do when it is pulled again
+	res, err = rpcServer.DoKillSwitch(ctx, &rpc.KillSwitchRequest{MemberId: user1})
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(res.Items))
+}
+
+func TestAmendOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	// each member has one account, with the id of the member
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, member, coin *pb.UUID) ([]*pb.AccountDefined, error) {
+		return []*pb.AccountDefined{{Id: member, Owner: member, Currency: BTCRef}}, nil
+	}).AnyTimes()
+	// what the buyer has locked and the pending amount of their account
+	buyerLocked, pending := new(big.Int), new(big.Int)
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, lr *rpcapi.LockBalance) error {
+		if bytes.Equal(lr.MemberId.Bytes, user2.Bytes) {
+			buyerLocked.Add(buyerLocked, new(big.Int).Sub(lr.ToAmount, lr.FromAmount))
+		}
+		return nil
+	}).AnyTimes()
+	api.EXPECT().ReleaselockedBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, req *pb.ReleaseLockedBalanceRequest) error {
+		if bytes.Equal(req.From.Bytes, user2.Bytes) {
+			amount, _ := new(big.Int).SetString(req.Amount, 10)
+			buyerLocked.Sub(buyerLocked, amount)
+		}
+		return nil
+	}).AnyTimes()
+	api.EXPECT().AddPending(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, req *pb.AddPendingRequest) (*pb.AddPendingResponse, error) {
+		amount, _ := new(big.Int).SetString(req.Amount, 10)
+		pending.Add(pending, amount)
+		return &pb.AddPendingResponse{}, nil
+	}).AnyTimes()
+	api.EXPECT().ReleasePending(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, req *pb.ReleasePendingRequest) (*pb.ReleasePendingResponse, error) {
+		amount, _ := new(big.Int).SetString(req.Amount, 10)
+		pending.Sub(pending, amount)
+		return &pb.ReleasePendingResponse{}, nil
+	}).AnyTimes()
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
+
+	res, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: &pb.Quote{
+		Instrument:             FakeInstrumentRef,
+		Price:                  0.001,
+		Side:                   pb.OrderSide_ASK,
+		Owner:                  user1,
+		Type:                   pb.Quote_REGULAR,
+		Volume:                 "100000000",
+		MinValue:               "1000",
+		MaxValue:               "100000",
+		ExpireBy:               1800,
+		AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+	}})
+	assert.NilError(t, err)
+	bo, err := rpcServer.DoBuyQuote(ctx, &pb.BuyQuoteRequest{
+		QuoteId:   res.Id,
+		MemberId:  user2,
+		AccountId: user2,
+		Method:    pb.PaymentMethod_BANK,
+		Volume:    "10000000",
+		Value:     "10000",
+	})
+	assert.NilError(t, err)
+	before, err := rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: res.Id})
+	assert.NilError(t, err)
+	lockedBefore := new(big.Int).Set(buyerLocked)
+	assert.Equal(t, "10000000", pending.String())
+
+	sellerCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user1)))
+	buyerCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user2)))
+	otherCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user3)))
+	amend := func(ctx context.Context, volume, value string) (*rpc.AmendOrderResponse, error) {
+		return rpcServer.DoAmendOrder(ctx, &rpc.AmendOrderRequest{OrderId: bo.OrderId, Volume: volume, Value: value})
+	}
+
+	_, err = amend(otherCtx, "5000000", "5000")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = amend(buyerCtx, "20000000", "20000")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// sending your own proposal again does not agree to it, and a counter-proposal rejects it
+	out, err := amend(buyerCtx, "5000000", "5000")
+	assert.NilError(t, err)
+	assert.Assert(t, !out.Applied)
+	out, err = amend(buyerCtx, "5000000", "5000")
+	assert.NilError(t, err)
+	assert.Assert(t, !out.Applied)
+	out, err = amend(sellerCtx, "6000000", "6000")
+	assert.NilError(t, err)
+	assert.Assert(t, !out.Applied)
+	order, err := repository.NewOtcTradeRepository(db).GetOtcOrder(ctx, bo.OrderId)
+	assert.NilError(t, err)
+	assert.Equal(t, "10000000", order.Volume)
+	assert.Equal(t, lockedBefore.String(), buyerLocked.String())
+	assert.Equal(t, "10000000", pending.String())
+
+	// the counter-proposal applies once the buyer agrees to it
+	out, err = amend(buyerCtx, "6000000", "6000")
+	assert.NilError(t, err)
+	assert.Assert(t, out.Applied)
+	order, err = repository.NewOtcTradeRepository(db).GetOtcOrder(ctx, bo.OrderId)
+	assert.NilError(t, err)
+	assert.Equal(t, "6000000", order.Volume)
+	assert.Equal(t, "6000", order.Value)
+	fees, err := repository.NewOtcTradeRepository(db).GetOtcOrderFees(ctx, bo.OrderId)
+	assert.NilError(t, err)
+	lockedFee := "0"
+	if fees != nil && fees.Currency == repository.FeeCurrencyQuote {
+		lockedFee = fees.Taker
+	}
+	fee, _ := new(big.Int).SetString(lockedFee, 10)
+	assert.Equal(t, new(big.Int).Add(big.NewInt(6000), fee).String(), buyerLocked.String())
+	assert.Equal(t, "6000000", pending.String())
+
+	after, err := rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: res.Id})
+	assert.NilError(t, err)
+	volumeBefore, _ := new(big.Int).SetString(before.Quote.Volume, 10)
+	valueBefore, _ := new(big.Int).SetString(before.Quote.Value, 10)
+	assert.Equal(t, new(big.Int).Add(volumeBefore, big.NewInt(4000000)).String(), after.Quote.Volume)
+	assert.Equal(t, new(big.Int).Add(valueBefore, big.NewInt(4000)).String(), after.Quote.Value)
+	assert.Equal(t, "6000000", after.Quote.ProcessingVolume)
+
+	// the amendment is gone once applied
+	_, err = amend(sellerCtx, "6000000", "6000")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestConcurrentCompleteOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	// each member has one account, with the id of the member
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, member, coin *pb.UUID) ([]*pb.AccountDefined, error) {
+		return []*pb.AccountDefined{{Id: member, Owner: member, Currency: BTCRef}}, nil
+	}).AnyTimes()
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	api.EXPECT().AddPending(gomock.Any(), gomock.Any()).Return(&pb.AddPendingResponse{}, nil).AnyTimes()
+	api.EXPECT().ReleasePending(gomock.Any(), gomock.Any()).Return(&pb.ReleasePendingResponse{}, nil).AnyTimes()
+	// coin goes from the seller, user1, to the buyer, user2
+	var coinReleases int32
+	api.EXPECT().ReleaselockedBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, req *pb.ReleaseLockedBalanceRequest) error {
+		if bytes.Equal(req.From.Bytes, user1.Bytes) && bytes.Equal(req.To.Bytes, user2.Bytes) {
+			atomic.AddInt32(&coinReleases, 1)
+			time.Sleep(100 * time.Millisecond)
+		}
+		return nil
+	}).AnyTimes()
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
+
+	res, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: &pb.Quote{
+		Instrument:             FakeInstrumentRef,
+		Price:                  0.001,
+		Side:                   pb.OrderSide_ASK,
+		Owner:                  user1,
+		Type:                   pb.Quote_REGULAR,
+		Volume:                 "100000000",
+		MinValue:               "1000",
+		MaxValue:               "100000",
+		ExpireBy:               1800,
+		AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+	}})
+	assert.NilError(t, err)
+	bo, err := rpcServer.DoBuyQuote(ctx, &pb.BuyQuoteRequest{
+		QuoteId:   res.Id,
+		MemberId:  user2,
+		AccountId: user2,
+		Method:    pb.PaymentMethod_BANK,
+		Volume:    "10000000",
+		Value:     "10000",
+	})
+	assert.NilError(t, err)
+	buyerCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user2)))
+	_, err = rpcServer.DoUpdateOrder(buyerCtx, &pb.UpdateOtcOrderStatusRequest{OrderId: bo.OrderId, Status: pb.OtcOrder_PAID})
+	assert.NilError(t, err)
+
+	// the seller releasing twice at once releases the coin once
+	sellerCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user1)))
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := rpcServer.DoUpdateOrder(sellerCtx, &pb.UpdateOtcOrderStatusRequest{OrderId: bo.OrderId, Status: pb.OtcOrder_COMPLETED})
+			if err != nil {
+				assert.Equal(t, codes.Aborted, status.Code(err))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&coinReleases))
+	order, err := repository.NewOtcTradeRepository(db).GetOtcOrder(ctx, bo.OrderId)
+	assert.NilError(t, err)
+	assert.Equal(t, pb.OtcOrder_COMPLETED, order.Status)
+}
+
+func TestResolveAppeal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := NewMockApi(ctrl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+
+	// each member has one account per coin, so coin and value moves can be told apart
+	var mu sync.Mutex
+	accounts := map[string]*pb.UUID{}
+	account := func(member, coin *pb.UUID) *pb.UUID {
+		mu.Lock()
+		defer mu.Unlock()
+		key := exutil.UUIDtoA(member) + exutil.UUIDtoA(coin)
+		if accounts[key] == nil {
+			accounts[key] = exutil.NewUUID()
+		}
+		return accounts[key]
+	}
+	// moved sums the released amounts by source and destination account
+	moved := map[string]*big.Int{}
+	move := func(from, to *pb.UUID) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if m, ok := moved[exutil.UUIDtoA(from)+exutil.UUIDtoA(to)]; ok {
+			return m.String()
+		}
+		return "0"
+	}
+	api.EXPECT().FindMember(gomock.Any(), gomock.Any()).Return(&pb.MemberDefined{}, nil).AnyTimes()
+	api.EXPECT().FindMemberAccount(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, member, coin *pb.UUID) ([]*pb.AccountDefined, error) {
+		return []*pb.AccountDefined{{Id: account(member, coin), Owner: member, Currency: BTCRef}}, nil
+	}).AnyTimes()
+	api.EXPECT().LockAccountBalance(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	api.EXPECT().AddPending(gomock.Any(), gomock.Any()).Return(&pb.AddPendingResponse{}, nil).AnyTimes()
+	api.EXPECT().ReleasePending(gomock.Any(), gomock.Any()).Return(&pb.ReleasePendingResponse{}, nil).AnyTimes()
+	api.EXPECT().ReleaselockedBalance(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, req *pb.ReleaseLockedBalanceRequest) error {
+		mu.Lock()
+		defer mu.Unlock()
+		key := exutil.UUIDtoA(req.From) + exutil.UUIDtoA(req.To)
+		if moved[key] == nil {
+			moved[key] = new(big.Int)
+		}
+		amount, _ := new(big.Int).SetString(req.Amount, 10)
+		moved[key].Add(moved[key], amount)
+		return nil
+	}).AnyTimes()
+	rpcServer := rpc.NewOtcTradingServer(api, db)
+	setUpBank(ctx, t, rpcServer, user1)
+
+	// no fees, so the settled amounts are exact
+	_, err := repository.NewFeeScheduleRepo(db).CreateFeeSchedule(ctx, &repository.FeeSchedule{
+		Instrument:    "tuzi-rmb",
+		EffectiveFrom: time.Now().Add(-time.Hour).UnixNano(),
+		Tiers:         []*repository.FeeTier{{MinVolume: "0", Rate: "0"}},
+	})
+	assert.NilError(t, err)
+	res, err := rpcServer.DoCreateQuote(ctx, &pb.CreateQuoteRequest{Quote: &pb.Quote{
+		Instrument:             FakeInstrumentRef,
+		Price:                  0.001,
+		Side:                   pb.OrderSide_ASK,
+		Owner:                  user1,
+		Type:                   pb.Quote_REGULAR,
+		Volume:                 "100000000",
+		MinValue:               "1000",
+		MaxValue:               "100000",
+		ExpireBy:               1800,
+		AcceptedPaymentMethods: []pb.PaymentMethod{pb.PaymentMethod_BANK},
+	}})
+	assert.NilError(t, err)
+
+	buyerCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user2)))
+	adminCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(orderstate.ActorIdHeader, exutil.UUIDtoA(user3),
+		orderstate.ActorRoleHeader, string(orderstate.RoleAdmin)))
+	// appeal buys 10000000 for 10000 from user1 and has the buyer appeal it, after paying if paid
+	appeal := func(paid bool) *pb.UUID {
+		bo, err := rpcServer.DoBuyQuote(ctx, &pb.BuyQuoteRequest{
+			QuoteId:   res.Id,
+			MemberId:  user2,
+			AccountId: user2,
+			Method:    pb.PaymentMethod_BANK,
+			Volume:    "10000000",
+			Value:     "10000",
+		})
+		assert.NilError(t, err)
+		if paid {
+			_, err = rpcServer.DoUpdateOrder(buyerCtx, &pb.UpdateOtcOrderStatusRequest{OrderId: bo.OrderId, Status: pb.OtcOrder_PAID})
+			assert.NilError(t, err)
+		}
+		_, err = rpcServer.DoUpdateOrder(buyerCtx, &pb.UpdateOtcOrderStatusRequest{OrderId: bo.OrderId, Status: pb.OtcOrder_APPEAL})
+		assert.NilError(t, err)
+		mu.Lock()
+		moved = map[string]*big.Int{}
+		mu.Unlock()
+		return bo.OrderId
+	}
+	resolve := func(orderId *pb.UUID, outcome rpc.AppealOutcome, buyerVolume string) (*rpc.ResolveAppealResponse, error) {
+		return rpcServer.DoResolveAppeal(adminCtx, &rpc.ResolveAppealRequest{
+			OrderId:     orderId,
+			Outcome:     outcome,
+			BuyerVolume: buyerVolume,
+			Reason:      "checked the bank statement",
+		})
+	}
+	quoteDetails := func() *pb.Quote {
+		q, err := rpcServer.DoGetQuoteDetails(ctx, &pb.GetQuoteDetailsRequest{QuoteId: res.Id})
+		assert.NilError(t, err)
+		return q.Quote
+	}
+	sellerCoin, buyerCoin := account(user1, BTCRef.Id), account(user2, BTCRef.Id)
+	sellerValue, buyerValue := account(user1, AUDRef.Id), account(user2, AUDRef.Id)
+
+	// releasing to the buyer of a paid order gives them the coin. Only an admin may resolve it.
+	orderId := appeal(true)
+	_, err = rpcServer.DoResolveAppeal(buyerCtx, &rpc.ResolveAppealRequest{OrderId: orderId, Outcome: rpc.AppealReleaseToBuyer, Reason: "paid"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = resolve(orderId, rpc.AppealReleaseToBuyer, "")
+	assert.NilError(t, err)
+	assert.Equal(t, "10000000", move(sellerCoin, buyerCoin))
+	assert.Equal(t, "0", move(sellerValue, buyerValue))
+	order, err := repository.NewOtcTradeRepository(db).GetOtcOrder(ctx, orderId)
+	assert.NilError(t, err)
+	assert.Equal(t, pb.OtcOrder_RESOLVED, order.Status)
+
+	// a second resolve is rejected and moves nothing
+	_, err = resolve(orderId, rpc.AppealRefundSeller, "")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, "10000000", move(sellerCoin, buyerCoin))
+	assert.Equal(t, "0", move(sellerValue, buyerValue))
+
+	// refunding a paid order gives the value back to the buyer and the coin back to the quote
+	orderId = appeal(true)
+	before := quoteDetails()
+	out, err := resolve(orderId, rpc.AppealRefundSeller, "")
+	assert.NilError(t, err)
+	assert.Equal(t, pb.OtcOrder_CANCELLED, out.Status)
+	assert.Equal(t, "10000", move(sellerValue, buyerValue))
+	assert.Equal(t, "0", move(sellerCoin, buyerCoin))
+	after := quoteDetails()
+	beforeVolume, _ := new(big.Int).SetString(before.Volume, 10)
+	assert.Equal(t, new(big.Int).Add(beforeVolume, big.NewInt(10000000)).String(), after.Volume)
+
+	// a split of an unpaid order has the buyer pay for their part, the rest goes back
+	orderId = appeal(false)
+	before = quoteDetails()
+	_, err = resolve(orderId, rpc.AppealSplit, "10000000")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = resolve(orderId, rpc.AppealSplit, "4000000")
+	assert.NilError(t, err)
+	assert.Equal(t, "4000", move(buyerValue, sellerValue))
+	assert.Equal(t, "6000", move(buyerValue, buyerValue))
+	assert.Equal(t, "4000000", move(sellerCoin, buyerCoin))
+	after = quoteDetails()
+	beforeVolume, _ = new(big.Int).SetString(before.Volume, 10)
+	assert.Equal(t, new(big.Int).Add(beforeVolume, big.NewInt(6000000)).String(), after.Volume)
+	_, err = resolve(orderId, rpc.AppealSplit, "4000000")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
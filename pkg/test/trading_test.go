@@ -3,6 +3,7 @@ package test
 import (
 	"context"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/sdce/exlib/exutil"
@@ -39,7 +40,7 @@ func TestOrderCreate(t *testing.T) {
 		Status:    pb.OtcOrder_UNPAID,
 	}
 
-	oid, err := trRepo.CreateOtcOrder(ctx, order)
+	oid, err := trRepo.CreateOtcOrder(ctx, order, nil)
 	if err != nil {
 		log.Errorf("failed to create otc order : %v", err)
 		t.Fail()
@@ -86,13 +87,13 @@ func TestOrderUpdate(t *testing.T) {
 		Events:    []*pb.OrderEvent{},
 	}
 
-	oid, err := trRepo.CreateOtcOrder(ctx, order)
+	oid, err := trRepo.CreateOtcOrder(ctx, order, nil)
 	if err != nil {
 		log.Errorf("failed to create otc order : %v", err)
 		t.Fail()
 	}
 
-	err = trRepo.UpdateOtcOrder(ctx, oid, "2000000000", "10000000000000")
+	err = trRepo.UpdateOtcOrder(ctx, oid, "2000000000", "10000000000000", "0")
 	if err != nil {
 		log.Errorf("failed to update otc order %v", err)
 		t.Fail()
@@ -101,7 +102,7 @@ func TestOrderUpdate(t *testing.T) {
 		MemberId: user1,
 	}
 
-	updated, err := trRepo.SearchOtcOrders(ctx, f)
+	updated, _, err := trRepo.SearchOtcOrders(ctx, f)
 	if err != nil {
 		log.Errorf("failed to search otc orders %v", err)
 		t.Fail()
@@ -110,20 +111,67 @@ func TestOrderUpdate(t *testing.T) {
 	assert.Assert(t, updated[0].Volume == "2000000000", "volume of updated order should be 2000000000")
 	assert.Assert(t, updated[0].Value == "10000000000000", "volume of updated order should be 2000000000")
 
-	err = trRepo.DeleteOtcOrder(ctx, oid)
-	if err != nil {
-		log.Errorf("failed to delete otc order %v", err)
-		t.Fail()
+	// amending only applies to an order still in the status it was checked in
+	assert.NilError(t, trRepo.AmendOtcOrder(ctx, oid, pb.OtcOrder_UNPAID, "1500000000", "7500000000000", "0"))
+	assert.NilError(t, trRepo.UpdateOtcOrderStatus(ctx, oid, exutil.NewUUID(), pb.OtcOrder_UNPAID, pb.OtcOrder_PAID, nil))
+	err = trRepo.AmendOtcOrder(ctx, oid, pb.OtcOrder_UNPAID, "1000000000", "5000000000000", "0")
+	assert.Equal(t, repository.ErrOrderStatusChanged, err)
+	amended, err := trRepo.GetOtcOrder(ctx, oid)
+	assert.NilError(t, err)
+	assert.Equal(t, "1500000000", amended.Volume)
+
+	db.Db.Drop(ctx)
+}
+
+func TestSumCompletedVolume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := exmongo.Connect(ctx, exmongo.Config{
+		URI:    "mongodb://localhost:27017",
+		DbName: "test",
+	})
+	defer db.Close(ctx)
+	defer db.Db.Drop(ctx)
+	trRepo := repository.NewOtcTradeRepository(db)
+
+	// orders placed an hour ago count from when they complete
+	placed := time.Now().Add(-time.Hour).UnixNano()
+	create := func(code, volume string, status pb.OtcOrder_OrderStatus) *pb.UUID {
+		oid, err := trRepo.CreateOtcOrder(ctx, &pb.OtcOrder{
+			Side:       pb.OrderSide_BID,
+			MemberId:   user2,
+			QuoteOwner: user1,
+			QuoteId:    qid,
+			Instrument: &pb.InstrumentRef{Code: code},
+			Method:     pb.PaymentMethod_BANK,
+			Volume:     volume,
+			Value:      "1000",
+			Status:     status,
+			Time:       placed,
+		}, nil)
+		assert.NilError(t, err)
+		return oid
 	}
-	f2 := &repository.OrderFilter{
-		MemberId: user1,
+	since := time.Now().Add(-time.Minute).UnixNano()
+	for _, o := range []struct {
+		code, volume string
+	}{{"BTC-AUD", "100"}, {"btc-aud", "20"}, {"ETH-AUD", "3"}} {
+		oid := create(o.code, o.volume, pb.OtcOrder_PAID)
+		err := trRepo.UpdateOtcOrderStatus(ctx, oid, exutil.NewUUID(), pb.OtcOrder_PAID, pb.OtcOrder_COMPLETED, nil)
+		assert.NilError(t, err)
 	}
-	deleted, err := trRepo.SearchOtcOrders(ctx, f2)
-	if err != nil {
-		log.Errorf("failed to search otc orders %v", err)
-		t.Fail()
+	create("BTC-AUD", "4000", pb.OtcOrder_PAID)
+
+	for _, member := range []*pb.UUID{user1, user2} {
+		volume, err := trRepo.SumCompletedVolume(ctx, member, "btc-aud", since)
+		assert.NilError(t, err)
+		assert.Equal(t, "120", volume.String())
 	}
-	assert.Assert(t, len(deleted) == 1, "1 order should be returned")
-	assert.Assert(t, deleted[0].Status == pb.OtcOrder_CANCELLED, "otc order has been cancelled.")
-	db.Db.Drop(ctx)
+	volume, err := trRepo.SumCompletedVolume(ctx, user3, "btc-aud", since)
+	assert.NilError(t, err)
+	assert.Equal(t, "0", volume.String())
+	volume, err = trRepo.SumCompletedVolume(ctx, user1, "btc-aud", time.Now().UnixNano())
+	assert.NilError(t, err)
+	assert.Equal(t, "0", volume.String())
 }